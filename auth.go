@@ -0,0 +1,46 @@
+package vault
+
+import "github.com/keys-pub/vault/auth"
+
+// ErrLastAuth if removing the last auth method.
+var ErrLastAuth = auth.ErrLastAuth
+
+// ErrLastNonPasswordAuth if removing the last auth method that isn't a
+// password.
+var ErrLastNonPasswordAuth = auth.ErrLastNonPasswordAuth
+
+// RemoveAuthOptions for RemoveAuth.
+type RemoveAuthOptions struct {
+	// Force removes the last auth method (or last non-password auth method).
+	Force bool
+}
+
+// RemoveAuthOption for RemoveAuth.
+type RemoveAuthOption func(*RemoveAuthOptions)
+
+// WithForce removes the auth method even if it's the last auth method (or the
+// last non-password auth method).
+func WithForce() RemoveAuthOption {
+	return func(o *RemoveAuthOptions) {
+		o.Force = true
+	}
+}
+
+// RemoveAuth removes an auth method.
+// Returns ErrLastAuth if it's the last auth method, or ErrLastNonPasswordAuth
+// if it's the last auth method that isn't a password (needed to recover from a
+// forgotten password), unless WithForce.
+// Only auth methods for this vault (master key) can be removed.
+// Requires Unlock.
+func (v *Vault) RemoveAuth(id string, opt ...RemoveAuthOption) error {
+	c, err := v.useWrite()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	var opts RemoveAuthOptions
+	for _, o := range opt {
+		o(&opts)
+	}
+	return v.auth.Remove(c.mkID, id, opts.Force)
+}
@@ -7,19 +7,43 @@ type Auth struct {
 	// ID is an identifier for the auth.
 	ID string `msgpack:"id" db:"id"`
 
-	// EncryptedKey is a nacl secretbox encrypted master key using the auth key.
+	// EncryptedKey is the master key sealed to PublicKey, or for auth from
+	// before PublicKey, a nacl secretbox encrypted master key using the auth
+	// key.
 	EncryptedKey []byte `msgpack:"ek,omitempty" db:"ek"`
 
+	// PublicKey is the X25519 public key the master key is sealed to.
+	// This allows a new master key to be sealed for the auth when the master
+	// key is rotated, without the auth key.
+	PublicKey []byte `msgpack:"pk,omitempty" db:"pk"`
+	// SecretKey is a nacl secretbox encrypted X25519 private key (for
+	// PublicKey) using the auth key.
+	SecretKey []byte `msgpack:"sk,omitempty" db:"sk"`
+	// MasterKeyID identifies the master key (see auth.MasterKeyID).
+	MasterKeyID []byte `msgpack:"mkid,omitempty" db:"mkid"`
+
 	// Type of auth
 	Type Type `msgpack:"type,omitempty" db:"type"`
 
-	// Salt (for PasswordAuth and FIDO2HMACSecretAuth)
+	// Salt (for PasswordAuth and FIDO2HMACSecretAuth), or the challenge (for
+	// SSHAgentAuth), or the auth key sealed to the recipient (for X25519Auth).
 	Salt []byte `msgpack:"salt,omitempty" db:"salt"`
 
 	// AAGUID (for FIDO2HMACSecretAuth)
 	AAGUID string `msgpack:"aaguid,omitempty" json:"aaguid"`
 	// NoPin (for FIDO2HMACSecretAuth)
 	NoPin bool `msgpack:"nopin,omitempty" db:"nopin"`
+	// RP is the relying party ID (for FIDO2HMACSecretAuth).
+	RP string `msgpack:"rp,omitempty" db:"rp"`
+	// Derived if the master key is derived from the auth (for a FIDO2
+	// resident key from auth.DB.SetupFIDO2ResidentKey).
+	Derived bool `msgpack:"derived,omitempty" db:"derived"`
+
+	// KDF and parameters (for PasswordAuth).
+	KDF        string `msgpack:"kdf,omitempty" db:"kdf"`
+	KDFTime    uint32 `msgpack:"kdft,omitempty" db:"kdfTime"`
+	KDFMemory  uint32 `msgpack:"kdfm,omitempty" db:"kdfMemory"`
+	KDFThreads uint8  `msgpack:"kdfp,omitempty" db:"kdfThreads"`
 
 	CreatedAt time.Time `msgpack:"createdAt,omitempty" db:"createdAt"`
 
@@ -32,8 +56,12 @@ type Type string
 
 // Auth types.
 const (
-	UnknownType         Type = ""
-	PaperKeyType        Type = "paper-key"
-	PasswordType        Type = "password"
-	FIDO2HMACSecretType Type = "fido2-hmac-secret" // #nosec
+	UnknownType          Type = ""
+	PaperKeyType         Type = "paper-key"
+	ShamirType           Type = "shamir"
+	SSHAgentType         Type = "ssh-agent"
+	X25519Type           Type = "x25519"
+	PasswordType         Type = "password"
+	FIDO2HMACSecretType  Type = "fido2-hmac-secret" // #nosec
+	FIDO2ResidentKeyType Type = "fido2-resident-key"
 )
@@ -8,6 +8,26 @@ import (
 	"github.com/pkg/errors"
 )
 
+// SetVaultKeyID records the master key ID (see MasterKeyID) for a vault (by
+// path), so its auth methods can be cleared without the master key, for
+// example if the vault is reset while locked.
+// If mkID is nil, the record is removed.
+func (d *DB) SetVaultKeyID(vault string, mkID []byte) error {
+	if mkID == nil {
+		if _, err := d.db.Exec("DELETE FROM config WHERE key = $1", "mkid:"+vault); err != nil {
+			return errors.Wrapf(err, "failed to set config")
+		}
+		return nil
+	}
+	return setConfigBytes(d.db, "mkid:"+vault, mkID)
+}
+
+// VaultKeyID returns the master key ID for a vault (see SetVaultKeyID), or nil
+// if not recorded.
+func (d *DB) VaultKeyID(vault string) ([]byte, error) {
+	return getConfigBytes(d.db, "mkid:"+vault)
+}
+
 func setConfig(db *sqlx.DB, key string, value string) error {
 	if _, err := db.Exec("INSERT OR REPLACE INTO config (key, value) VALUES ($1, $2)", key, value); err != nil {
 		return errors.Wrapf(err, "failed to set config")
@@ -1,12 +1,16 @@
 package auth
 
 import (
+	"bytes"
 	"database/sql"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys-ext/auth/fido2"
 	kapi "github.com/keys-pub/keys/api"
+	"github.com/keys-pub/keys/tsutil"
 	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/migrate"
 	"github.com/keys-pub/vault/syncer"
 	"github.com/pkg/errors"
 
@@ -25,6 +29,17 @@ type Type = api.Type
 type DB struct {
 	db *sqlx.DB
 	ck *kapi.Key
+
+	// rotated are new master keys of a staged rotation, by master key, opened
+	// by an auth key (see unlockRotation).
+	rotated map[[32]byte]*[32]byte
+	rmtx    sync.Mutex
+
+	selector       DeviceSelector
+	rp             *fido2.RelyingParty
+	throttlePolicy ThrottlePolicy
+	clock          tsutil.Clock
+	kdf            KDFParams
 }
 
 // NewDB creates an DB for auth.
@@ -32,7 +47,7 @@ type DB struct {
 func NewDB(path string, opt ...Option) (*DB, error) {
 	opts := newOptions(opt...)
 
-	db, err := sqlx.Open("sqlite3", path)
+	db, err := sqlx.Open("sqlite3", path+"?"+migrate.TxLock)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to open db")
 	}
@@ -43,26 +58,45 @@ func NewDB(path string, opt ...Option) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db, ck: ck}, nil
+	return &DB{
+		db:             db,
+		ck:             ck,
+		rotated:        map[[32]byte]*[32]byte{},
+		selector:       opts.DeviceSelector,
+		rp:             opts.RP,
+		throttlePolicy: opts.Throttle,
+		clock:          opts.Clock,
+		kdf:            opts.KDF,
+	}, nil
 }
 
 func (d *DB) unlock(auth *Auth, key *[32]byte) *[32]byte {
-	k, ok := secretBoxOpen(auth.EncryptedKey, key)
-	if !ok {
+	mk := unwrapKey(auth, key)
+	if mk == nil {
 		logger.Debugf("Failed %s", auth.ID)
 		return nil
 	}
-	if len(k) != 32 {
-		return nil
+
+	// Auth from before master key rotation was supported has the master key
+	// encrypted with the auth key, so we re-wrap it now.
+	if len(auth.PublicKey) == 0 {
+		wrapKey(auth, key, mk)
+		if err := d.Set(auth); err != nil {
+			logger.Warningf("Failed to re-wrap key for %s: %v", auth.ID, err)
+		}
 	}
-	mk := keys.Bytes32(k)
+
+	d.unlockRotation(auth, key, mk)
 	return mk
 }
 
-func initTables(db *sqlx.DB) error {
-	stmts := []string{
+// migrations for the auth database, see migrate.Run.
+// Only add migrations to the end, and don't change existing migrations.
+var migrations = []migrate.Migration{
+	// 1: Initial tables
+	migrate.Exec(
 		`CREATE TABLE IF NOT EXISTS auth (
-			id TEXT NOT NULL PRIMARY KEY, 
+			id TEXT NOT NULL PRIMARY KEY,
 			ek BLOB,
 			type TEXT,
 			createdAt TIMESTAMP,
@@ -74,13 +108,47 @@ func initTables(db *sqlx.DB) error {
 			key TEXT PRIMARY KEY NOT NULL,
 			value TEXT NOT NULL
 		);`,
-	}
-	for _, stmt := range stmts {
-		if _, err := db.Exec(stmt); err != nil {
-			return err
-		}
-	}
-	return nil
+	),
+	// 2: Master key sealed to a key for the auth (for master key rotation).
+	// Auth from before this is re-wrapped on unlock (see wrapKey).
+	migrate.Steps(
+		migrate.AddColumn("auth", "pk", "BLOB"),
+		migrate.AddColumn("auth", "sk", "BLOB"),
+		migrate.AddColumn("auth", "mkid", "BLOB"),
+	),
+	// 3: Deleted flag
+	migrate.AddColumn("auth", "del", "BOOL NOT NULL DEFAULT 0"),
+	// 4: Relying party (FIDO2 credentials before this are for getchill.app)
+	migrate.Steps(
+		migrate.AddColumn("auth", "rp", "TEXT NOT NULL DEFAULT ''"),
+		migrate.Exec(`UPDATE auth SET rp = 'getchill.app' WHERE rp = '' AND type IN ('fido2-hmac-secret', 'fido2-resident-key');`),
+	),
+	// 5: Failed attempts (see ThrottlePolicy)
+	migrate.Exec(
+		`CREATE TABLE IF NOT EXISTS throttle (
+			type TEXT NOT NULL PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			ts INTEGER NOT NULL
+		);`,
+	),
+	// 6: Password KDF (passwords before this use KDFInteractive)
+	migrate.Steps(
+		migrate.AddColumn("auth", "kdf", "TEXT NOT NULL DEFAULT ''"),
+		migrate.AddColumn("auth", "kdfTime", "INTEGER NOT NULL DEFAULT 0"),
+		migrate.AddColumn("auth", "kdfMemory", "INTEGER NOT NULL DEFAULT 0"),
+		migrate.AddColumn("auth", "kdfThreads", "INTEGER NOT NULL DEFAULT 0"),
+		migrate.Exec(`UPDATE auth SET kdf = 'argon2id', kdfTime = 1, kdfMemory = 65536, kdfThreads = 4 WHERE kdf = '' AND type = 'password';`),
+	),
+	// 7: Derived flag (resident keys before this are treated as derived)
+	migrate.Steps(
+		migrate.AddColumn("auth", "derived", "BOOL NOT NULL DEFAULT 0"),
+		migrate.Exec(`UPDATE auth SET derived = 1 WHERE type = 'fido2-resident-key';`),
+	),
+}
+
+// initTables creates or migrates the auth database tables.
+func initTables(db *sqlx.DB) error {
+	return migrate.Run(db, migrations)
 }
 
 func (d *DB) Close() error {
@@ -108,8 +176,8 @@ func (d *DB) Delete(id string) error {
 }
 
 func setTx(tx *sqlx.Tx, auth *Auth) error {
-	sql := `INSERT OR REPLACE INTO auth (id, ek, type, createdAt, salt, aaguid, nopin) 
-			VALUES (:id, :ek, :type, :createdAt, :salt, :aaguid, :nopin)`
+	sql := `INSERT OR REPLACE INTO auth (id, ek, pk, sk, mkid, type, createdAt, salt, aaguid, nopin, rp, derived, kdf, kdfTime, kdfMemory, kdfThreads, del) 
+			VALUES (:id, :ek, :pk, :sk, :mkid, :type, :createdAt, :salt, :aaguid, :nopin, :rp, :derived, :kdf, :kdfTime, :kdfMemory, :kdfThreads, :del)`
 	if _, err := tx.NamedExec(sql, auth); err != nil {
 		return err
 	}
@@ -123,6 +191,23 @@ func deleteTx(tx *sqlx.Tx, id string) error {
 	return nil
 }
 
+// RelyingParty for new FIDO2 credentials.
+func (d *DB) RelyingParty() *fido2.RelyingParty {
+	return d.rp
+}
+
+// get returns auth by id, or nil if not found.
+func (d *DB) get(id string) (*Auth, error) {
+	var auth Auth
+	if err := d.db.Get(&auth, "SELECT * FROM auth WHERE id = $1", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &auth, nil
+}
+
 // List auth.
 func (d *DB) List() ([]*Auth, error) {
 	var auths []*Auth
@@ -152,3 +237,41 @@ func (d *DB) ListByType(typ Type) ([]*Auth, error) {
 	}
 	return auths, nil
 }
+
+// Clear removes the auth methods for a master key (see MasterKeyID), and a
+// staged rotation for them.
+// Auth methods for other master keys (other vaults) are kept, and failed
+// attempts (see ThrottlePolicy) are only cleared if there are no auth methods
+// left.
+// Auth from before MasterKeyID is kept, since we can't tell which master key
+// it's for.
+func (d *DB) Clear(mkID []byte) error {
+	rot, err := d.rotation()
+	if err != nil {
+		return err
+	}
+	if err := syncer.Transact(d.db, func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec("DELETE FROM auth WHERE mkid = $1", mkID); err != nil {
+			return err
+		}
+		if rot != nil && bytes.Equal(rot.From, mkID) {
+			if _, err := tx.Exec("DELETE FROM config WHERE key = $1", "rotation"); err != nil {
+				return err
+			}
+		}
+		var count int
+		if err := tx.Get(&count, "SELECT COUNT(*) FROM auth"); err != nil {
+			return err
+		}
+		if count == 0 {
+			if _, err := tx.Exec("DELETE FROM throttle"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	d.clearRotated()
+	return nil
+}
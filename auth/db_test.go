@@ -0,0 +1,63 @@
+package auth_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/migrate"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateDB(t *testing.T) {
+	var err error
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+
+	// Tables from before migrations
+	db, err := sqlx.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE auth (
+		id TEXT NOT NULL PRIMARY KEY, 
+		ek BLOB,
+		type TEXT,
+		createdAt TIMESTAMP,
+		salt BLOB,
+		aaguid TEXT,
+		nopin BOOL
+	);`)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO auth (id, type, createdAt, aaguid, nopin) VALUES ('old', 'password', CURRENT_TIMESTAMP, '', 0)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO auth (id, type, createdAt, aaguid, nopin) VALUES ('oldfido2', 'fido2-hmac-secret', CURRENT_TIMESTAMP, 'aaguid', 0)")
+	require.NoError(t, err)
+
+	adb, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer adb.Close()
+
+	version, err := migrate.Version(db)
+	require.NoError(t, err)
+	require.Equal(t, 7, version)
+	require.NoError(t, db.Close())
+
+	auths, err := adb.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(auths))
+	require.Equal(t, "old", auths[0].ID)
+	require.False(t, auths[0].Deleted)
+	require.Equal(t, "", auths[0].RP)
+	require.Equal(t, auth.Argon2id, auths[0].KDF)
+	require.Equal(t, uint32(65536), auths[0].KDFMemory)
+	require.Equal(t, "oldfido2", auths[1].ID)
+	require.Equal(t, "getchill.app", auths[1].RP)
+
+	mk := testutil.Seed(0x01)
+	_, err = adb.RegisterPassword("testpassword", mk)
+	require.NoError(t, err)
+	_, out, err := adb.Password("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+}
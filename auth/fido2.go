@@ -3,6 +3,7 @@ package auth
 import (
 	"bytes"
 	"context"
+	"strings"
 	"time"
 
 	"github.com/keys-pub/keys"
@@ -12,10 +13,24 @@ import (
 	"github.com/pkg/errors"
 )
 
-type authDevice struct {
-	Device     *fido2.Device
-	DeviceInfo *fido2.DeviceInfo
-	Auth       *Auth
+// FIDO2Device is a FIDO2 device, and the auth methods with a credential that
+// may be on the device (with a matching AAGUID).
+type FIDO2Device struct {
+	Device *fido2.Device
+	Info   *fido2.DeviceInfo
+	Auths  []*Auth
+}
+
+// DeviceSelector chooses a device when there are multiple devices that may
+// have a matching credential, for example by prompting the user.
+// If it returns nil, each device is tried in order.
+type DeviceSelector func(ctx context.Context, devices []*FIDO2Device) (*FIDO2Device, error)
+
+// defaultRP is the default relying party for FIDO2 credentials, see
+// WithRelyingParty.
+var defaultRP = &fido2.RelyingParty{
+	ID:   "getchill.app",
+	Name: "getchill.app",
 }
 
 // FIDO2HMACSecret from a device.
@@ -24,19 +39,22 @@ type FIDO2HMACSecret struct {
 	Salt         []byte
 	AAGUID       string
 	NoPin        bool
+	// RP is the relying party ID.
+	RP string
+	// Resident if a resident key (discoverable credential), see
+	// GenerateFIDO2ResidentKey.
+	Resident bool
 }
 
 // GenerateFIDO2HMACSecret creates FIDO2 hmac-secret on a device.
-func GenerateFIDO2HMACSecret(ctx context.Context, plugin fido2.FIDO2Server, pin string, device string, appName string) (*FIDO2HMACSecret, error) {
+// The relying party can be set with WithRelyingParty.
+func GenerateFIDO2HMACSecret(ctx context.Context, plugin fido2.FIDO2Server, pin string, device string, appName string, opt ...Option) (*FIDO2HMACSecret, error) {
 	if plugin == nil {
 		return nil, errors.Errorf("fido2 plugin not available")
 	}
+	opts := newOptions(opt...)
 
 	cdh := bytes.Repeat([]byte{0x00}, 32) // No client data
-	rp := &fido2.RelyingParty{
-		ID:   "getchill.app",
-		Name: "getchill.app",
-	}
 
 	logger.Debugf("Find device...")
 	dev, err := findDevice(ctx, plugin, device)
@@ -49,19 +67,16 @@ func GenerateFIDO2HMACSecret(ctx context.Context, plugin fido2.FIDO2Server, pin
 
 	userID := keys.Rand16()[:]
 
-	// TODO: Default to using resident key?
-
 	logger.Debugf("Generating hmac-secret...")
 	resp, err := plugin.GenerateHMACSecret(ctx, &fido2.GenerateHMACSecretRequest{
 		Device:         dev.Device.Path,
 		PIN:            pin,
 		ClientDataHash: cdh[:],
-		RP:             rp,
+		RP:             opts.RP,
 		User: &fido2.User{
 			ID:   userID,
 			Name: appName,
 		},
-		// RK: fido2.True,
 	})
 	if err != nil {
 		return nil, err
@@ -75,9 +90,10 @@ func GenerateFIDO2HMACSecret(ctx context.Context, plugin fido2.FIDO2Server, pin
 	salt := keys.Rand32()
 	fhs := &FIDO2HMACSecret{
 		CredentialID: resp.CredentialID,
-		AAGUID:       dev.DeviceInfo.AAGUID,
+		AAGUID:       dev.Info.AAGUID,
 		Salt:         salt[:],
 		NoPin:        noPin,
+		RP:           opts.RP.ID,
 	}
 
 	return fhs, nil
@@ -85,49 +101,81 @@ func GenerateFIDO2HMACSecret(ctx context.Context, plugin fido2.FIDO2Server, pin
 
 // RegisterFIDO2HMACSecret registers FIDO2HMACSecret.
 func (d *DB) RegisterFIDO2HMACSecret(ctx context.Context, plugin fido2.FIDO2Server, hs *FIDO2HMACSecret, mk *[32]byte, pin string) (*Auth, error) {
+	auth, key, err := d.fido2Auth(ctx, plugin, hs, pin)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.setFIDO2Auth(auth, key, mk); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// fido2Auth returns the auth for a FIDO2HMACSecret and its hmac-secret key.
+func (d *DB) fido2Auth(ctx context.Context, plugin fido2.FIDO2Server, hs *FIDO2HMACSecret, pin string) (*Auth, *[32]byte, error) {
 	if len(hs.CredentialID) < 32 {
-		return nil, errors.Errorf("invalid credential id")
+		return nil, nil, errors.Errorf("invalid credential id")
 	}
 	id := encoding.MustEncode(hs.CredentialID, encoding.Base62)
+	typ := api.FIDO2HMACSecretType
+	if hs.Resident {
+		typ = api.FIDO2ResidentKeyType
+	}
+	rp := hs.RP
+	if rp == "" {
+		rp = d.rp.ID
+	}
 	auth := &Auth{
 		ID:        id,
-		Type:      api.FIDO2HMACSecretType,
+		Type:      typ,
 		Salt:      hs.Salt,
 		AAGUID:    hs.AAGUID,
 		NoPin:     hs.NoPin,
+		RP:        rp,
 		CreatedAt: time.Now(),
 	}
 
-	_, key, err := hmacSecret(ctx, plugin, []*Auth{auth}, pin)
+	_, key, err := hmacSecret(ctx, plugin, []*Auth{auth}, pin, d.selector, func(*Auth, *[32]byte) bool { return true })
 	if err != nil {
-		return nil, err
-	}
-	if len(key) != 32 {
-		return nil, errors.Errorf("invalid hmac-secret key length")
-	}
-	auth.EncryptedKey = secretBoxSeal(mk[:], key)
-	if err := d.Set(auth); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return auth, nil
+	return auth, key, nil
+}
+
+func (d *DB) setFIDO2Auth(auth *Auth, key *[32]byte, mk *[32]byte) error {
+	auth.Derived = auth.Type == api.FIDO2ResidentKeyType && *residentMasterKey(key) == *mk
+	wrapKey(auth, key, mk)
+	return d.Set(auth)
 }
 
-// FIDO2HMACSecret authenticates using FIDO2 hmac-secret.
+// FIDO2HMACSecret authenticates using FIDO2 hmac-secret (or a registered
+// resident key).
+// Each registered credential is tried on each device (with a matching AAGUID),
+// until one opens the master key.
+// If there are multiple matching devices, the DeviceSelector (see
+// WithDeviceSelector) can choose which one to use.
 func (d *DB) FIDO2HMACSecret(ctx context.Context, plugin fido2.FIDO2Server, pin string) (*Auth, *[32]byte, error) {
 	auths, err := d.ListByType(api.FIDO2HMACSecretType)
 	if err != nil {
 		return nil, nil, err
 	}
-	// TODO: How to choose if multiple device matches.
-	auth, key, err := hmacSecret(ctx, plugin, auths, pin)
+	rks, err := d.ListByType(api.FIDO2ResidentKeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	auths = append(auths, rks...)
+	var mk *[32]byte
+	auth, _, err := hmacSecret(ctx, plugin, auths, pin, d.selector, func(auth *Auth, key *[32]byte) bool {
+		mk = d.unlock(auth, key)
+		return mk != nil
+	})
 	if err != nil {
 		return nil, nil, err
 	}
-	mk := d.unlock(auth, key)
 	return auth, mk, nil
 }
 
-func findDevice(ctx context.Context, plugin fido2.FIDO2Server, query string) (*authDevice, error) {
+func findDevice(ctx context.Context, plugin fido2.FIDO2Server, query string) (*FIDO2Device, error) {
 	if plugin == nil {
 		return nil, errors.Errorf("fido2 plugin not available")
 	}
@@ -143,27 +191,33 @@ func findDevice(ctx context.Context, plugin fido2.FIDO2Server, query string) (*a
 				logger.Infof("Failed to get device info: %s", err)
 				continue
 			}
-			return &authDevice{
-				Device:     device,
-				DeviceInfo: infoResp.Info,
+			return &FIDO2Device{
+				Device: device,
+				Info:   infoResp.Info,
 			}, nil
 		}
 	}
 	return nil, nil
 }
 
-func matchAAGUID(auths []*Auth, aaguid string) *Auth {
+func matchAAGUID(auths []*Auth, aaguid string) []*Auth {
+	out := []*Auth{}
 	for _, auth := range auths {
 		if auth.AAGUID == aaguid {
-			return auth
+			out = append(out, auth)
 		}
 	}
-	return nil
+	return out
 }
 
-// findAuth returns a auth matching the auth credentials (aaguid).
-func findAuth(ctx context.Context, plugin fido2.FIDO2Server, auths []*Auth) (*authDevice, error) {
-	if auths == nil {
+var errNoDevices = errors.New("no devices found")
+var errNoMatchingDevices = errors.New("no matching devices found")
+
+// findAuths returns devices that may have a credential for the auths (with a
+// matching aaguid).
+// Returns errNoDevices or errNoMatchingDevices if none.
+func findAuths(ctx context.Context, plugin fido2.FIDO2Server, auths []*Auth) ([]*FIDO2Device, error) {
+	if plugin == nil {
 		return nil, errors.Errorf("fido2 plugin not available")
 	}
 	if len(auths) == 0 {
@@ -175,9 +229,10 @@ func findAuth(ctx context.Context, plugin fido2.FIDO2Server, auths []*Auth) (*au
 		return nil, err
 	}
 	if len(devicesResp.Devices) == 0 {
-		return nil, errors.Errorf("no devices found")
+		return nil, errNoDevices
 	}
 
+	out := []*FIDO2Device{}
 	for _, device := range devicesResp.Devices {
 		infoResp, err := plugin.DeviceInfo(ctx, &fido2.DeviceInfoRequest{Device: device.Path})
 		if err != nil {
@@ -187,61 +242,111 @@ func findAuth(ctx context.Context, plugin fido2.FIDO2Server, auths []*Auth) (*au
 		}
 		deviceInfo := infoResp.Info
 		logger.Debugf("Checking device: %v", deviceInfo)
-		if deviceInfo.HasExtension(fido2.HMACSecretExtension) {
-			auth := matchAAGUID(auths, deviceInfo.AAGUID)
-			if auth != nil {
-				logger.Debugf("Found device: %v", device.Path)
-				return &authDevice{
-					Device:     device,
-					DeviceInfo: deviceInfo,
-					Auth:       auth,
-				}, nil
-			}
+		if !deviceInfo.HasExtension(fido2.HMACSecretExtension) {
+			continue
+		}
+		matches := matchAAGUID(auths, deviceInfo.AAGUID)
+		if len(matches) > 0 {
+			logger.Debugf("Found device: %v", device.Path)
+			out = append(out, &FIDO2Device{
+				Device: device,
+				Info:   deviceInfo,
+				Auths:  matches,
+			})
 		}
 	}
-	return nil, errors.Errorf("no matching devices found")
+	if len(out) == 0 {
+		return nil, errNoMatchingDevices
+	}
+	return out, nil
 }
 
-func hmacSecret(ctx context.Context, plugin fido2.FIDO2Server, auths []*Auth, pin string) (*Auth, *[32]byte, error) {
+// hmacSecret gets the hmac-secret for each auth on each matching device, until
+// accept returns true for an auth and hmac-secret key.
+// It stops at the first error (such as an invalid PIN) other than a missing
+// credential, so we don't use up PIN retries.
+func hmacSecret(ctx context.Context, plugin fido2.FIDO2Server, auths []*Auth, pin string, selector DeviceSelector, accept func(*Auth, *[32]byte) bool) (*Auth, *[32]byte, error) {
 	if plugin == nil {
 		return nil, nil, errors.Errorf("fido2 plugin not available")
 	}
 
-	logger.Debugf("Looking for device with a matching credential...")
-	authDevice, err := findAuth(ctx, plugin, auths)
+	logger.Debugf("Looking for devices with a matching credential...")
+	devices, err := findAuths(ctx, plugin, auths)
 	if err != nil {
 		return nil, nil, err
 	}
-	if authDevice.Auth == nil {
-		return nil, nil, errors.Errorf("device has no matching auth")
+	if len(devices) > 1 && selector != nil {
+		selected, err := selector(ctx, devices)
+		if err != nil {
+			return nil, nil, err
+		}
+		if selected != nil {
+			devices = []*FIDO2Device{selected}
+		}
 	}
 
-	credID, err := encoding.Decode(authDevice.Auth.ID, encoding.Base62)
+	found := false
+	for _, device := range devices {
+		for _, auth := range device.Auths {
+			key, err := hmacSecretKey(ctx, plugin, device.Device.Path, auth, pin)
+			if err != nil {
+				if isNoCredentials(err) {
+					logger.Debugf("No credential %s on %s", auth.ID, device.Device.Path)
+					continue
+				}
+				return nil, nil, err
+			}
+			found = true
+			if accept(auth, key) {
+				return auth, key, nil
+			}
+			logger.Debugf("Auth %s failed on %s", auth.ID, device.Device.Path)
+		}
+	}
+	if !found {
+		return nil, nil, errors.Errorf("no matching credentials found")
+	}
+	return nil, nil, ErrInvalidAuth
+}
+
+// hmacSecretKey gets the hmac-secret for an auth on a device.
+func hmacSecretKey(ctx context.Context, plugin fido2.FIDO2Server, device string, auth *Auth, pin string) (*[32]byte, error) {
+	credID, err := encoding.Decode(auth.ID, encoding.Base62)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "credential (provision) id was invalid")
+		return nil, errors.Wrapf(err, "credential (provision) id was invalid")
 	}
 
 	logger.Debugf("Getting hmac-secret...")
 	cdh := bytes.Repeat([]byte{0x00}, 32) // No client data
-	rp := &fido2.RelyingParty{
-		ID:   "getchill.app",
-		Name: "getchill.app",
-	}
 	secretResp, err := plugin.HMACSecret(ctx, &fido2.HMACSecretRequest{
-		Device:         authDevice.Device.Path,
+		Device:         device,
 		PIN:            pin,
 		ClientDataHash: cdh[:],
-		RPID:           rp.ID,
+		RPID:           authRP(auth),
 		CredentialIDs:  [][]byte{credID},
-		Salt:           authDevice.Auth.Salt,
+		Salt:           auth.Salt,
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	if len(secretResp.HMACSecret) != 32 {
-		return nil, nil, errors.Errorf("invalid hmac-secret key length")
+		return nil, errors.Errorf("invalid hmac-secret key length")
 	}
 
-	return authDevice.Auth, keys.Bytes32(secretResp.HMACSecret), nil
+	return keys.Bytes32(secretResp.HMACSecret), nil
+}
+
+// isNoCredentials returns true if the error is from the device not having the
+// credential.
+func isNoCredentials(err error) bool {
+	return strings.Contains(err.Error(), "FIDO_ERR_NO_CREDENTIALS")
+}
+
+// authRP returns the relying party ID for an auth.
+func authRP(auth *Auth) string {
+	if auth.RP == "" {
+		return defaultRP.ID
+	}
+	return auth.RP
 }
@@ -2,15 +2,18 @@ package auth_test
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/keys-pub/keys"
 	"github.com/keys-pub/keys-ext/auth/fido2"
 	"github.com/keys-pub/vault/auth"
 	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/auth/fido2test"
 	"github.com/keys-pub/vault/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -58,3 +61,340 @@ func TestFIDO2(t *testing.T) {
 	require.Equal(t, mk, mko)
 	require.Equal(t, out.ID, reg.ID)
 }
+
+func TestFIDO2Virtual(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	mk := testutil.Seed(0x01)
+	pin := "12345"
+
+	fido2Plugin := fido2test.NewServer()
+	other := fido2Plugin.AddDevice("Other Key")
+	dev := fido2Plugin.AddDevice("Test Key")
+	dev.SetPIN(pin)
+
+	hs, err := auth.GenerateFIDO2HMACSecret(context.TODO(), fido2Plugin, pin, dev.Path(), "test")
+	require.NoError(t, err)
+	require.Equal(t, dev.AAGUID(), hs.AAGUID)
+	require.False(t, hs.NoPin)
+
+	reg, err := db.RegisterFIDO2HMACSecret(context.TODO(), fido2Plugin, hs, mk, pin)
+	require.NoError(t, err)
+
+	out, mko, err := db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, out.ID, reg.ID)
+
+	// Invalid PIN
+	_, _, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, "invalid")
+	require.Equal(t, fido2test.ErrPinInvalid, err)
+	require.Equal(t, 7, dev.Retries())
+
+	// Unplugged
+	dev.Unplug()
+	_, _, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.EqualError(t, err, "no matching devices found")
+	dev.Plug()
+
+	// Other device (no matching credential)
+	_, err = auth.GenerateFIDO2HMACSecret(context.TODO(), fido2Plugin, "", other.Path(), "test")
+	require.NoError(t, err)
+	_, mko, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+
+	// No hmac-secret extension
+	dev.DisableHMACSecret()
+	_, _, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.EqualError(t, err, "no matching devices found")
+}
+
+func TestFIDO2MultipleDevices(t *testing.T) {
+	path := testutil.Path()
+	var selected []*auth.FIDO2Device
+	selector := func(ctx context.Context, devices []*auth.FIDO2Device) (*auth.FIDO2Device, error) {
+		selected = devices
+		return devices[1], nil
+	}
+	db, err := auth.NewDB(path, auth.WithDeviceSelector(selector))
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	mk := testutil.Seed(0x01)
+	pin := "12345"
+
+	// Two keys of the same model (same AAGUID)
+	fido2Plugin := fido2test.NewServer()
+	dev1 := fido2Plugin.AddDeviceWithAAGUID("Test Key", "aaguid")
+	dev1.SetPIN(pin)
+	dev2 := fido2Plugin.AddDeviceWithAAGUID("Test Key", "aaguid")
+	dev2.SetPIN(pin)
+
+	hs1, err := auth.GenerateFIDO2HMACSecret(context.TODO(), fido2Plugin, pin, dev1.Path(), "test")
+	require.NoError(t, err)
+	reg1, err := db.RegisterFIDO2HMACSecret(context.TODO(), fido2Plugin, hs1, mk, pin)
+	require.NoError(t, err)
+	hs2, err := auth.GenerateFIDO2HMACSecret(context.TODO(), fido2Plugin, pin, dev2.Path(), "test")
+	require.NoError(t, err)
+	reg2, err := db.RegisterFIDO2HMACSecret(context.TODO(), fido2Plugin, hs2, mk, pin)
+	require.NoError(t, err)
+
+	// Selector chooses the second device
+	out, mko, err := db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg2.ID, out.ID)
+	require.Equal(t, 2, len(selected))
+	require.Equal(t, 2, len(selected[0].Auths))
+
+	// Only one device (selector isn't called)
+	selected = nil
+	dev2.Unplug()
+	out, mko, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg1.ID, out.ID)
+	require.Nil(t, selected)
+
+	dev1.Unplug()
+	dev2.Plug()
+	out, mko, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg2.ID, out.ID)
+
+	// Without PIN (different hmac-secret)
+	_, mko, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, "")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	require.Nil(t, mko)
+
+	// Reset device (no credentials)
+	_, err = fido2Plugin.Reset(context.TODO(), &fido2.ResetRequest{Device: dev2.Path()})
+	require.NoError(t, err)
+	_, _, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, "")
+	require.EqualError(t, err, "no matching credentials found")
+}
+
+func TestFIDO2ResidentKey(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	pin := "12345"
+	fido2Plugin := fido2test.NewServer()
+	dev := fido2Plugin.AddDevice("Test Key")
+	dev.SetPIN(pin)
+
+	_, err = auth.GenerateFIDO2ResidentKey(context.TODO(), fido2Plugin, "", dev.Path(), "test")
+	require.EqualError(t, err, "pin required for resident key")
+
+	hs, err := auth.GenerateFIDO2ResidentKey(context.TODO(), fido2Plugin, pin, dev.Path(), "test")
+	require.NoError(t, err)
+	require.True(t, hs.Resident)
+
+	reg, mk, err := db.SetupFIDO2ResidentKey(context.TODO(), fido2Plugin, hs, pin)
+	require.NoError(t, err)
+	require.Equal(t, api.FIDO2ResidentKeyType, reg.Type)
+
+	// Registered resident key
+	out, mko, err := db.FIDO2ResidentKey(context.TODO(), fido2Plugin, pin, nil)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+	out, mko, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+
+	// New auth db (only the device)
+	path2 := testutil.Path()
+	db2, err := auth.NewDB(path2)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path2) }()
+
+	_, _, err = db2.FIDO2ResidentKey(context.TODO(), fido2Plugin, pin, nil)
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	_, _, err = db2.FIDO2ResidentKey(context.TODO(), fido2Plugin, pin, func(mk *[32]byte) (*[32]byte, error) {
+		return nil, errors.New("invalid master key")
+	})
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	out, mko, err = db2.FIDO2ResidentKey(context.TODO(), fido2Plugin, pin, func(mk *[32]byte) (*[32]byte, error) {
+		return mk, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+	auths, err := db2.ListByType(api.FIDO2ResidentKeyType)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+
+	// Invalid PIN
+	_, _, err = db2.FIDO2ResidentKey(context.TODO(), fido2Plugin, "invalid", nil)
+	require.Equal(t, fido2test.ErrPinInvalid, err)
+
+	// Can't rotate (the master key is derived from the resident key)
+	err = db2.StageRotation(mk, keys.Rand32())
+	require.Equal(t, auth.ErrFIDO2ResidentKeyRotation, err)
+
+	// List, delete
+	creds, err := auth.ListFIDO2ResidentKeys(context.TODO(), fido2Plugin, dev.Path(), pin)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(creds))
+	require.Equal(t, hs.CredentialID, creds[0].ID)
+
+	// Plugin without FIDO2CredentialDeleter
+	noDelete := struct{ fido2.FIDO2Server }{fido2Plugin}
+	err = db2.DeleteFIDO2ResidentKey(context.TODO(), noDelete, dev.Path(), pin, creds[0].ID)
+	require.Equal(t, auth.ErrFIDO2DeleteNotSupported, err)
+	auths, err = db2.ListByType(api.FIDO2ResidentKeyType)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+
+	err = db2.DeleteFIDO2ResidentKey(context.TODO(), fido2Plugin, dev.Path(), pin, creds[0].ID)
+	require.NoError(t, err)
+	creds, err = auth.ListFIDO2ResidentKeys(context.TODO(), fido2Plugin, dev.Path(), pin)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(creds))
+	auths, err = db2.ListByType(api.FIDO2ResidentKeyType)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(auths))
+}
+
+func TestFIDO2ResidentKeyRotate(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+	defer db.Close()
+
+	pin := "12345"
+	fido2Plugin := fido2test.NewServer()
+	dev := fido2Plugin.AddDevice("Test Key")
+	dev.SetPIN(pin)
+
+	// Resident key for an existing master key (not derived)
+	mk := testutil.Seed(0x01)
+	hs, err := auth.GenerateFIDO2ResidentKey(context.TODO(), fido2Plugin, pin, dev.Path(), "test")
+	require.NoError(t, err)
+	reg, err := db.RegisterFIDO2HMACSecret(context.TODO(), fido2Plugin, hs, mk, pin)
+	require.NoError(t, err)
+	require.Equal(t, api.FIDO2ResidentKeyType, reg.Type)
+	require.False(t, reg.Derived)
+
+	newMK := testutil.Seed(0x02)
+	err = db.StageRotation(mk, newMK)
+	require.NoError(t, err)
+	err = db.CommitRotation()
+	require.NoError(t, err)
+
+	_, mko, err := db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, newMK, mko)
+}
+
+func TestFIDO2ResidentKeyMigrate(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	pin := "12345"
+	fido2Plugin := fido2test.NewServer()
+	dev := fido2Plugin.AddDevice("Test Key")
+	dev.SetPIN(pin)
+
+	hs, err := auth.GenerateFIDO2ResidentKey(context.TODO(), fido2Plugin, pin, dev.Path(), "test")
+	require.NoError(t, err)
+	reg, mk, err := db.SetupFIDO2ResidentKey(context.TODO(), fido2Plugin, hs, pin)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = auth.NewDB(path, auth.WithRelyingParty("example.com", "Example"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// The master key is derived from the resident key
+	_, err = db.MigrateFIDO2RelyingParty(context.TODO(), fido2Plugin, mk, pin, "test")
+	require.EqualError(t, err, "auth "+reg.ID+" is the resident key the master key is derived from, and can't be migrated")
+	auths, err := db.ListByType(api.FIDO2ResidentKeyType)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+	require.Equal(t, reg.ID, auths[0].ID)
+}
+
+func TestFIDO2RelyingParty(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	mk := testutil.Seed(0x01)
+	pin := "12345"
+
+	fido2Plugin := fido2test.NewServer()
+	dev := fido2Plugin.AddDevice("Test Key")
+	dev.SetPIN(pin)
+
+	require.Equal(t, "getchill.app", db.RelyingParty().ID)
+	hs, err := auth.GenerateFIDO2HMACSecret(context.TODO(), fido2Plugin, pin, dev.Path(), "test")
+	require.NoError(t, err)
+	require.Equal(t, "getchill.app", hs.RP)
+	reg, err := db.RegisterFIDO2HMACSecret(context.TODO(), fido2Plugin, hs, mk, pin)
+	require.NoError(t, err)
+	require.Equal(t, "getchill.app", reg.RP)
+	require.NoError(t, db.Close())
+
+	// Open with another relying party
+	db, err = auth.NewDB(path, auth.WithRelyingParty("example.com", "Example"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, "example.com", db.RelyingParty().ID)
+
+	// Existing credential uses its relying party
+	out, mko, err := db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+
+	// Migrate
+	migrated, err := db.MigrateFIDO2RelyingParty(context.TODO(), fido2Plugin, mk, pin, "test")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(migrated))
+	require.Equal(t, "example.com", migrated[0].RP)
+	require.Equal(t, dev.AAGUID(), migrated[0].AAGUID)
+	auths, err := db.ListByType(api.FIDO2HMACSecretType)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+	require.Equal(t, migrated[0].ID, auths[0].ID)
+
+	out, mko, err = db.FIDO2HMACSecret(context.TODO(), fido2Plugin, pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, migrated[0].ID, out.ID)
+
+	// Already migrated
+	migrated, err = db.MigrateFIDO2RelyingParty(context.TODO(), fido2Plugin, mk, pin, "test")
+	require.NoError(t, err)
+	require.Equal(t, 0, len(migrated))
+
+	// Resident key for relying party
+	hs, err = auth.GenerateFIDO2ResidentKey(context.TODO(), fido2Plugin, pin, dev.Path(), "test", auth.WithRelyingParty("example.com", "Example"))
+	require.NoError(t, err)
+	_, err = db.RegisterFIDO2HMACSecret(context.TODO(), fido2Plugin, hs, mk, pin)
+	require.NoError(t, err)
+	creds, err := auth.ListFIDO2ResidentKeys(context.TODO(), fido2Plugin, dev.Path(), pin, auth.WithRelyingParty("example.com", "Example"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(creds))
+	require.Equal(t, "example.com", creds[0].RP.ID)
+	creds, err = auth.ListFIDO2ResidentKeys(context.TODO(), fido2Plugin, dev.Path(), pin)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(creds))
+	_, mko, err = db.FIDO2ResidentKey(context.TODO(), fido2Plugin, pin, nil)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys-ext/auth/fido2"
+	"github.com/keys-pub/keys/encoding"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/pkg/errors"
+)
+
+// FIDO2CredentialDeleter is implemented by FIDO2 plugins that can delete
+// resident credentials.
+type FIDO2CredentialDeleter interface {
+	DeleteCredential(ctx context.Context, device string, pin string, credentialID []byte) error
+}
+
+// GenerateFIDO2ResidentKey creates a FIDO2 resident key (discoverable
+// credential) with hmac-secret on a device.
+// The salt is stored in the credential's user handle, so the hmac-secret can
+// be found with only the device (and PIN), see FIDO2ResidentKey.
+// Requires a PIN, which is needed to list credentials on the device.
+// The relying party can be set with WithRelyingParty.
+func GenerateFIDO2ResidentKey(ctx context.Context, plugin fido2.FIDO2Server, pin string, device string, appName string, opt ...Option) (*FIDO2HMACSecret, error) {
+	if plugin == nil {
+		return nil, errors.Errorf("fido2 plugin not available")
+	}
+	opts := newOptions(opt...)
+	if pin == "" {
+		return nil, errors.Errorf("pin required for resident key")
+	}
+
+	dev, err := findDevice(ctx, plugin, device)
+	if err != nil {
+		return nil, err
+	}
+	if dev == nil {
+		return nil, errors.Errorf("device not found: %s", device)
+	}
+
+	salt := keys.Rand32()
+
+	logger.Debugf("Generating hmac-secret (resident key)...")
+	cdh := bytes.Repeat([]byte{0x00}, 32) // No client data
+	resp, err := plugin.GenerateHMACSecret(ctx, &fido2.GenerateHMACSecretRequest{
+		Device:         dev.Device.Path,
+		PIN:            pin,
+		ClientDataHash: cdh[:],
+		RP:             opts.RP,
+		User: &fido2.User{
+			ID:   salt[:],
+			Name: appName,
+		},
+		RK: fido2.True,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &FIDO2HMACSecret{
+		CredentialID: resp.CredentialID,
+		AAGUID:       dev.Info.AAGUID,
+		Salt:         salt[:],
+		RP:           opts.RP.ID,
+		Resident:     true,
+	}, nil
+}
+
+// SetupFIDO2ResidentKey registers a resident key for a new vault, returning the
+// master key, which is derived from the hmac-secret.
+// This allows the vault to be unlocked with the resident key without this auth
+// database (see FIDO2ResidentKey).
+// The master key can't be rotated while the resident key is registered (see
+// ErrFIDO2ResidentKeyRotation).
+func (d *DB) SetupFIDO2ResidentKey(ctx context.Context, plugin fido2.FIDO2Server, hs *FIDO2HMACSecret, pin string) (*Auth, *[32]byte, error) {
+	if !hs.Resident {
+		return nil, nil, errors.Errorf("not a resident key")
+	}
+	auth, key, err := d.fido2Auth(ctx, plugin, hs, pin)
+	if err != nil {
+		return nil, nil, err
+	}
+	mk := residentMasterKey(key)
+	if err := d.setFIDO2Auth(auth, key, mk); err != nil {
+		return nil, nil, err
+	}
+	return auth, mk, nil
+}
+
+// FIDO2ResidentKey authenticates using a FIDO2 resident key on a device,
+// returning the auth and master key.
+//
+// If a resident key isn't registered in this auth database (for example on a
+// new machine), the master key derived from the hmac-secret (see
+// SetupFIDO2ResidentKey) is checked with verify, and if valid, the resident
+// key is registered (for the master key returned by verify).
+// This only works for a master key from SetupFIDO2ResidentKey; a resident key
+// registered for an existing master key (see RegisterFIDO2HMACSecret) needs to
+// be in this auth database.
+func (d *DB) FIDO2ResidentKey(ctx context.Context, plugin fido2.FIDO2Server, pin string, verify func(mk *[32]byte) (*[32]byte, error)) (*Auth, *[32]byte, error) {
+	if plugin == nil {
+		return nil, nil, errors.Errorf("fido2 plugin not available")
+	}
+	if pin == "" {
+		return nil, nil, errors.Errorf("pin required for resident key")
+	}
+	devices, err := findResidentDevices(ctx, plugin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(devices) > 1 && d.selector != nil {
+		selected, err := d.selector(ctx, devices)
+		if err != nil {
+			return nil, nil, err
+		}
+		if selected != nil {
+			devices = []*FIDO2Device{selected}
+		}
+	}
+
+	for _, device := range devices {
+		resp, err := plugin.Credentials(ctx, &fido2.CredentialsRequest{
+			Device: device.Device.Path,
+			PIN:    pin,
+			RPID:   d.rp.ID,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, cred := range resp.Credentials {
+			if cred.User == nil || len(cred.User.ID) != 32 {
+				continue
+			}
+			auth := &Auth{
+				ID:        encoding.MustEncode(cred.ID, encoding.Base62),
+				Type:      api.FIDO2ResidentKeyType,
+				Salt:      cred.User.ID,
+				AAGUID:    device.Info.AAGUID,
+				RP:        d.rp.ID,
+				CreatedAt: time.Now(),
+			}
+			key, err := hmacSecretKey(ctx, plugin, device.Device.Path, auth, pin)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			existing, err := d.get(auth.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if existing != nil {
+				if mk := d.unlock(existing, key); mk != nil {
+					return existing, mk, nil
+				}
+				continue
+			}
+
+			if verify == nil {
+				continue
+			}
+			mk, err := verify(residentMasterKey(key))
+			if err != nil {
+				logger.Debugf("Resident key %s failed to verify: %v", auth.ID, err)
+				continue
+			}
+			if err := d.setFIDO2Auth(auth, key, mk); err != nil {
+				return nil, nil, err
+			}
+			return auth, mk, nil
+		}
+	}
+	return nil, nil, ErrInvalidAuth
+}
+
+// ListFIDO2ResidentKeys lists the resident keys for the relying party (see
+// WithRelyingParty) on a device.
+func ListFIDO2ResidentKeys(ctx context.Context, plugin fido2.FIDO2Server, device string, pin string, opt ...Option) ([]*fido2.Credential, error) {
+	if plugin == nil {
+		return nil, errors.Errorf("fido2 plugin not available")
+	}
+	opts := newOptions(opt...)
+	resp, err := plugin.Credentials(ctx, &fido2.CredentialsRequest{
+		Device: device,
+		PIN:    pin,
+		RPID:   opts.RP.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Credentials, nil
+}
+
+// ErrFIDO2DeleteNotSupported if the FIDO2 plugin can't delete resident keys
+// (it doesn't implement FIDO2CredentialDeleter).
+// The credential can be deleted with the device vendor's tools, and the auth
+// removed with Delete.
+var ErrFIDO2DeleteNotSupported = errors.New("fido2 plugin doesn't support deleting resident keys")
+
+// DeleteFIDO2ResidentKey deletes a resident key from a device, and removes the
+// auth for it (if any).
+// Returns ErrFIDO2DeleteNotSupported if the plugin doesn't implement
+// FIDO2CredentialDeleter, in which case nothing is deleted.
+func (d *DB) DeleteFIDO2ResidentKey(ctx context.Context, plugin fido2.FIDO2Server, device string, pin string, credentialID []byte) error {
+	if plugin == nil {
+		return errors.Errorf("fido2 plugin not available")
+	}
+	deleter, ok := plugin.(FIDO2CredentialDeleter)
+	if !ok {
+		return ErrFIDO2DeleteNotSupported
+	}
+	if err := deleter.DeleteCredential(ctx, device, pin, credentialID); err != nil {
+		return err
+	}
+	return d.Delete(encoding.MustEncode(credentialID, encoding.Base62))
+}
+
+// findResidentDevices returns devices that support hmac-secret and resident
+// keys.
+func findResidentDevices(ctx context.Context, plugin fido2.FIDO2Server) ([]*FIDO2Device, error) {
+	devicesResp, err := plugin.Devices(ctx, &fido2.DevicesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if len(devicesResp.Devices) == 0 {
+		return nil, errors.Errorf("no devices found")
+	}
+	out := []*FIDO2Device{}
+	for _, device := range devicesResp.Devices {
+		infoResp, err := plugin.DeviceInfo(ctx, &fido2.DeviceInfoRequest{Device: device.Path})
+		if err != nil {
+			logger.Infof("Failed to get device info: %s", err)
+			continue
+		}
+		info := infoResp.Info
+		if !info.HasExtension(fido2.HMACSecretExtension) || !hasOption(info, "rk") {
+			continue
+		}
+		out = append(out, &FIDO2Device{Device: device, Info: info})
+	}
+	if len(out) == 0 {
+		return nil, errors.Errorf("no matching devices found")
+	}
+	return out, nil
+}
+
+func hasOption(info *fido2.DeviceInfo, name string) bool {
+	for _, opt := range info.Options {
+		if opt.Name == name {
+			return opt.Value == fido2.True
+		}
+	}
+	return false
+}
+
+// residentMasterKey derives the master key from a resident key hmac-secret.
+func residentMasterKey(key *[32]byte) *[32]byte {
+	h := sha256.New()
+	_, _ = h.Write([]byte("vault.fido2.rk"))
+	_, _ = h.Write(key[:])
+	return keys.Bytes32(h.Sum(nil))
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/keys-pub/keys-ext/auth/fido2"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/pkg/errors"
+)
+
+// MigrateFIDO2RelyingParty replaces FIDO2 credentials for other relying
+// parties with new credentials (on the same devices) for the relying party
+// (see WithRelyingParty).
+// The devices must be plugged in, and credentials on devices that aren't are
+// skipped.
+// The old credentials are not deleted from the devices.
+// A resident key the master key is derived from (see SetupFIDO2ResidentKey)
+// can't be migrated, since the new resident key wouldn't derive it.
+// Returns the new auths.
+func (d *DB) MigrateFIDO2RelyingParty(ctx context.Context, plugin fido2.FIDO2Server, mk *[32]byte, pin string, appName string) ([]*Auth, error) {
+	if plugin == nil {
+		return nil, errors.Errorf("fido2 plugin not available")
+	}
+	auths, err := d.ListByType(api.FIDO2HMACSecretType)
+	if err != nil {
+		return nil, err
+	}
+	rks, err := d.ListByType(api.FIDO2ResidentKeyType)
+	if err != nil {
+		return nil, err
+	}
+	auths = append(auths, rks...)
+
+	out := []*Auth{}
+	for _, auth := range auths {
+		if authRP(auth) == d.rp.ID {
+			continue
+		}
+		reg, err := d.migrateFIDO2Auth(ctx, plugin, auth, mk, pin, appName)
+		if err != nil {
+			return nil, err
+		}
+		if reg == nil {
+			logger.Infof("Skipping %s (device not found)", auth.ID)
+			continue
+		}
+		out = append(out, reg)
+	}
+	return out, nil
+}
+
+// migrateFIDO2Auth creates a new credential on the device with the auth
+// credential, and replaces the auth.
+// Returns nil if the device isn't found.
+func (d *DB) migrateFIDO2Auth(ctx context.Context, plugin fido2.FIDO2Server, auth *Auth, mk *[32]byte, pin string, appName string) (*Auth, error) {
+	credPin := pin
+	if auth.NoPin {
+		credPin = ""
+	}
+
+	devices, err := findAuths(ctx, plugin, []*Auth{auth})
+	if err == errNoDevices || err == errNoMatchingDevices {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var device *FIDO2Device
+	for _, dev := range devices {
+		key, err := hmacSecretKey(ctx, plugin, dev.Device.Path, auth, credPin)
+		if err != nil {
+			if isNoCredentials(err) {
+				continue
+			}
+			return nil, err
+		}
+		if d.unlock(auth, key) == nil {
+			return nil, errors.Errorf("auth %s is not for this master key", auth.ID)
+		}
+		if auth.Type == api.FIDO2ResidentKeyType && *residentMasterKey(key) == *mk {
+			// A new resident key wouldn't derive the master key (see
+			// SetupFIDO2ResidentKey).
+			return nil, errors.Errorf("auth %s is the resident key the master key is derived from, and can't be migrated", auth.ID)
+		}
+		device = dev
+		break
+	}
+	if device == nil {
+		return nil, nil
+	}
+
+	opt := WithRelyingParty(d.rp.ID, d.rp.Name)
+	var hs *FIDO2HMACSecret
+	if auth.Type == api.FIDO2ResidentKeyType {
+		hs, err = GenerateFIDO2ResidentKey(ctx, plugin, credPin, device.Device.Path, appName, opt)
+	} else {
+		hs, err = GenerateFIDO2HMACSecret(ctx, plugin, credPin, device.Device.Path, appName, opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reg, err := d.RegisterFIDO2HMACSecret(ctx, plugin, hs, mk, credPin)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Delete(auth.ID); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
@@ -0,0 +1,267 @@
+package fido2test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys-ext/auth/fido2"
+	"github.com/pkg/errors"
+)
+
+// maxRetries is the number of PIN retries before the device is blocked.
+const maxRetries = 8
+
+// maxAttempts is the number of consecutive invalid PIN attempts before the
+// device has to be plugged in again.
+const maxAttempts = 3
+
+// Device is a virtual FIDO2 device.
+type Device struct {
+	srv *Server
+
+	path         string
+	product      string
+	aaguid       string
+	pin          string
+	retries      int
+	attempts     int
+	creds        map[string]*credential
+	seq          int
+	unplugged    bool
+	noHMACSecret bool
+}
+
+// credential stored on a device.
+// Non-resident credentials on a real device are usually encrypted into the
+// credential ID, but a virtual device can just store them.
+type credential struct {
+	id   []byte
+	rp   *fido2.RelyingParty
+	user *fido2.User
+	rk   bool
+	seq  int
+	// credRandom is the hmac-secret key without user verification (PIN) and
+	// credRandomUV with.
+	credRandom   []byte
+	credRandomUV []byte
+}
+
+func newDevice(srv *Server, path string, product string, aaguid string) *Device {
+	return &Device{
+		srv:     srv,
+		path:    path,
+		product: product,
+		aaguid:  aaguid,
+		retries: maxRetries,
+		creds:   map[string]*credential{},
+	}
+}
+
+// Path for device.
+func (d *Device) Path() string {
+	return d.path
+}
+
+// AAGUID for device.
+func (d *Device) AAGUID() string {
+	return d.aaguid
+}
+
+// SetPIN sets the PIN directly (without the old PIN).
+func (d *Device) SetPIN(pin string) {
+	d.srv.mtx.Lock()
+	defer d.srv.mtx.Unlock()
+	d.pin = pin
+	d.retries = maxRetries
+	d.attempts = 0
+}
+
+// Retries returns the number of PIN retries left.
+func (d *Device) Retries() int {
+	d.srv.mtx.Lock()
+	defer d.srv.mtx.Unlock()
+	return d.retries
+}
+
+// Unplug the device.
+// An unplugged device isn't listed and requests to it fail.
+func (d *Device) Unplug() {
+	d.srv.mtx.Lock()
+	defer d.srv.mtx.Unlock()
+	d.unplugged = true
+}
+
+// Plug the device (back) in.
+// This resets the consecutive invalid PIN attempts (like a power cycle).
+func (d *Device) Plug() {
+	d.srv.mtx.Lock()
+	defer d.srv.mtx.Unlock()
+	d.unplugged = false
+	d.attempts = 0
+}
+
+// DisableHMACSecret removes the hmac-secret extension from the device.
+func (d *Device) DisableHMACSecret() {
+	d.srv.mtx.Lock()
+	defer d.srv.mtx.Unlock()
+	d.noHMACSecret = true
+}
+
+func (d *Device) device() *fido2.Device {
+	return &fido2.Device{
+		Path:         d.path,
+		Manufacturer: "keys.pub",
+		Product:      d.product,
+	}
+}
+
+func (d *Device) info() *fido2.DeviceInfo {
+	extensions := []string{"credProtect"}
+	if !d.noHMACSecret {
+		extensions = append(extensions, string(fido2.HMACSecretExtension))
+	}
+	clientPin := fido2.False
+	if d.pin != "" {
+		clientPin = fido2.True
+	}
+	return &fido2.DeviceInfo{
+		Versions:   []string{"U2F_V2", "FIDO_2_0"},
+		Extensions: extensions,
+		AAGUID:     d.aaguid,
+		Options: []*fido2.Option{
+			{Name: "rk", Value: fido2.True},
+			{Name: "up", Value: fido2.True},
+			{Name: "plat", Value: fido2.False},
+			{Name: "clientPin", Value: clientPin},
+		},
+	}
+}
+
+// checkPIN verifies the PIN, decrementing the retries if invalid.
+func (d *Device) checkPIN(pin string) error {
+	if d.pin == "" {
+		return ErrPinNotSet
+	}
+	if d.retries <= 0 {
+		return ErrPinBlocked
+	}
+	if d.attempts >= maxAttempts {
+		return ErrPinAuthBlocked
+	}
+	if pin != d.pin {
+		d.retries--
+		d.attempts++
+		switch {
+		case d.retries <= 0:
+			return ErrPinBlocked
+		case d.attempts >= maxAttempts:
+			return ErrPinAuthBlocked
+		default:
+			return ErrPinInvalid
+		}
+	}
+	d.retries = maxRetries
+	d.attempts = 0
+	return nil
+}
+
+// verify checks the PIN (if specified), returning whether the user was
+// verified.
+// If the PIN is required (and the device has a PIN), a PIN must be specified.
+func (d *Device) verify(pin string, required bool) (bool, error) {
+	if pin == "" {
+		if required && d.pin != "" {
+			return false, ErrPinRequired
+		}
+		return false, nil
+	}
+	if err := d.checkPIN(pin); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *Device) reset() {
+	d.pin = ""
+	d.retries = maxRetries
+	d.attempts = 0
+	d.creds = map[string]*credential{}
+}
+
+func (d *Device) addCredential(rp *fido2.RelyingParty, user *fido2.User, rk bool) *credential {
+	cred := &credential{
+		id:           keys.RandBytes(64),
+		rp:           rp,
+		user:         user,
+		rk:           rk,
+		credRandom:   keys.RandBytes(32),
+		credRandomUV: keys.RandBytes(32),
+	}
+	d.seq++
+	cred.seq = d.seq
+	if rk {
+		// A resident key replaces an existing one for the same RP and user.
+		for id, c := range d.creds {
+			if c.rk && c.rp.ID == rp.ID && hmac.Equal(c.user.ID, user.ID) {
+				delete(d.creds, id)
+			}
+		}
+	}
+	d.creds[hex.EncodeToString(cred.id)] = cred
+	return cred
+}
+
+// findCredential returns the first credential for the RP in ids, or if no ids
+// are specified, the most recent resident credential for the RP.
+func (d *Device) findCredential(rpID string, ids [][]byte) *credential {
+	if len(ids) == 0 {
+		creds := d.residentCredentials(rpID)
+		if len(creds) == 0 {
+			return nil
+		}
+		return creds[0]
+	}
+	for _, id := range ids {
+		c, ok := d.creds[hex.EncodeToString(id)]
+		if ok && c.rp.ID == rpID {
+			return c
+		}
+	}
+	return nil
+}
+
+// residentCredentials returns resident credentials for the RP (or all if rpID
+// is empty), most recent first.
+func (d *Device) residentCredentials(rpID string) []*credential {
+	out := []*credential{}
+	for _, c := range d.creds {
+		if c.rk && (rpID == "" || c.rp.ID == rpID) {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].seq > out[j].seq })
+	return out
+}
+
+// hmacSecret returns the hmac-secret output for a salt (32 or 64 bytes), as
+// specified by the CTAP2 hmac-secret extension:
+// HMAC-SHA-256(CredRandom, salt1) || HMAC-SHA-256(CredRandom, salt2).
+func (c *credential) hmacSecret(salt []byte, uv bool) ([]byte, error) {
+	if len(salt) != 32 && len(salt) != 64 {
+		return nil, errors.Wrapf(ErrInvalidArgument, "invalid salt length")
+	}
+	key := c.credRandom
+	if uv {
+		key = c.credRandomUV
+	}
+	out := []byte{}
+	for i := 0; i < len(salt); i += 32 {
+		h := hmac.New(sha256.New, key)
+		_, _ = h.Write(salt[i : i+32])
+		out = append(out, h.Sum(nil)...)
+	}
+	return out, nil
+}
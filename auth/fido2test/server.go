@@ -0,0 +1,284 @@
+// Package fido2test provides a virtual FIDO2 authenticator for testing.
+package fido2test
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys-ext/auth/fido2"
+	"github.com/pkg/errors"
+)
+
+// Errors match the libfido2 error names returned by the fido2 plugin.
+var (
+	// ErrDeviceNotFound if device isn't found (or is unplugged).
+	ErrDeviceNotFound = errors.New("FIDO_ERR_RX")
+	// ErrInvalidArgument if request is invalid.
+	ErrInvalidArgument = errors.New("FIDO_ERR_INVALID_ARGUMENT")
+	// ErrPinInvalid if PIN is invalid.
+	ErrPinInvalid = errors.New("FIDO_ERR_PIN_INVALID")
+	// ErrPinAuthBlocked if there were too many invalid PIN attempts, and the
+	// device needs to be plugged in again.
+	ErrPinAuthBlocked = errors.New("FIDO_ERR_PIN_AUTH_BLOCKED")
+	// ErrPinBlocked if there are no PIN retries left, and the device needs to
+	// be reset.
+	ErrPinBlocked = errors.New("FIDO_ERR_PIN_BLOCKED")
+	// ErrPinRequired if device has a PIN and it wasn't specified.
+	ErrPinRequired = errors.New("FIDO_ERR_PIN_REQUIRED")
+	// ErrPinNotSet if a PIN was specified and the device has no PIN.
+	ErrPinNotSet = errors.New("FIDO_ERR_PIN_NOT_SET")
+	// ErrPinPolicyViolation if a new PIN is too short.
+	ErrPinPolicyViolation = errors.New("FIDO_ERR_PIN_POLICY_VIOLATION")
+	// ErrUnsupportedExtension if device doesn't support hmac-secret.
+	ErrUnsupportedExtension = errors.New("FIDO_ERR_UNSUPPORTED_EXTENSION")
+	// ErrNoCredentials if no matching credentials are on the device.
+	ErrNoCredentials = errors.New("FIDO_ERR_NO_CREDENTIALS")
+)
+
+// Server is a virtual authenticator (fido2.FIDO2Server) with simulated
+// devices, for testing without a hardware key.
+//
+// The hmac-secret output is as specified by CTAP2, so it's different with and
+// without a PIN (user verification), and for each credential.
+type Server struct {
+	fido2.UnimplementedFIDO2Server
+
+	mtx     sync.Mutex
+	devices []*Device
+}
+
+var _ fido2.FIDO2Server = &Server{}
+
+// NewServer creates a virtual authenticator with no devices.
+func NewServer() *Server {
+	return &Server{}
+}
+
+// AddDevice adds a (plugged in) device, with a random AAGUID and no PIN.
+func (s *Server) AddDevice(product string) *Device {
+	return s.AddDeviceWithAAGUID(product, hex.EncodeToString(keys.RandBytes(16)))
+}
+
+// AddDeviceWithAAGUID adds a (plugged in) device with an AAGUID and no PIN.
+// Devices of the same model have the same AAGUID.
+func (s *Server) AddDeviceWithAAGUID(product string, aaguid string) *Device {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d := newDevice(s, fmt.Sprintf("virtual/%d", len(s.devices)), product, aaguid)
+	s.devices = append(s.devices, d)
+	return d
+}
+
+// findDevice returns a plugged in device.
+func (s *Server) findDevice(path string) (*Device, error) {
+	for _, d := range s.devices {
+		if d.path == path && !d.unplugged {
+			return d, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrDeviceNotFound, "device not found %s", path)
+}
+
+// Devices lists plugged in devices.
+func (s *Server) Devices(ctx context.Context, req *fido2.DevicesRequest) (*fido2.DevicesResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	devices := []*fido2.Device{}
+	for _, d := range s.devices {
+		if d.unplugged {
+			continue
+		}
+		devices = append(devices, d.device())
+	}
+	return &fido2.DevicesResponse{Devices: devices}, nil
+}
+
+// DeviceInfo ...
+func (s *Server) DeviceInfo(ctx context.Context, req *fido2.DeviceInfoRequest) (*fido2.DeviceInfoResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	return &fido2.DeviceInfoResponse{Info: d.info()}, nil
+}
+
+// SetPIN sets or changes the PIN.
+// If the device has a PIN, the old PIN is required.
+func (s *Server) SetPIN(ctx context.Context, req *fido2.SetPINRequest) (*fido2.SetPINResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.PIN) < 4 {
+		return nil, ErrPinPolicyViolation
+	}
+	if d.pin != "" || req.OldPIN != "" {
+		if req.OldPIN == "" {
+			return nil, ErrPinRequired
+		}
+		if err := d.checkPIN(req.OldPIN); err != nil {
+			return nil, err
+		}
+	}
+	d.pin = req.PIN
+	return &fido2.SetPINResponse{}, nil
+}
+
+// Reset removes the PIN and all credentials.
+func (s *Server) Reset(ctx context.Context, req *fido2.ResetRequest) (*fido2.ResetResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	d.reset()
+	return &fido2.ResetResponse{}, nil
+}
+
+// RetryCount returns the number of PIN retries left.
+func (s *Server) RetryCount(ctx context.Context, req *fido2.RetryCountRequest) (*fido2.RetryCountResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	return &fido2.RetryCountResponse{Count: int32(d.retries)}, nil
+}
+
+// Credentials lists resident credentials for a relying party.
+// Requires the PIN.
+func (s *Server) Credentials(ctx context.Context, req *fido2.CredentialsRequest) (*fido2.CredentialsResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkPIN(req.PIN); err != nil {
+		return nil, err
+	}
+	creds := []*fido2.Credential{}
+	for _, c := range d.residentCredentials(req.RPID) {
+		creds = append(creds, &fido2.Credential{
+			ID:   c.id,
+			Type: "es256",
+			RP:   c.rp,
+			User: c.user,
+		})
+	}
+	return &fido2.CredentialsResponse{Credentials: creds}, nil
+}
+
+// RelyingParties lists relying parties with resident credentials.
+// Requires the PIN.
+func (s *Server) RelyingParties(ctx context.Context, req *fido2.RelyingPartiesRequest) (*fido2.RelyingPartiesResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkPIN(req.PIN); err != nil {
+		return nil, err
+	}
+	parties := []*fido2.RelyingParty{}
+	found := map[string]bool{}
+	for _, c := range d.residentCredentials("") {
+		if found[c.rp.ID] {
+			continue
+		}
+		found[c.rp.ID] = true
+		parties = append(parties, c.rp)
+	}
+	return &fido2.RelyingPartiesResponse{Parties: parties}, nil
+}
+
+// DeleteCredential deletes a resident credential.
+// Requires the PIN.
+func (s *Server) DeleteCredential(ctx context.Context, device string, pin string, credentialID []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(device)
+	if err != nil {
+		return err
+	}
+	if err := d.checkPIN(pin); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(credentialID)
+	c, ok := d.creds[id]
+	if !ok || !c.rk {
+		return ErrNoCredentials
+	}
+	delete(d.creds, id)
+	return nil
+}
+
+// GenerateHMACSecret creates a credential with the hmac-secret extension.
+// If the device has a PIN, the PIN is required.
+func (s *Server) GenerateHMACSecret(ctx context.Context, req *fido2.GenerateHMACSecretRequest) (*fido2.GenerateHMACSecretResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if d.noHMACSecret {
+		return nil, ErrUnsupportedExtension
+	}
+	if len(req.ClientDataHash) != 32 {
+		return nil, errors.Wrapf(ErrInvalidArgument, "invalid client data hash")
+	}
+	if req.RP == nil || req.RP.ID == "" {
+		return nil, errors.Wrapf(ErrInvalidArgument, "no relying party")
+	}
+	if req.User == nil || len(req.User.ID) == 0 {
+		return nil, errors.Wrapf(ErrInvalidArgument, "no user")
+	}
+	if _, err := d.verify(req.PIN, true); err != nil {
+		return nil, err
+	}
+	cred := d.addCredential(req.RP, req.User, req.RK == fido2.True)
+	return &fido2.GenerateHMACSecretResponse{CredentialID: cred.id}, nil
+}
+
+// HMACSecret returns the hmac-secret for a credential (in CredentialIDs, or
+// a resident credential if not specified) and salt.
+// If the PIN is specified, the user is verified, which gives a different
+// hmac-secret than without.
+func (s *Server) HMACSecret(ctx context.Context, req *fido2.HMACSecretRequest) (*fido2.HMACSecretResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.findDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if d.noHMACSecret {
+		return nil, ErrUnsupportedExtension
+	}
+	if len(req.ClientDataHash) != 32 {
+		return nil, errors.Wrapf(ErrInvalidArgument, "invalid client data hash")
+	}
+	uv, err := d.verify(req.PIN, false)
+	if err != nil {
+		return nil, err
+	}
+	cred := d.findCredential(req.RPID, req.CredentialIDs)
+	if cred == nil {
+		return nil, ErrNoCredentials
+	}
+	secret, err := cred.hmacSecret(req.Salt, uv)
+	if err != nil {
+		return nil, err
+	}
+	return &fido2.HMACSecretResponse{HMACSecret: secret}, nil
+}
@@ -0,0 +1,234 @@
+package fido2test_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/keys-pub/keys-ext/auth/fido2"
+	"github.com/keys-pub/vault/auth/fido2test"
+	"github.com/stretchr/testify/require"
+)
+
+var cdh = bytes.Repeat([]byte{0x00}, 32)
+
+func generate(t *testing.T, srv *fido2test.Server, device string, pin string, rk fido2.OptionValue) []byte {
+	resp, err := srv.GenerateHMACSecret(context.TODO(), &fido2.GenerateHMACSecretRequest{
+		Device:         device,
+		PIN:            pin,
+		ClientDataHash: cdh,
+		RP:             &fido2.RelyingParty{ID: "test", Name: "test"},
+		User:           &fido2.User{ID: []byte{0x01}, Name: "alice"},
+		RK:             rk,
+	})
+	require.NoError(t, err)
+	return resp.CredentialID
+}
+
+func hmacSecret(srv *fido2test.Server, device string, pin string, credID []byte, salt []byte) ([]byte, error) {
+	req := &fido2.HMACSecretRequest{
+		Device:         device,
+		PIN:            pin,
+		ClientDataHash: cdh,
+		RPID:           "test",
+		Salt:           salt,
+	}
+	if credID != nil {
+		req.CredentialIDs = [][]byte{credID}
+	}
+	resp, err := srv.HMACSecret(context.TODO(), req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.HMACSecret, nil
+}
+
+func TestHMACSecret(t *testing.T) {
+	srv := fido2test.NewServer()
+	dev := srv.AddDevice("Test Key")
+	dev.SetPIN("12345")
+
+	credID := generate(t, srv, dev.Path(), "12345", fido2.Default)
+	require.Equal(t, 64, len(credID))
+
+	salt1 := bytes.Repeat([]byte{0x01}, 32)
+	salt2 := bytes.Repeat([]byte{0x02}, 32)
+
+	out, err := hmacSecret(srv, dev.Path(), "12345", credID, salt1)
+	require.NoError(t, err)
+	require.Equal(t, 32, len(out))
+
+	// Same credential and salt
+	out2, err := hmacSecret(srv, dev.Path(), "12345", credID, salt1)
+	require.NoError(t, err)
+	require.Equal(t, out, out2)
+
+	// Two salts
+	out3, err := hmacSecret(srv, dev.Path(), "12345", credID, append(append([]byte{}, salt1...), salt2...))
+	require.NoError(t, err)
+	require.Equal(t, 64, len(out3))
+	require.Equal(t, out, out3[:32])
+	require.NotEqual(t, out, out3[32:])
+
+	// Without PIN (no user verification)
+	out4, err := hmacSecret(srv, dev.Path(), "", credID, salt1)
+	require.NoError(t, err)
+	require.NotEqual(t, out, out4)
+
+	// Other credential
+	credID2 := generate(t, srv, dev.Path(), "12345", fido2.Default)
+	out5, err := hmacSecret(srv, dev.Path(), "12345", credID2, salt1)
+	require.NoError(t, err)
+	require.NotEqual(t, out, out5)
+
+	// Invalid salt
+	_, err = hmacSecret(srv, dev.Path(), "12345", credID, []byte{0x01})
+	require.EqualError(t, err, "invalid salt length: FIDO_ERR_INVALID_ARGUMENT")
+
+	// Unknown credential
+	_, err = hmacSecret(srv, dev.Path(), "12345", bytes.Repeat([]byte{0x01}, 64), salt1)
+	require.Equal(t, fido2test.ErrNoCredentials, err)
+
+	// No resident credential
+	_, err = hmacSecret(srv, dev.Path(), "12345", nil, salt1)
+	require.Equal(t, fido2test.ErrNoCredentials, err)
+
+	// Other device
+	dev2 := srv.AddDevice("Test Key 2")
+	_, err = hmacSecret(srv, dev2.Path(), "", credID, salt1)
+	require.Equal(t, fido2test.ErrNoCredentials, err)
+}
+
+func TestResidentKey(t *testing.T) {
+	srv := fido2test.NewServer()
+	dev := srv.AddDevice("Test Key")
+	dev.SetPIN("12345")
+
+	credID := generate(t, srv, dev.Path(), "12345", fido2.True)
+	salt := bytes.Repeat([]byte{0x01}, 32)
+
+	out, err := hmacSecret(srv, dev.Path(), "12345", credID, salt)
+	require.NoError(t, err)
+	out2, err := hmacSecret(srv, dev.Path(), "12345", nil, salt)
+	require.NoError(t, err)
+	require.Equal(t, out, out2)
+
+	creds, err := srv.Credentials(context.TODO(), &fido2.CredentialsRequest{Device: dev.Path(), PIN: "12345", RPID: "test"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(creds.Credentials))
+	require.Equal(t, credID, creds.Credentials[0].ID)
+
+	rps, err := srv.RelyingParties(context.TODO(), &fido2.RelyingPartiesRequest{Device: dev.Path(), PIN: "12345"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rps.Parties))
+	require.Equal(t, "test", rps.Parties[0].ID)
+
+	// Same user replaces resident credential
+	credID2 := generate(t, srv, dev.Path(), "12345", fido2.True)
+	creds, err = srv.Credentials(context.TODO(), &fido2.CredentialsRequest{Device: dev.Path(), PIN: "12345", RPID: "test"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(creds.Credentials))
+	require.Equal(t, credID2, creds.Credentials[0].ID)
+
+	// Reset
+	_, err = srv.Reset(context.TODO(), &fido2.ResetRequest{Device: dev.Path()})
+	require.NoError(t, err)
+	_, err = hmacSecret(srv, dev.Path(), "", nil, salt)
+	require.Equal(t, fido2test.ErrNoCredentials, err)
+}
+
+func TestPIN(t *testing.T) {
+	srv := fido2test.NewServer()
+	dev := srv.AddDevice("Test Key")
+
+	// No PIN
+	credID := generate(t, srv, dev.Path(), "", fido2.Default)
+	salt := bytes.Repeat([]byte{0x01}, 32)
+	_, err := hmacSecret(srv, dev.Path(), "12345", credID, salt)
+	require.Equal(t, fido2test.ErrPinNotSet, err)
+
+	_, err = srv.SetPIN(context.TODO(), &fido2.SetPINRequest{Device: dev.Path(), PIN: "123"})
+	require.Equal(t, fido2test.ErrPinPolicyViolation, err)
+	_, err = srv.SetPIN(context.TODO(), &fido2.SetPINRequest{Device: dev.Path(), PIN: "12345"})
+	require.NoError(t, err)
+
+	// Change PIN
+	_, err = srv.SetPIN(context.TODO(), &fido2.SetPINRequest{Device: dev.Path(), PIN: "54321"})
+	require.Equal(t, fido2test.ErrPinRequired, err)
+	_, err = srv.SetPIN(context.TODO(), &fido2.SetPINRequest{Device: dev.Path(), PIN: "54321", OldPIN: "12345"})
+	require.NoError(t, err)
+
+	// PIN required to generate
+	_, err = srv.GenerateHMACSecret(context.TODO(), &fido2.GenerateHMACSecretRequest{
+		Device:         dev.Path(),
+		ClientDataHash: cdh,
+		RP:             &fido2.RelyingParty{ID: "test", Name: "test"},
+		User:           &fido2.User{ID: []byte{0x01}, Name: "alice"},
+	})
+	require.Equal(t, fido2test.ErrPinRequired, err)
+
+	// Invalid PIN
+	_, err = hmacSecret(srv, dev.Path(), "invalid", credID, salt)
+	require.Equal(t, fido2test.ErrPinInvalid, err)
+	require.Equal(t, 7, dev.Retries())
+	_, err = hmacSecret(srv, dev.Path(), "invalid", credID, salt)
+	require.Equal(t, fido2test.ErrPinInvalid, err)
+	_, err = hmacSecret(srv, dev.Path(), "invalid", credID, salt)
+	require.Equal(t, fido2test.ErrPinAuthBlocked, err)
+	_, err = hmacSecret(srv, dev.Path(), "54321", credID, salt)
+	require.Equal(t, fido2test.ErrPinAuthBlocked, err)
+
+	resp, err := srv.RetryCount(context.TODO(), &fido2.RetryCountRequest{Device: dev.Path()})
+	require.NoError(t, err)
+	require.Equal(t, int32(5), resp.Count)
+
+	// Plug back in, valid PIN resets retries
+	dev.Unplug()
+	dev.Plug()
+	_, err = hmacSecret(srv, dev.Path(), "54321", credID, salt)
+	require.NoError(t, err)
+	require.Equal(t, 8, dev.Retries())
+
+	// Blocked
+	for i := 0; i < 8; i++ {
+		if i%3 == 0 {
+			dev.Unplug()
+			dev.Plug()
+		}
+		_, err = hmacSecret(srv, dev.Path(), "invalid", credID, salt)
+		require.Error(t, err)
+	}
+	require.Equal(t, fido2test.ErrPinBlocked, err)
+	_, err = hmacSecret(srv, dev.Path(), "54321", credID, salt)
+	require.Equal(t, fido2test.ErrPinBlocked, err)
+}
+
+func TestFaults(t *testing.T) {
+	srv := fido2test.NewServer()
+	dev := srv.AddDevice("Test Key")
+	dev2 := srv.AddDevice("Test Key 2")
+	require.NotEqual(t, dev.AAGUID(), dev2.AAGUID())
+
+	credID := generate(t, srv, dev.Path(), "", fido2.Default)
+	salt := bytes.Repeat([]byte{0x01}, 32)
+
+	// Unplugged
+	dev.Unplug()
+	devices, err := srv.Devices(context.TODO(), &fido2.DevicesRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(devices.Devices))
+	require.Equal(t, dev2.Path(), devices.Devices[0].Path)
+	_, err = hmacSecret(srv, dev.Path(), "", credID, salt)
+	require.EqualError(t, err, "device not found virtual/0: FIDO_ERR_RX")
+	dev.Plug()
+	_, err = hmacSecret(srv, dev.Path(), "", credID, salt)
+	require.NoError(t, err)
+
+	// No hmac-secret extension
+	dev.DisableHMACSecret()
+	info, err := srv.DeviceInfo(context.TODO(), &fido2.DeviceInfoRequest{Device: dev.Path()})
+	require.NoError(t, err)
+	require.False(t, info.Info.HasExtension(fido2.HMACSecretExtension))
+	_, err = hmacSecret(srv, dev.Path(), "", credID, salt)
+	require.Equal(t, fido2test.ErrUnsupportedExtension, err)
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"github.com/keys-pub/keys"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id is the KDF for passwords.
+const Argon2id = "argon2id"
+
+// KDFParams are the Argon2id parameters for deriving a key from a password.
+type KDFParams struct {
+	Time uint32
+	// Memory in KiB.
+	Memory  uint32
+	Threads uint8
+}
+
+// KDF cost profiles.
+var (
+	// KDFInteractive is the same as keys.KeyForPassword, used for passwords
+	// registered before KDF parameters were stored.
+	KDFInteractive = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+	// KDFModerate takes about 3 times longer and 4 times more memory than
+	// KDFInteractive.
+	KDFModerate = KDFParams{Time: 3, Memory: 256 * 1024, Threads: 4}
+	// KDFSensitive for machines that can spare 1GiB of memory.
+	KDFSensitive = KDFParams{Time: 4, Memory: 1024 * 1024, Threads: 4}
+)
+
+// below returns true if p is weaker than policy.
+func (p KDFParams) below(policy KDFParams) bool {
+	return p.Time < policy.Time || p.Memory < policy.Memory
+}
+
+// kdfParams returns the KDF parameters for a password auth.
+func kdfParams(auth *Auth) (KDFParams, error) {
+	switch auth.KDF {
+	case "":
+		return KDFInteractive, nil
+	case Argon2id:
+		return KDFParams{Time: auth.KDFTime, Memory: auth.KDFMemory, Threads: auth.KDFThreads}, nil
+	default:
+		return KDFParams{}, errors.Errorf("unsupported kdf %s", auth.KDF)
+	}
+}
+
+func setKDFParams(auth *Auth, params KDFParams) {
+	auth.KDF = Argon2id
+	auth.KDFTime = params.Time
+	auth.KDFMemory = params.Memory
+	auth.KDFThreads = params.Threads
+}
+
+func keyForPassword(password string, salt []byte, params KDFParams) (*[32]byte, error) {
+	if len(salt) < 16 {
+		return nil, errors.Errorf("not enough salt")
+	}
+	if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+		return nil, errors.Errorf("invalid kdf params")
+	}
+	b := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, 32)
+	return keys.Bytes32(b), nil
+}
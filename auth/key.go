@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/sha256"
+
+	"github.com/keys-pub/keys"
+	"github.com/pkg/errors"
+)
+
+// wrapKey encrypts the master key for an auth with the auth key.
+//
+// The master key is sealed (keys.CryptoBoxSeal) to a new X25519 key for the
+// auth, and the X25519 private key is encrypted with the auth key.
+// This allows a new master key to be sealed for the auth when the master key is
+// rotated (see rewrapKey), without the auth key, and without storing anything
+// the master key can open.
+func wrapKey(auth *Auth, key *[32]byte, mk *[32]byte) {
+	bk := keys.GenerateX25519Key()
+	auth.PublicKey = bk.PublicKey().Bytes()
+	auth.SecretKey = secretBoxSeal(bk.PrivateKey()[:], key)
+	auth.EncryptedKey = keys.CryptoBoxSeal(mk[:], bk.PublicKey())
+	auth.MasterKeyID = MasterKeyID(mk)
+}
+
+// rewrapKey seals a new master key for an auth (see wrapKey).
+func rewrapKey(auth *Auth, mk *[32]byte) error {
+	if len(auth.PublicKey) != 32 {
+		return errors.Errorf("auth %s has no public key", auth.ID)
+	}
+	pk := keys.NewX25519PublicKey(keys.Bytes32(auth.PublicKey))
+	auth.EncryptedKey = keys.CryptoBoxSeal(mk[:], pk)
+	auth.MasterKeyID = MasterKeyID(mk)
+	return nil
+}
+
+// unwrapKey decrypts the master key for an auth with the auth key.
+// Returns nil if the auth key is invalid.
+func unwrapKey(auth *Auth, key *[32]byte) *[32]byte {
+	// Auth from before wrapKey has the master key encrypted with the auth key.
+	if len(auth.PublicKey) == 0 {
+		b, ok := secretBoxOpen(auth.EncryptedKey, key)
+		if !ok || len(b) != 32 {
+			return nil
+		}
+		return keys.Bytes32(b)
+	}
+	sk, ok := secretBoxOpen(auth.SecretKey, key)
+	if !ok || len(sk) != 32 {
+		return nil
+	}
+	b, err := keys.CryptoBoxSealOpen(auth.EncryptedKey, keys.NewX25519KeyFromPrivateKey(keys.Bytes32(sk)))
+	if err != nil || len(b) != 32 {
+		return nil
+	}
+	return keys.Bytes32(b)
+}
+
+// MasterKeyID identifies the master key an auth is for, so the auths for a
+// master key can be found without their auth keys (for rotation and reset).
+func MasterKeyID(mk *[32]byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write([]byte("vault.mk"))
+	_, _ = h.Write(mk[:])
+	return h.Sum(nil)[:16]
+}
@@ -1,17 +1,36 @@
 package auth
 
-import "github.com/keys-pub/keys"
+import (
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys-ext/auth/fido2"
+	"github.com/keys-pub/keys/tsutil"
+)
 
 // Options for auth.
 type Options struct {
 	ClientKey *keys.EdX25519Key
+	// DeviceSelector chooses a FIDO2 device if multiple devices match.
+	DeviceSelector DeviceSelector
+	// RP is the relying party for new FIDO2 credentials.
+	RP *fido2.RelyingParty
+	// Throttle for failed password and paper key attempts.
+	Throttle ThrottlePolicy
+	Clock    tsutil.Clock
+	// KDF for new passwords, and the minimum for existing passwords, which
+	// are upgraded on unlock.
+	KDF KDFParams
 }
 
 // Option for DB.
 type Option func(*Options)
 
 func newOptions(opts ...Option) *Options {
-	options := &Options{}
+	options := &Options{
+		RP:       defaultRP,
+		Throttle: DefaultThrottlePolicy,
+		Clock:    tsutil.NewClock(),
+		KDF:      KDFInteractive,
+	}
 	for _, o := range opts {
 		o(options)
 	}
@@ -24,3 +43,43 @@ func WithClientKey(key *keys.EdX25519Key) Option {
 		o.ClientKey = key
 	}
 }
+
+// WithDeviceSelector chooses a FIDO2 device if multiple devices match, for
+// example by prompting the user.
+func WithDeviceSelector(selector DeviceSelector) Option {
+	return func(o *Options) {
+		o.DeviceSelector = selector
+	}
+}
+
+// WithRelyingParty sets the relying party for new FIDO2 credentials.
+// Existing credentials use the relying party they were created with, see
+// MigrateFIDO2RelyingParty.
+func WithRelyingParty(id string, name string) Option {
+	return func(o *Options) {
+		o.RP = &fido2.RelyingParty{ID: id, Name: name}
+	}
+}
+
+// WithThrottle sets the throttle policy for failed password and paper key
+// attempts.
+func WithThrottle(policy ThrottlePolicy) Option {
+	return func(o *Options) {
+		o.Throttle = policy
+	}
+}
+
+// WithClock ...
+func WithClock(clock tsutil.Clock) Option {
+	return func(o *Options) {
+		o.Clock = clock
+	}
+}
+
+// WithKDF sets the KDF parameters (cost profile) for new passwords, and the
+// minimum for existing passwords, which are upgraded on unlock.
+func WithKDF(params KDFParams) Option {
+	return func(o *Options) {
+		o.KDF = params
+	}
+}
@@ -17,13 +17,13 @@ func NewPaperKey(paperKey string, mk *[32]byte) (*Auth, error) {
 		return nil, errors.Wrapf(err, "failed to decode paper key")
 	}
 
-	ek := secretBoxSeal(mk[:], key)
-	return &Auth{
-		ID:           id,
-		Type:         api.PaperKeyType,
-		EncryptedKey: ek,
-		CreatedAt:    time.Now(),
-	}, nil
+	auth := &Auth{
+		ID:        id,
+		Type:      api.PaperKeyType,
+		CreatedAt: time.Now(),
+	}
+	wrapKey(auth, key, mk)
+	return auth, nil
 }
 
 // RegisterPaperKey registers paper key auth.
@@ -44,7 +44,12 @@ func (d *DB) RegisterPaperKey(paperKey string, mk *[32]byte) (*Auth, error) {
 }
 
 // PaperKey authenticates using a paper key.
+// Returns ErrThrottled if there were too many failed attempts (see
+// ThrottlePolicy).
 func (d *DB) PaperKey(paperKey string) (*Auth, *[32]byte, error) {
+	if err := d.reserveAttempt(api.PaperKeyType); err != nil {
+		return nil, nil, err
+	}
 	auths, err := d.ListByType(api.PaperKeyType)
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "failed to auth")
@@ -59,6 +64,9 @@ func (d *DB) PaperKey(paperKey string) (*Auth, *[32]byte, error) {
 		if mk == nil {
 			continue
 		}
+		if err := d.ResetThrottle(api.PaperKeyType); err != nil {
+			return nil, nil, err
+		}
 		return auth, mk, nil
 	}
 	return nil, nil, ErrInvalidAuth
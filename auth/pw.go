@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"bytes"
 	"time"
 
 	"github.com/keys-pub/keys"
@@ -9,29 +10,46 @@ import (
 	"github.com/pkg/errors"
 )
 
+// NewPassword creates a password auth (with KDFInteractive).
 func NewPassword(password string, mk *[32]byte) (*Auth, error) {
+	return NewPasswordWithKDF(password, mk, KDFInteractive)
+}
+
+// NewPasswordWithKDF creates a password auth with KDF parameters.
+func NewPasswordWithKDF(password string, mk *[32]byte, params KDFParams) (*Auth, error) {
 	id := encoding.MustEncode(keys.RandBytes(32), encoding.Base62)
+	auth := &Auth{
+		ID:        id,
+		Type:      api.PasswordType,
+		CreatedAt: time.Now(),
+	}
+	if err := wrapPassword(auth, password, mk, params); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// wrapPassword sets a new salt and KDF parameters, and encrypts the master key
+// with the password key.
+func wrapPassword(auth *Auth, password string, mk *[32]byte, params KDFParams) error {
 	salt := keys.RandBytes(24)
-	key, err := keys.KeyForPassword(password, salt)
+	key, err := keyForPassword(password, salt, params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	ek := secretBoxSeal(mk[:], key)
-	return &Auth{
-		ID:           id,
-		Type:         api.PasswordType,
-		EncryptedKey: ek,
-		Salt:         salt,
-		CreatedAt:    time.Now(),
-	}, nil
+	auth.Salt = salt
+	setKDFParams(auth, params)
+	wrapKey(auth, key, mk)
+	return nil
 }
 
-// RegisterPassword registers a password.
+// RegisterPassword registers a password (with the KDF parameters from
+// WithKDF).
 func (d *DB) RegisterPassword(password string, mk *[32]byte) (*Auth, error) {
 	if mk == nil {
 		return nil, errors.Errorf("nil master key")
 	}
-	auth, err := NewPassword(password, mk)
+	auth, err := NewPasswordWithKDF(password, mk, d.kdf)
 	if err != nil {
 		return nil, err
 	}
@@ -44,17 +62,37 @@ func (d *DB) RegisterPassword(password string, mk *[32]byte) (*Auth, error) {
 }
 
 // Password authenticates with a password.
+// If the password KDF parameters are below the KDF parameters from WithKDF, the
+// master key is re-wrapped with them.
+// Returns ErrThrottled if there were too many failed attempts (see
+// ThrottlePolicy).
 func (d *DB) Password(password string) (*Auth, *[32]byte, error) {
+	return d.password(password, nil)
+}
+
+// password authenticates with a password, for the master key with mkID (if
+// not nil).
+func (d *DB) password(password string, mkID []byte) (*Auth, *[32]byte, error) {
 	if password == "" {
 		return nil, nil, ErrInvalidAuth
 	}
+	if err := d.reserveAttempt(api.PasswordType); err != nil {
+		return nil, nil, err
+	}
 	auths, err := d.ListByType(api.PasswordType)
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "failed to auth")
 	}
 	for _, auth := range auths {
-
-		key, err := keys.KeyForPassword(password, auth.Salt)
+		if mkID != nil && len(auth.MasterKeyID) > 0 && !bytes.Equal(auth.MasterKeyID, mkID) {
+			continue
+		}
+		params, err := kdfParams(auth)
+		if err != nil {
+			logger.Warningf("Skipping password %s: %v", auth.ID, err)
+			continue
+		}
+		key, err := keyForPassword(password, auth.Salt, params)
 		if err != nil {
 			return nil, nil, errors.Wrapf(err, "failed to auth")
 		}
@@ -63,8 +101,35 @@ func (d *DB) Password(password string) (*Auth, *[32]byte, error) {
 		if mk == nil {
 			continue
 		}
+		if mkID != nil && !bytes.Equal(MasterKeyID(mk), mkID) {
+			continue
+		}
 
+		if params.below(d.kdf) {
+			if err := d.upgradePassword(auth, password, mk); err != nil {
+				logger.Warningf("Failed to upgrade password %s: %v", auth.ID, err)
+			}
+		}
+
+		if err := d.ResetThrottle(api.PasswordType); err != nil {
+			return nil, nil, err
+		}
 		return auth, mk, nil
 	}
 	return nil, nil, ErrInvalidAuth
 }
+
+// upgradePassword re-wraps the master key for the password with the KDF
+// parameters from WithKDF.
+func (d *DB) upgradePassword(auth *Auth, password string, mk *[32]byte) error {
+	logger.Infof("Upgrading password %s KDF...", auth.ID)
+	next := *auth
+	if err := wrapPassword(&next, password, mk, d.kdf); err != nil {
+		return err
+	}
+	if err := d.Set(&next); err != nil {
+		return err
+	}
+	*auth = next
+	return nil
+}
@@ -36,3 +36,47 @@ func TestPassword(t *testing.T) {
 	_, _, err = db.Password("")
 	require.EqualError(t, err, "invalid auth")
 }
+
+func TestPasswordKDF(t *testing.T) {
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+
+	low := auth.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+	high := auth.KDFParams{Time: 2, Memory: 16 * 1024, Threads: 1}
+
+	db, err := auth.NewDB(path, auth.WithKDF(low))
+	require.NoError(t, err)
+
+	mk := testutil.Seed(0x01)
+	reg, err := db.RegisterPassword("testpassword", mk)
+	require.NoError(t, err)
+	require.Equal(t, auth.Argon2id, reg.KDF)
+	require.Equal(t, uint32(1), reg.KDFTime)
+	require.Equal(t, uint32(8*1024), reg.KDFMemory)
+	require.Equal(t, uint8(1), reg.KDFThreads)
+	require.NoError(t, db.Close())
+
+	// Stronger policy upgrades on unlock
+	db, err = auth.NewDB(path, auth.WithKDF(high))
+	require.NoError(t, err)
+	defer db.Close()
+
+	out, mko, err := db.Password("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+
+	auths, err := db.ListByType(api.PasswordType)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+	require.Equal(t, reg.ID, auths[0].ID)
+	require.Equal(t, uint32(2), auths[0].KDFTime)
+	require.Equal(t, uint32(16*1024), auths[0].KDFMemory)
+	require.NotEqual(t, reg.Salt, auths[0].Salt)
+
+	_, mko, err = db.Password("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+}
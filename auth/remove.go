@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+)
+
+// ErrLastAuth if removing the last auth method.
+var ErrLastAuth = errors.New("can't remove the last auth method")
+
+// ErrLastNonPasswordAuth if removing the last auth method that isn't a
+// password (for recovering from a forgotten password).
+var ErrLastNonPasswordAuth = errors.New("can't remove the last non-password auth method")
+
+// ChangePassword replaces a password for the master key with mkID (see
+// MasterKeyID), if the old password is valid.
+// The auth keeps the same ID.
+func (d *DB) ChangePassword(mkID []byte, old string, new string) (*Auth, error) {
+	if new == "" {
+		return nil, errors.Errorf("empty password")
+	}
+	auth, mk, err := d.password(old, mkID)
+	if err != nil {
+		return nil, err
+	}
+	next := *auth
+	if err := wrapPassword(&next, new, mk, d.kdf); err != nil {
+		return nil, err
+	}
+	if err := d.Set(&next); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// Remove an auth method for the master key with mkID (see MasterKeyID).
+// Unless force, returns ErrLastAuth if it's the last auth method for the
+// master key, or ErrLastNonPasswordAuth if it's the last auth method that
+// isn't a password.
+// Auth methods for other master keys (in a shared auth database) are not
+// found or counted.
+func (d *DB) Remove(mkID []byte, id string, force bool) error {
+	if len(mkID) == 0 {
+		return errors.Errorf("no master key id")
+	}
+	return syncer.Transact(d.db, func(tx *sqlx.Tx) error {
+		var auths []*Auth
+		if err := tx.Select(&auths, "SELECT * FROM auth WHERE del = 0 AND mkid = $1", mkID); err != nil {
+			return err
+		}
+		var auth *Auth
+		nonPassword := 0
+		for _, a := range auths {
+			if a.ID == id {
+				auth = a
+			}
+			if a.Type != api.PasswordType {
+				nonPassword++
+			}
+		}
+		if auth == nil {
+			return errors.Errorf("auth not found %s", id)
+		}
+		if !force {
+			if len(auths) == 1 {
+				return ErrLastAuth
+			}
+			if auth.Type != api.PasswordType && nonPassword == 1 {
+				return ErrLastNonPasswordAuth
+			}
+		}
+		return deleteTx(tx, id)
+	})
+}
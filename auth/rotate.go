@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"bytes"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// ErrRotationPending if a master key rotation was interrupted, and can only be
+// completed by authenticating with an auth method (see PendingRotation).
+var ErrRotationPending = errors.New("master key rotation is pending (unlock with an auth method to complete it)")
+
+// ErrFIDO2ResidentKeyRotation if rotating a master key derived from a FIDO2
+// resident key auth (see SetupFIDO2ResidentKey), since a new master key
+// wouldn't be found with the resident key on a new machine.
+// A resident key registered for an existing master key (not derived, see
+// RegisterFIDO2HMACSecret) is rotated like any other hmac-secret auth.
+var ErrFIDO2ResidentKeyRotation = errors.New("can't rotate the master key derived from a FIDO2 resident key auth method (remove it first)")
+
+// rotation is a staged master key rotation.
+type rotation struct {
+	// From is the master key ID (see MasterKeyID) of the master key rotated
+	// from.
+	From []byte `msgpack:"from"`
+	// Auths with the new master key sealed for them.
+	Auths []*Auth `msgpack:"auths"`
+}
+
+// StageRotation prepares a master key rotation from mk to newMK, by sealing the
+// new master key for every auth method for mk (see wrapKey).
+// Auth methods for other master keys are not changed.
+// Auth methods are not changed until CommitRotation.
+// Returns ErrFIDO2ResidentKeyRotation if mk is derived from a FIDO2 resident
+// key auth method (see Auth.Derived).
+//
+// The new master key isn't stored in a way the master key can open, so if the
+// rotation is interrupted, it can only be completed with an auth method (see
+// PendingRotation).
+func (d *DB) StageRotation(mk *[32]byte, newMK *[32]byte) error {
+	if mk == nil || newMK == nil {
+		return errors.Errorf("nil master key")
+	}
+	auths, err := d.List()
+	if err != nil {
+		return err
+	}
+	id := MasterKeyID(mk)
+	staged := []*Auth{}
+	for _, auth := range auths {
+		if len(auth.PublicKey) == 0 {
+			return errors.Errorf("auth %s needs to be used (unlock with it) or removed before rotating", auth.ID)
+		}
+		if !bytes.Equal(auth.MasterKeyID, id) {
+			continue
+		}
+		if auth.Type == api.FIDO2ResidentKeyType && auth.Derived {
+			return ErrFIDO2ResidentKeyRotation
+		}
+		next := *auth
+		if err := rewrapKey(&next, newMK); err != nil {
+			return err
+		}
+		staged = append(staged, &next)
+	}
+	if len(staged) == 0 {
+		return errors.Errorf("no auth methods for this master key")
+	}
+
+	b, err := msgpack.Marshal(&rotation{From: id, Auths: staged})
+	if err != nil {
+		return err
+	}
+	return setConfigBytes(d.db, "rotation", b)
+}
+
+// unlockRotation opens the new master key of a staged rotation for auth (with
+// the auth key), so an interrupted rotation from mk can be completed (see
+// PendingRotation).
+func (d *DB) unlockRotation(auth *Auth, key *[32]byte, mk *[32]byte) {
+	rot, err := d.rotation()
+	if err != nil {
+		logger.Warningf("Failed to get rotation: %v", err)
+		return
+	}
+	if rot == nil {
+		return
+	}
+	for _, staged := range rot.Auths {
+		if staged.ID != auth.ID {
+			continue
+		}
+		if newMK := unwrapKey(staged, key); newMK != nil {
+			d.rmtx.Lock()
+			d.rotated[*mk] = newMK
+			d.rmtx.Unlock()
+		}
+	}
+}
+
+// PendingRotation returns the new master key of a staged rotation from mk.
+// Returns nil if there is no staged rotation from mk.
+// The new master key is only available after authenticating with an auth
+// method (for mk), otherwise returns ErrRotationPending.
+func (d *DB) PendingRotation(mk *[32]byte) (*[32]byte, error) {
+	rot, err := d.rotation()
+	if err != nil {
+		return nil, err
+	}
+	if rot == nil || !bytes.Equal(rot.From, MasterKeyID(mk)) {
+		return nil, nil
+	}
+	d.rmtx.Lock()
+	defer d.rmtx.Unlock()
+	newMK, ok := d.rotated[*mk]
+	if !ok {
+		return nil, ErrRotationPending
+	}
+	return newMK, nil
+}
+
+// CommitRotation replaces auth methods with those from the staged rotation.
+func (d *DB) CommitRotation() error {
+	rot, err := d.rotation()
+	if err != nil {
+		return err
+	}
+	if rot == nil {
+		return errors.Errorf("no pending rotation")
+	}
+	if err := syncer.Transact(d.db, func(tx *sqlx.Tx) error {
+		for _, auth := range rot.Auths {
+			if err := setTx(tx, auth); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM config WHERE key = $1", "rotation"); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	d.clearRotated()
+	return nil
+}
+
+// DropRotation removes a staged rotation from mk, if there is one.
+// This is for a rotation that was interrupted before the vault database was
+// rekeyed (it still opens with mk), so it can't be resumed.
+func (d *DB) DropRotation(mk *[32]byte) error {
+	rot, err := d.rotation()
+	if err != nil {
+		return err
+	}
+	if rot == nil || !bytes.Equal(rot.From, MasterKeyID(mk)) {
+		return nil
+	}
+	logger.Infof("Dropping master key rotation that wasn't started")
+	return d.CancelRotation()
+}
+
+// CancelRotation removes a staged rotation.
+func (d *DB) CancelRotation() error {
+	if _, err := d.db.Exec("DELETE FROM config WHERE key = $1", "rotation"); err != nil {
+		return err
+	}
+	d.clearRotated()
+	return nil
+}
+
+func (d *DB) clearRotated() {
+	d.rmtx.Lock()
+	d.rotated = map[[32]byte]*[32]byte{}
+	d.rmtx.Unlock()
+}
+
+func (d *DB) rotation() (*rotation, error) {
+	b, err := getConfigBytes(d.db, "rotation")
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	var rot rotation
+	if err := msgpack.Unmarshal(b, &rot); err != nil {
+		return nil, err
+	}
+	return &rot, nil
+}
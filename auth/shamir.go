@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/encoding"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/auth/shamir"
+	"github.com/pkg/errors"
+)
+
+// NewShamir creates an auth for a random recovery key, split into n shares,
+// any k of which can recover the master key (see DB.Shamir).
+// Each share is a phrase, the share number followed by the (paper key) words.
+func NewShamir(mk *[32]byte, n int, k int) (*Auth, []string, error) {
+	id := encoding.MustEncode(keys.RandBytes(32), encoding.Base62)
+
+	key := keys.Rand32()
+	splits, err := shamir.Split(key[:], n, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	shares := make([]string, 0, len(splits))
+	for _, split := range splits {
+		share, err := encodeShare(split)
+		if err != nil {
+			return nil, nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	auth := &Auth{
+		ID:        id,
+		Type:      api.ShamirType,
+		CreatedAt: time.Now(),
+	}
+	wrapKey(auth, key, mk)
+	return auth, shares, nil
+}
+
+// RegisterShamir registers a recovery key split into n shares with threshold k.
+// Returns the shares, which are not stored.
+func (d *DB) RegisterShamir(mk *[32]byte, n int, k int) (*Auth, []string, error) {
+	if mk == nil {
+		return nil, nil, errors.Errorf("nil master key")
+	}
+	auth, shares, err := NewShamir(mk, n, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := d.Set(auth); err != nil {
+		return nil, nil, err
+	}
+	return auth, shares, nil
+}
+
+// Shamir authenticates by combining recovery key shares (see RegisterShamir).
+// If there are fewer shares than the threshold, returns ErrInvalidAuth.
+// Shares that can't be decoded or combined are also a failed attempt.
+// Returns ErrThrottled if there were too many failed attempts (see
+// ThrottlePolicy).
+func (d *DB) Shamir(shares []string) (*Auth, *[32]byte, error) {
+	if err := d.reserveAttempt(api.ShamirType); err != nil {
+		return nil, nil, err
+	}
+	auths, err := d.ListByType(api.ShamirType)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to auth")
+	}
+
+	splits := make([]*shamir.Share, 0, len(shares))
+	for _, share := range shares {
+		split, err := decodeShare(share)
+		if err != nil {
+			return nil, nil, err
+		}
+		splits = append(splits, split)
+	}
+	b, err := shamir.Combine(splits)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := keys.Bytes32(b)
+
+	for _, auth := range auths {
+		mk := d.unlock(auth, key)
+		if mk == nil {
+			continue
+		}
+		if err := d.ResetThrottle(api.ShamirType); err != nil {
+			return nil, nil, err
+		}
+		return auth, mk, nil
+	}
+	return nil, nil, ErrInvalidAuth
+}
+
+func encodeShare(share *shamir.Share) (string, error) {
+	phrase, err := encoding.BytesToPhrase(share.Y)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(int(share.X)) + " " + phrase, nil
+}
+
+func decodeShare(s string) (*shamir.Share, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return nil, errors.Errorf("invalid share")
+	}
+	x, err := strconv.Atoi(fields[0])
+	if err != nil || x < 1 || x > 255 {
+		return nil, errors.Errorf("invalid share number %q", fields[0])
+	}
+	y, err := encoding.PhraseToBytes(strings.Join(fields[1:], " "), true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode share %d", x)
+	}
+	return &shamir.Share{X: byte(x), Y: y[:]}, nil
+}
@@ -0,0 +1,45 @@
+package shamir
+
+// Arithmetic in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1,
+// using log and exp tables for generator 3.
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		expTable[i+255] = x
+		logTable[x] = byte(i)
+		// x *= 3
+		x ^= xtime(x)
+	}
+}
+
+// xtime multiplies by x (2).
+func xtime(b byte) byte {
+	if b&0x80 != 0 {
+		return (b << 1) ^ 0x1b
+	}
+	return b << 1
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// div returns a / b, b must be non-zero.
+func div(a, b byte) byte {
+	if b == 0 {
+		panic("division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
@@ -0,0 +1,99 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+package shamir
+
+import (
+	"github.com/keys-pub/keys"
+	"github.com/pkg/errors"
+)
+
+// Share of a secret.
+type Share struct {
+	// X is the (non-zero) x-coordinate.
+	X byte
+	// Y are the polynomial values at X, one for each byte of the secret.
+	Y []byte
+}
+
+// Split a secret into n shares, any k of which can recover the secret (see
+// Combine).
+// Fewer than k shares reveal nothing about the secret.
+func Split(secret []byte, n int, k int) ([]*Share, error) {
+	if len(secret) == 0 {
+		return nil, errors.Errorf("empty secret")
+	}
+	if k < 2 {
+		return nil, errors.Errorf("threshold must be at least 2")
+	}
+	if n < k {
+		return nil, errors.Errorf("shares must be at least threshold")
+	}
+	if n > 255 {
+		return nil, errors.Errorf("too many shares")
+	}
+
+	shares := make([]*Share, n)
+	for i := 0; i < n; i++ {
+		shares[i] = &Share{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+
+	// For each byte of the secret, a random polynomial of degree k-1 with the
+	// secret byte as the constant term.
+	coeffs := make([]byte, k)
+	for j, b := range secret {
+		coeffs[0] = b
+		copy(coeffs[1:], keys.RandBytes(k-1))
+		for _, share := range shares {
+			share.Y[j] = eval(coeffs, share.X)
+		}
+	}
+	return shares, nil
+}
+
+// Combine shares to recover the secret.
+// If there are fewer shares than the threshold used to split, the result is
+// not the secret (and there is no way to tell, here).
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.Errorf("not enough shares")
+	}
+	size := len(shares[0].Y)
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if share.X == 0 {
+			return nil, errors.Errorf("invalid share")
+		}
+		if len(share.Y) != size {
+			return nil, errors.Errorf("share lengths don't match")
+		}
+		if seen[share.X] {
+			return nil, errors.Errorf("duplicate share %d", share.X)
+		}
+		seen[share.X] = true
+	}
+
+	// Lagrange interpolation at x=0.
+	secret := make([]byte, size)
+	for i, si := range shares {
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			// sj.X / (sj.X - si.X), subtraction is xor.
+			basis = mul(basis, div(sj.X, sj.X^si.X))
+		}
+		for b := 0; b < size; b++ {
+			secret[b] ^= mul(si.Y[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// eval returns the polynomial with coefficients (lowest degree first) at x.
+func eval(coeffs []byte, x byte) byte {
+	out := byte(0)
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		out = mul(out, x) ^ coeffs[i]
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package shamir_test
+
+import (
+	"testing"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault/auth/shamir"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := keys.RandBytes(32)
+
+	shares, err := shamir.Split(secret, 5, 3)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(shares))
+
+	// Any 3 shares
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				out, err := shamir.Combine([]*shamir.Share{shares[i], shares[j], shares[k]})
+				require.NoError(t, err)
+				require.Equal(t, secret, out)
+			}
+		}
+	}
+
+	// All shares
+	out, err := shamir.Combine(shares)
+	require.NoError(t, err)
+	require.Equal(t, secret, out)
+
+	// Not enough shares
+	out, err = shamir.Combine(shares[:2])
+	require.NoError(t, err)
+	require.NotEqual(t, secret, out)
+
+	_, err = shamir.Combine(shares[:1])
+	require.EqualError(t, err, "not enough shares")
+
+	_, err = shamir.Combine([]*shamir.Share{shares[0], shares[1], shares[0]})
+	require.EqualError(t, err, "duplicate share 1")
+}
+
+func TestSplitInvalid(t *testing.T) {
+	secret := keys.RandBytes(32)
+
+	_, err := shamir.Split(secret, 3, 1)
+	require.EqualError(t, err, "threshold must be at least 2")
+
+	_, err = shamir.Split(secret, 2, 3)
+	require.EqualError(t, err, "shares must be at least threshold")
+
+	_, err = shamir.Split(secret, 256, 2)
+	require.EqualError(t, err, "too many shares")
+
+	_, err = shamir.Split([]byte{}, 3, 2)
+	require.EqualError(t, err, "empty secret")
+}
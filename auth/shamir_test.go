@@ -0,0 +1,62 @@
+package auth_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShamir(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	mk := testutil.Seed(0x01)
+
+	reg, shares, err := db.RegisterShamir(mk, 3, 2)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(shares))
+
+	auths, err := db.ListByType(api.ShamirType)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+
+	out, mko, err := db.Shamir([]string{shares[0], shares[2]})
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+
+	out, mko, err = db.Shamir([]string{shares[2], shares[1]})
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+
+	_, _, err = db.Shamir(shares[:1])
+	require.EqualError(t, err, "not enough shares")
+
+	// Shares from a different split
+	_, other, err := auth.NewShamir(mk, 3, 2)
+	require.NoError(t, err)
+	_, _, err = db.Shamir([]string{shares[0], other[1]})
+	require.EqualError(t, err, "invalid auth")
+
+	// Threshold 3
+	_, shares3, err := db.RegisterShamir(mk, 5, 3)
+	require.NoError(t, err)
+	_, _, err = db.Shamir(shares3[:2])
+	require.EqualError(t, err, "invalid auth")
+	_, mko, err = db.Shamir([]string{shares3[4], shares3[0], shares3[3]})
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+
+	_, _, err = db.Shamir([]string{"0 " + shares[0][2:], shares[1]})
+	require.EqualError(t, err, `invalid share number "0"`)
+
+	_, _, err = db.RegisterShamir(mk, 2, 3)
+	require.EqualError(t, err, "shares must be at least threshold")
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/encoding"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DialSSHAgent connects to the ssh-agent socket.
+// If sock is empty, uses SSH_AUTH_SOCK.
+// The caller should close the connection when done with the agent.
+func DialSSHAgent(sock string) (agent.ExtendedAgent, io.Closer, error) {
+	if sock == "" {
+		sock = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if sock == "" {
+		return nil, nil, errors.Errorf("no ssh-agent (SSH_AUTH_SOCK not set)")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to connect to ssh-agent")
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// SSHAgentKeys lists the keys in the agent that can be used for auth.
+// Only Ed25519 keys are supported, since their signatures are deterministic.
+func SSHAgentKeys(ag agent.Agent) ([]*agent.Key, error) {
+	if ag == nil {
+		return nil, errors.Errorf("no ssh-agent")
+	}
+	list, err := ag.List()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list ssh-agent keys")
+	}
+	out := []*agent.Key{}
+	for _, key := range list {
+		if key.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+		out = append(out, key)
+	}
+	return out, nil
+}
+
+// NewSSHAgent creates an auth for an Ed25519 key in the agent.
+// The auth key is derived from the signature of a random challenge, which is
+// stored as the salt.
+func NewSSHAgent(ag agent.Agent, key ssh.PublicKey, mk *[32]byte) (*Auth, error) {
+	if ag == nil {
+		return nil, errors.Errorf("no ssh-agent")
+	}
+	if key == nil {
+		return nil, errors.Errorf("no ssh key")
+	}
+	if key.Type() != ssh.KeyAlgoED25519 {
+		return nil, errors.Errorf("unsupported ssh key type %s", key.Type())
+	}
+	id := encoding.MustEncode(keys.RandBytes(32), encoding.Base62)
+	challenge := keys.RandBytes(32)
+
+	authKey, err := sshAgentKey(ag, key, challenge)
+	if err != nil {
+		return nil, err
+	}
+	// Check the signature is deterministic, otherwise we wouldn't be able to
+	// derive the same key again.
+	check, err := sshAgentKey(ag, key, challenge)
+	if err != nil {
+		return nil, err
+	}
+	if *check != *authKey {
+		return nil, errors.Errorf("ssh-agent signature isn't deterministic")
+	}
+
+	auth := &Auth{
+		ID:        id,
+		Type:      api.SSHAgentType,
+		Salt:      challenge,
+		CreatedAt: time.Now(),
+	}
+	wrapKey(auth, authKey, mk)
+	return auth, nil
+}
+
+// RegisterSSHAgent registers ssh-agent auth for an Ed25519 key (see
+// SSHAgentKeys).
+func (d *DB) RegisterSSHAgent(ag agent.Agent, key ssh.PublicKey, mk *[32]byte) (*Auth, error) {
+	if mk == nil {
+		return nil, errors.Errorf("nil master key")
+	}
+	auth, err := NewSSHAgent(ag, key, mk)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Set(auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// SSHAgent authenticates using a key in the ssh-agent.
+// Each Ed25519 key in the agent is tried for each ssh-agent auth.
+func (d *DB) SSHAgent(ag agent.Agent) (*Auth, *[32]byte, error) {
+	auths, err := d.ListByType(api.SSHAgentType)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to auth")
+	}
+	if len(auths) == 0 {
+		return nil, nil, ErrInvalidAuth
+	}
+	sshKeys, err := SSHAgentKeys(ag)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sshKeys) == 0 {
+		return nil, nil, errors.Errorf("no ed25519 keys in ssh-agent")
+	}
+
+	for _, auth := range auths {
+		for _, key := range sshKeys {
+			authKey, err := sshAgentKey(ag, key, auth.Salt)
+			if err != nil {
+				logger.Infof("Failed to sign with ssh key %s: %v", ssh.FingerprintSHA256(key), err)
+				continue
+			}
+			if mk := d.unlock(auth, authKey); mk != nil {
+				return auth, mk, nil
+			}
+		}
+	}
+	return nil, nil, ErrInvalidAuth
+}
+
+// sshAgentKey returns the auth key from the signature of challenge.
+func sshAgentKey(ag agent.Agent, key ssh.PublicKey, challenge []byte) (*[32]byte, error) {
+	if len(challenge) != 32 {
+		return nil, errors.Errorf("invalid challenge")
+	}
+	sig, err := ag.Sign(key, sshAgentChallenge(challenge))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign with ssh-agent")
+	}
+	if sig.Format != ssh.KeyAlgoED25519 || len(sig.Blob) != 64 {
+		return nil, errors.Errorf("unsupported ssh signature %s", sig.Format)
+	}
+	h := sha256.New()
+	_, _ = h.Write([]byte("vault.ssh-agent"))
+	_, _ = h.Write(sig.Blob)
+	return keys.Bytes32(h.Sum(nil)), nil
+}
+
+// sshAgentChallenge is the data signed, prefixed so the signature can't be
+// used for anything else (such as an SSH login).
+func sshAgentChallenge(challenge []byte) []byte {
+	return bytes.Join([][]byte{[]byte("vault.ssh-agent.challenge"), challenge}, nil)
+}
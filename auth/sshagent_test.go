@@ -0,0 +1,84 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHAgent(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	mk := testutil.Seed(0x01)
+
+	ag := agent.NewKeyring()
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	err = ag.Add(agent.AddedKey{PrivateKey: sk, Comment: "test"})
+	require.NoError(t, err)
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	err = ag.Add(agent.AddedKey{PrivateKey: ek, Comment: "ecdsa"})
+	require.NoError(t, err)
+
+	sshKeys, err := auth.SSHAgentKeys(ag)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sshKeys))
+	require.Equal(t, "test", sshKeys[0].Comment)
+
+	// ECDSA signatures aren't deterministic
+	epk, err := ssh.NewPublicKey(&ek.PublicKey)
+	require.NoError(t, err)
+	_, err = db.RegisterSSHAgent(ag, epk, mk)
+	require.EqualError(t, err, "unsupported ssh key type ecdsa-sha2-nistp256")
+
+	reg, err := db.RegisterSSHAgent(ag, sshKeys[0], mk)
+	require.NoError(t, err)
+	require.Equal(t, 32, len(reg.Salt))
+
+	auths, err := db.ListByType(api.SSHAgentType)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+
+	out, mko, err := db.SSHAgent(ag)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+
+	// Different key
+	ag2 := agent.NewKeyring()
+	_, sk2, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	err = ag2.Add(agent.AddedKey{PrivateKey: sk2})
+	require.NoError(t, err)
+	_, _, err = db.SSHAgent(ag2)
+	require.EqualError(t, err, "invalid auth")
+
+	// No keys
+	_, _, err = db.SSHAgent(agent.NewKeyring())
+	require.EqualError(t, err, "no ed25519 keys in ssh-agent")
+
+	// Locked agent
+	err = ag.Lock([]byte("testpassword"))
+	require.NoError(t, err)
+	_, _, err = db.SSHAgent(ag)
+	require.EqualError(t, err, "no ed25519 keys in ssh-agent")
+	err = ag.Unlock([]byte("testpassword"))
+	require.NoError(t, err)
+	_, mko, err = db.SSHAgent(ag)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+}
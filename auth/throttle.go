@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+)
+
+// ThrottlePolicy for failed password, paper key and Shamir attempts.
+type ThrottlePolicy struct {
+	// Free is the number of failed attempts allowed without a delay.
+	Free int
+	// Delay after the first failed attempt after Free, doubled for each failed
+	// attempt after that (up to MaxDelay).
+	Delay time.Duration
+	// MaxDelay is the max delay, if 0, the DefaultThrottlePolicy MaxDelay.
+	MaxDelay time.Duration
+	// Lockout is the number of failed attempts after which auth is locked out
+	// for LockoutDuration, or if 0, until ResetThrottle.
+	// If Lockout is 0, there is no lockout.
+	Lockout         int
+	LockoutDuration time.Duration
+}
+
+// DefaultThrottlePolicy allows 3 failed attempts, then delays 1s, 2s, 4s, ...
+// up to 5 minutes, without a lockout.
+var DefaultThrottlePolicy = ThrottlePolicy{
+	Free:     3,
+	Delay:    time.Second,
+	MaxDelay: 5 * time.Minute,
+}
+
+// ErrThrottled if there were too many failed attempts.
+type ErrThrottled struct {
+	// Failures is the number of failed attempts.
+	Failures int
+	// Next is when the next attempt is allowed.
+	// If zero, auth is locked out until ResetThrottle.
+	Next time.Time
+}
+
+func (e ErrThrottled) Error() string {
+	if e.Next.IsZero() {
+		return fmt.Sprintf("too many failed attempts (%d), locked out", e.Failures)
+	}
+	return fmt.Sprintf("too many failed attempts (%d), try again at %s", e.Failures, e.Next.Format(time.RFC3339))
+}
+
+type throttle struct {
+	Type     Type  `db:"type"`
+	Failures int   `db:"failures"`
+	Last     int64 `db:"ts"`
+}
+
+// next returns when the next attempt is allowed after failures, the last at
+// time last.
+// Returns zero time if locked out (until reset).
+func (p ThrottlePolicy) next(failures int, last time.Time) time.Time {
+	if p.Lockout > 0 && failures >= p.Lockout {
+		if p.LockoutDuration == 0 {
+			return time.Time{}
+		}
+		return last.Add(p.LockoutDuration)
+	}
+	if failures <= p.Free {
+		return last
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = DefaultThrottlePolicy.MaxDelay
+	}
+	delay := p.Delay
+	for i := 1; i < failures-p.Free && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return last.Add(delay)
+}
+
+// reserveAttempt records an attempt for auth type as failed before it's made,
+// or returns ErrThrottled if an attempt isn't allowed yet.
+// The check and the record are in one transaction, so concurrent attempts
+// can't skip the delay. A successful attempt clears it (see ResetThrottle).
+func (d *DB) reserveAttempt(typ Type) error {
+	return syncer.Transact(d.db, func(tx *sqlx.Tx) error {
+		var th throttle
+		if err := tx.Get(&th, "SELECT * FROM throttle WHERE type = $1", typ); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		} else {
+			next := d.throttlePolicy.next(th.Failures, tsutil.ParseMillis(th.Last))
+			if next.IsZero() || d.clock.Now().Before(next) {
+				return ErrThrottled{Failures: th.Failures, Next: next}
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO throttle (type, failures, ts) VALUES ($1, 1, $2)
+			ON CONFLICT(type) DO UPDATE SET failures = failures + 1, ts = $2`, typ, tsutil.Millis(d.clock.Now())); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// ResetThrottle clears failed attempts for auth type.
+// This happens automatically after a successful attempt.
+func (d *DB) ResetThrottle(typ Type) error {
+	if _, err := d.db.Exec("DELETE FROM throttle WHERE type = $1", typ); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package auth_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.t
+}
+
+func (c *testClock) NowMillis() int64 {
+	return tsutil.Millis(c.t)
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func requireThrottled(t *testing.T, err error, failures int, next time.Time) {
+	var te auth.ErrThrottled
+	require.True(t, errors.As(err, &te), "expected throttled, got %v", err)
+	require.Equal(t, failures, te.Failures)
+	require.Equal(t, tsutil.Millis(next), tsutil.Millis(te.Next))
+}
+
+func TestThrottle(t *testing.T) {
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	clock := &testClock{t: tsutil.ParseMillis(int64(1234567890000))}
+	policy := auth.ThrottlePolicy{
+		Free:     2,
+		Delay:    time.Second,
+		MaxDelay: 4 * time.Second,
+	}
+	db, err := auth.NewDB(path, auth.WithThrottle(policy), auth.WithClock(clock))
+	require.NoError(t, err)
+
+	mk := testutil.Seed(0x01)
+	_, err = db.RegisterPassword("testpassword", mk)
+	require.NoError(t, err)
+
+	// Free attempts
+	for i := 0; i < 2; i++ {
+		_, _, err = db.Password("invalidpassword")
+		require.Equal(t, auth.ErrInvalidAuth, err)
+	}
+	// Delayed attempts (1s, 2s, ...)
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	_, _, err = db.Password("testpassword")
+	requireThrottled(t, err, 3, clock.Now().Add(time.Second))
+	clock.add(time.Second)
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	_, _, err = db.Password("testpassword")
+	requireThrottled(t, err, 4, clock.Now().Add(2*time.Second))
+
+	// Survives restart
+	require.NoError(t, db.Close())
+	db, err = auth.NewDB(path, auth.WithThrottle(policy), auth.WithClock(clock))
+	require.NoError(t, err)
+	defer db.Close()
+	_, _, err = db.Password("testpassword")
+	requireThrottled(t, err, 4, clock.Now().Add(2*time.Second))
+	clock.add(2 * time.Second)
+
+	// Max delay
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	clock.add(4 * time.Second)
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	_, _, err = db.Password("testpassword")
+	requireThrottled(t, err, 6, clock.Now().Add(4*time.Second))
+	clock.add(4 * time.Second)
+
+	// Paper key is throttled separately
+	_, _, err = db.PaperKey("invalid paper key")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+
+	// Success resets
+	_, mko, err := db.Password("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+}
+
+func TestThrottleLockout(t *testing.T) {
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	clock := &testClock{t: tsutil.ParseMillis(int64(1234567890000))}
+	policy := auth.ThrottlePolicy{
+		Free:    3,
+		Lockout: 3,
+	}
+	db, err := auth.NewDB(path, auth.WithThrottle(policy), auth.WithClock(clock))
+	require.NoError(t, err)
+	defer db.Close()
+
+	mk := testutil.Seed(0x01)
+	_, err = db.RegisterPassword("testpassword", mk)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, _, err = db.Password("invalidpassword")
+		require.Equal(t, auth.ErrInvalidAuth, err)
+	}
+	clock.add(24 * time.Hour)
+	_, _, err = db.Password("testpassword")
+	requireThrottled(t, err, 3, time.Time{})
+	require.EqualError(t, err, "too many failed attempts (3), locked out")
+
+	err = db.ResetThrottle(api.PasswordType)
+	require.NoError(t, err)
+	_, mko, err := db.Password("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+}
+
+func TestThrottleShamir(t *testing.T) {
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	clock := &testClock{t: tsutil.ParseMillis(int64(1234567890000))}
+	policy := auth.ThrottlePolicy{
+		Free:    2,
+		Lockout: 2,
+	}
+	db, err := auth.NewDB(path, auth.WithThrottle(policy), auth.WithClock(clock))
+	require.NoError(t, err)
+	defer db.Close()
+
+	mk := testutil.Seed(0x01)
+	_, shares, err := db.RegisterShamir(mk, 3, 2)
+	require.NoError(t, err)
+
+	// Invalid shares are failed attempts
+	_, _, err = db.Shamir([]string{"invalid", shares[1]})
+	require.EqualError(t, err, "invalid share")
+	_, _, err = db.Shamir(shares[:1])
+	require.EqualError(t, err, "not enough shares")
+	_, _, err = db.Shamir(shares[:2])
+	requireThrottled(t, err, 2, time.Time{})
+
+	err = db.ResetThrottle(api.ShamirType)
+	require.NoError(t, err)
+	_, mko, err := db.Shamir(shares[:2])
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+}
+
+func TestThrottleConcurrent(t *testing.T) {
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	clock := &testClock{t: tsutil.ParseMillis(int64(1234567890000))}
+	policy := auth.ThrottlePolicy{
+		Free:  0,
+		Delay: time.Hour,
+	}
+	db, err := auth.NewDB(path, auth.WithThrottle(policy), auth.WithClock(clock))
+	require.NoError(t, err)
+	defer db.Close()
+
+	mk := testutil.Seed(0x01)
+	_, err = db.RegisterPassword("testpassword", mk)
+	require.NoError(t, err)
+
+	// Only one of the concurrent attempts is made, the others are throttled.
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := db.Password("invalidpassword")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	invalid := 0
+	for err := range errs {
+		if err == auth.ErrInvalidAuth {
+			invalid++
+			continue
+		}
+		var te auth.ErrThrottled
+		require.True(t, errors.As(err, &te), "expected throttled, got %v", err)
+	}
+	require.Equal(t, 1, invalid)
+}
+
+func TestThrottleDefaultMaxDelay(t *testing.T) {
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	clock := &testClock{t: tsutil.ParseMillis(int64(1234567890000))}
+	// MaxDelay 0 is the default max delay (delay is still doubled)
+	policy := auth.ThrottlePolicy{
+		Free:  0,
+		Delay: time.Second,
+	}
+	db, err := auth.NewDB(path, auth.WithThrottle(policy), auth.WithClock(clock))
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.RegisterPassword("testpassword", testutil.Seed(0x01))
+	require.NoError(t, err)
+
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	clock.add(time.Second)
+	_, _, err = db.Password("invalidpassword")
+	require.Equal(t, auth.ErrInvalidAuth, err)
+	_, _, err = db.Password("testpassword")
+	requireThrottled(t, err, 2, clock.Now().Add(2*time.Second))
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/encoding"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/pkg/errors"
+)
+
+// X25519IdentityEnv is the environment variable for an X25519 identity, see
+// X25519IdentityFromEnv.
+const X25519IdentityEnv = "VAULT_IDENTITY"
+
+// NewX25519 creates an auth for an X25519 recipient (public key ID, kbx...).
+// A random auth key is sealed (keys.CryptoBoxSeal) to the recipient and stored
+// as the salt, so the master key can be unlocked with the recipient's identity
+// (private key) and without any interaction.
+func NewX25519(recipient keys.ID, mk *[32]byte) (*Auth, error) {
+	pk, err := keys.NewX25519PublicKeyFromID(recipient)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid recipient")
+	}
+	id := encoding.MustEncode(keys.RandBytes(32), encoding.Base62)
+
+	key := keys.Rand32()
+	sealed := keys.CryptoBoxSeal(key[:], pk)
+	auth := &Auth{
+		ID:        id,
+		Type:      api.X25519Type,
+		Salt:      sealed,
+		CreatedAt: time.Now(),
+	}
+	wrapKey(auth, key, mk)
+	return auth, nil
+}
+
+// RegisterX25519 registers X25519 auth for a recipient.
+func (d *DB) RegisterX25519(recipient keys.ID, mk *[32]byte) (*Auth, error) {
+	if mk == nil {
+		return nil, errors.Errorf("nil master key")
+	}
+	auth, err := NewX25519(recipient, mk)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Set(auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// X25519 authenticates using an X25519 identity (see ReadX25519Identity and
+// X25519IdentityFromEnv).
+func (d *DB) X25519(identity *keys.X25519Key) (*Auth, *[32]byte, error) {
+	if identity == nil {
+		return nil, nil, errors.Errorf("no identity")
+	}
+	auths, err := d.ListByType(api.X25519Type)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to auth")
+	}
+	for _, auth := range auths {
+		b, err := keys.CryptoBoxSealOpen(auth.Salt, identity)
+		if err != nil || len(b) != 32 {
+			continue
+		}
+		if mk := d.unlock(auth, keys.Bytes32(b)); mk != nil {
+			return auth, mk, nil
+		}
+	}
+	return nil, nil, ErrInvalidAuth
+}
+
+// EncodeX25519Identity encodes an X25519 identity (private key), for an
+// identity file or X25519IdentityEnv.
+func EncodeX25519Identity(identity *keys.X25519Key) string {
+	return encoding.MustEncode(identity.PrivateKey()[:], encoding.Base62)
+}
+
+// DecodeX25519Identity decodes an X25519 identity (see EncodeX25519Identity).
+func DecodeX25519Identity(s string) (*keys.X25519Key, error) {
+	b, err := encoding.Decode(strings.TrimSpace(s), encoding.Base62)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid identity")
+	}
+	if len(b) != 32 {
+		return nil, errors.Errorf("invalid identity length %d", len(b))
+	}
+	return keys.NewX25519KeyFromPrivateKey(keys.Bytes32(b)), nil
+}
+
+// ReadX25519Identity reads an X25519 identity from a file.
+// Lines starting with # (comments) and empty lines are ignored.
+func ReadX25519Identity(path string) (*keys.X25519Key, error) {
+	b, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return DecodeX25519Identity(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.Errorf("no identity in %s", path)
+}
+
+// X25519IdentityFromEnv returns the X25519 identity from the environment
+// (X25519IdentityEnv), or nil if not set.
+func X25519IdentityFromEnv() (*keys.X25519Key, error) {
+	s := os.Getenv(X25519IdentityEnv)
+	if s == "" {
+		return nil, nil
+	}
+	return DecodeX25519Identity(s)
+}
@@ -0,0 +1,94 @@
+package auth_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/auth/api"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestX25519(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	mk := testutil.Seed(0x01)
+	identity := keys.GenerateX25519Key()
+
+	reg, err := db.RegisterX25519(identity.ID(), mk)
+	require.NoError(t, err)
+
+	auths, err := db.ListByType(api.X25519Type)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+
+	out, mko, err := db.X25519(identity)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+	require.Equal(t, reg.ID, out.ID)
+
+	_, _, err = db.X25519(keys.GenerateX25519Key())
+	require.EqualError(t, err, "invalid auth")
+
+	_, err = db.RegisterX25519(keys.GenerateEdX25519Key().ID(), mk)
+	require.Error(t, err)
+
+	// Identity file
+	idPath := testutil.Path()
+	defer func() { _ = os.Remove(idPath) }()
+	err = ioutil.WriteFile(idPath, []byte("# recipient: "+identity.ID().String()+"\n\n"+auth.EncodeX25519Identity(identity)+"\n"), 0600)
+	require.NoError(t, err)
+	fromFile, err := auth.ReadX25519Identity(idPath)
+	require.NoError(t, err)
+	_, mko, err = db.X25519(fromFile)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+
+	err = ioutil.WriteFile(idPath, []byte("# empty\n"), 0600)
+	require.NoError(t, err)
+	_, err = auth.ReadX25519Identity(idPath)
+	require.EqualError(t, err, "no identity in "+idPath)
+
+	// Environment
+	fromEnv, err := auth.X25519IdentityFromEnv()
+	require.NoError(t, err)
+	require.Nil(t, fromEnv)
+	os.Setenv(auth.X25519IdentityEnv, auth.EncodeX25519Identity(identity))
+	defer os.Unsetenv(auth.X25519IdentityEnv)
+	fromEnv, err = auth.X25519IdentityFromEnv()
+	require.NoError(t, err)
+	_, mko, err = db.X25519(fromEnv)
+	require.NoError(t, err)
+	require.Equal(t, mk, mko)
+}
+
+func TestX25519Rotate(t *testing.T) {
+	path := testutil.Path()
+	db, err := auth.NewDB(path)
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	mk := testutil.Seed(0x01)
+	identity := keys.GenerateX25519Key()
+	_, err = db.RegisterX25519(identity.ID(), mk)
+	require.NoError(t, err)
+
+	newMK := testutil.Seed(0x02)
+	err = db.StageRotation(mk, newMK)
+	require.NoError(t, err)
+	// The new master key isn't available with the old master key
+	_, err = db.PendingRotation(mk)
+	require.Equal(t, auth.ErrRotationPending, err)
+	err = db.CommitRotation()
+	require.NoError(t, err)
+
+	_, mko, err := db.X25519(identity)
+	require.NoError(t, err)
+	require.Equal(t, newMK, mko)
+}
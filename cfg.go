@@ -10,46 +10,56 @@ import (
 )
 
 type Config struct {
-	db *sqlx.DB
+	vault *Vault
 }
 
 func (v *Vault) Config() Config {
-	return Config{v.db}
+	return Config{v}
 }
 
 func (c Config) String(k string) (string, error) {
-	if c.db == nil {
-		return "", ErrLocked
+	conn, err := c.vault.use()
+	if err != nil {
+		return "", err
 	}
-	return getConfig(c.db, k)
+	defer conn.release()
+	return getConfig(conn.db, k)
 }
 
 func (c Config) SetString(k string, v string) error {
-	if c.db == nil {
-		return ErrLocked
+	conn, err := c.vault.useWrite()
+	if err != nil {
+		return err
 	}
-	return setConfig(c.db, k, v)
+	defer conn.release()
+	return setConfig(conn.db, k, v)
 }
 
 func (c Config) Bytes(k string) ([]byte, error) {
-	if c.db == nil {
-		return nil, ErrLocked
+	conn, err := c.vault.use()
+	if err != nil {
+		return nil, err
 	}
-	return getConfigBytes(c.db, k)
+	defer conn.release()
+	return getConfigBytes(conn.db, k)
 }
 
 func (c Config) SetBytes(k string, v []byte) error {
-	if c.db == nil {
-		return ErrLocked
+	conn, err := c.vault.useWrite()
+	if err != nil {
+		return err
 	}
-	return setConfigBytes(c.db, k, v)
+	defer conn.release()
+	return setConfigBytes(conn.db, k, v)
 }
 
 func (c Config) Set(k string, v string) error {
-	if c.db == nil {
-		return ErrLocked
+	conn, err := c.vault.useWrite()
+	if err != nil {
+		return err
 	}
-	return setConfig(c.db, k, v)
+	defer conn.release()
+	return setConfig(conn.db, k, v)
 }
 
 func (c Config) KID(k string) (keys.ID, error) {
@@ -68,10 +78,12 @@ func (c Config) KID(k string) (keys.ID, error) {
 }
 
 func (c Config) SetKID(k string, v keys.ID) error {
-	if c.db == nil {
-		return ErrLocked
+	conn, err := c.vault.useWrite()
+	if err != nil {
+		return err
 	}
-	return setConfig(c.db, k, string(v))
+	defer conn.release()
+	return setConfig(conn.db, k, string(v))
 }
 
 func setConfig(db *sqlx.DB, key string, value string) error {
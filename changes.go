@@ -21,24 +21,32 @@ type Change struct {
 // If the keyring isn't synced this may not return all changes for those keyring
 // keys, so you should usually sync the keyring first.
 func (v *Vault) Changes(ctx context.Context) ([]*Change, error) {
-	vaults, err := getVaults(v.db)
+	c, err := v.use()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	vaults, err := getVaults(c.db)
 	if err != nil {
 		return nil, err
 	}
 	logger.Debugf("Changes for %d vaults", len(vaults))
-	status, err := v.client.Status(ctx, vaults)
+	status, err := v.remote.Status(ctx, vaults)
 	if err != nil {
 		return nil, err
 	}
 	for _, st := range status {
 		logger.Debugf("Status: %s %d", st.ID, st.Index)
 	}
-	pullIndexes, err := syncer.PullIndexes(v.db)
+	pullIndexes, err := syncer.PullIndexes(c.db)
 	if err != nil {
 		return nil, err
 	}
 
-	pushIndexes, err := syncer.PushIndexes(v.db)
+	pushIndexes, err := syncer.PushIndexes(c.db)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +46,7 @@ func TestChanges(t *testing.T) {
 	t.Logf("Client #2")
 	v2, closeFn2 := testutil.NewTestVaultWithSetup(t, env, "testpassword2", ck)
 	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
 
 	err = v2.Keyring().Sync(context.TODO())
 	require.NoError(t, err)
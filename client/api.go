@@ -3,6 +3,7 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
@@ -11,7 +12,6 @@ import (
 	"github.com/keys-pub/keys"
 	"github.com/keys-pub/keys/api"
 	"github.com/keys-pub/keys/dstore"
-	"github.com/keys-pub/keys/dstore/events"
 	"github.com/keys-pub/keys/http/client"
 	"github.com/keys-pub/keys/tsutil"
 	"github.com/pkg/errors"
@@ -20,12 +20,31 @@ import (
 
 // Event pulled from remote.
 type Event struct {
+	// ID is the (client generated) event ID, see PushEvent.
+	// Empty if the remote doesn't support event IDs.
+	ID              string    `db:"id"`
 	VID             keys.ID   `db:"vid"`
 	Data            []byte    `db:"data"`
 	RemoteIndex     int64     `db:"ridx"`
 	RemoteTimestamp time.Time `db:"rts"`
 }
 
+// PushEvent is an event to push to the remote.
+// The ID is generated by the client and is stable across retries, so the
+// remote can ignore events it already has.
+type PushEvent struct {
+	ID   string `json:"id" msgpack:"id"`
+	Data []byte `json:"data" msgpack:"dat"`
+}
+
+// Snapshot is an (encrypted) snapshot of a vault, covering events up to and
+// including Index.
+type Snapshot struct {
+	Index     int64  `json:"idx" msgpack:"idx" db:"idx"`
+	Data      []byte `json:"data" msgpack:"dat" db:"data"`
+	Timestamp int64  `json:"ts,omitempty" msgpack:"ts,omitempty" db:"ts"`
+}
+
 // Events ...
 type Events struct {
 	Events    []*Event
@@ -68,9 +87,9 @@ func (c *Client) Events(ctx context.Context, key *keys.EdX25519Key, index int64)
 	}
 
 	var out struct {
-		Vault     []*events.Event `json:"vault" msgpack:"vault"`
-		Index     int64           `json:"idx" msgpack:"idx"`
-		Truncated bool            `json:"truncated,omitempty" msgpack:"trunc,omitempty"`
+		Vault     []*RemoteEvent `json:"vault" msgpack:"vault"`
+		Index     int64          `json:"idx" msgpack:"idx"`
+		Truncated bool           `json:"truncated,omitempty" msgpack:"trunc,omitempty"`
 	}
 	if err := msgpack.Unmarshal(resp.Data, &out); err != nil {
 		return nil, err
@@ -80,6 +99,7 @@ func (c *Client) Events(ctx context.Context, key *keys.EdX25519Key, index int64)
 	events := []*Event{}
 	for _, e := range out.Vault {
 		event := &Event{
+			ID:              e.ID,
 			Data:            e.Data,
 			RemoteIndex:     e.Index,
 			RemoteTimestamp: tsutil.ParseMillis(e.Timestamp),
@@ -95,14 +115,61 @@ func (c *Client) Events(ctx context.Context, key *keys.EdX25519Key, index int64)
 	}, nil
 }
 
+// RemoteEvent is an event as returned from the vault API.
+type RemoteEvent struct {
+	ID        string `json:"id,omitempty" msgpack:"id,omitempty"`
+	Data      []byte `json:"data" msgpack:"dat"`
+	Index     int64  `json:"idx" msgpack:"idx"`
+	Timestamp int64  `json:"ts" msgpack:"ts"`
+}
+
 // Post events to the vault API with a key.
-func (c *Client) Post(ctx context.Context, key *keys.EdX25519Key, data [][]byte) error {
+// Events with an ID the vault already has are ignored.
+//
+// Events are posted as msgpack [][]byte (without IDs) if none have an ID, or
+// if the remote failed events with IDs before (older remotes only accept
+// [][]byte), in which case retried events may be duplicated.
+// If posting events with IDs fails (an HTTP error or a response that isn't
+// one), they are posted without IDs, and if that works, later posts are too.
+func (c *Client) Post(ctx context.Context, key *keys.EdX25519Key, events []*PushEvent) error {
 	if key == nil {
 		return errors.Errorf("no api key")
 	}
+	if !hasIDs(events) || c.isLegacyPost() {
+		return c.post(ctx, key, legacyEvents(events))
+	}
+	err := c.post(ctx, key, events)
+	if err == nil || !isPostFailure(err) {
+		return err
+	}
+	// The remote may not decode events with IDs (older remotes may fail with
+	// 400, 500 or an invalid response).
+	if lerr := c.post(ctx, key, legacyEvents(events)); lerr != nil {
+		return err
+	}
+	logger.Infof("Remote doesn't accept events with IDs, posting without IDs")
+	c.setLegacyPost()
+	return nil
+}
+
+// isPostFailure returns true if a post failed in a way an older remote that
+// doesn't accept events with IDs might fail (any HTTP error status or other
+// error), and not because the request was cancelled.
+func isPostFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var herr client.Error
+	if errors.As(err, &herr) {
+		return herr.StatusCode >= http.StatusBadRequest
+	}
+	return true
+}
+
+func (c *Client) post(ctx context.Context, key *keys.EdX25519Key, body interface{}) error {
 	path := dstore.Path("vault", key.ID(), "events")
 
-	b, err := msgpack.Marshal(data)
+	b, err := msgpack.Marshal(body)
 	if err != nil {
 		return err
 	}
@@ -126,6 +193,73 @@ func (c *Client) Post(ctx context.Context, key *keys.EdX25519Key, data [][]byte)
 	return nil
 }
 
+func (c *Client) isLegacyPost() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.legacyPost
+}
+
+func (c *Client) setLegacyPost() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.legacyPost = true
+}
+
+func hasIDs(events []*PushEvent) bool {
+	for _, event := range events {
+		if event.ID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyEvents returns events in the format without IDs.
+func legacyEvents(events []*PushEvent) [][]byte {
+	data := make([][]byte, 0, len(events))
+	for _, event := range events {
+		data = append(data, event.Data)
+	}
+	return data
+}
+
+// PutSnapshot stores a vault snapshot.
+func (c *Client) PutSnapshot(ctx context.Context, key *keys.EdX25519Key, snapshot *Snapshot) error {
+	if key == nil {
+		return errors.Errorf("no api key")
+	}
+	path := dstore.Path("vault", key.ID(), "snapshot")
+	b, err := msgpack.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Request(ctx, &client.Request{Method: "PUT", Path: path, Body: b, Key: key}); err != nil {
+		return errors.Wrapf(err, "failed to put snapshot")
+	}
+	return nil
+}
+
+// Snapshot returns the latest vault snapshot.
+// Returns nil if not found.
+func (c *Client) Snapshot(ctx context.Context, key *keys.EdX25519Key) (*Snapshot, error) {
+	if key == nil {
+		return nil, errors.Errorf("no api key")
+	}
+	path := dstore.Path("vault", key.ID(), "snapshot")
+	resp, err := c.Request(ctx, &client.Request{Method: "GET", Path: path, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	var snapshot Snapshot
+	if err := msgpack.Unmarshal(resp.Data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
 // Delete from vault API.
 func (c *Client) Delete(ctx context.Context, key *keys.EdX25519Key) error {
 	path := dstore.Path("vault", key.ID())
@@ -1,12 +1,18 @@
 package client
 
 import (
+	"sync"
+
 	hclient "github.com/keys-pub/keys/http/client"
 )
 
 // Client ...
 type Client struct {
 	*hclient.Client
+
+	// legacyPost is set if the remote doesn't accept events with IDs (see Post).
+	legacyPost bool
+	mtx        sync.Mutex
 }
 
 // New creates a Client for the a Web API.
@@ -15,5 +21,5 @@ func New(urs string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{cl}, nil
+	return &Client{Client: cl}, nil
 }
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+)
+
+// Remote stores and syncs vault events.
+// Client is the (hosted) HTTP implementation, see the remote package for other
+// implementations.
+type Remote interface {
+	// Register a vault.
+	Register(ctx context.Context, key *keys.EdX25519Key, account *keys.EdX25519Key) (*api.Key, error)
+	// Get a vault.
+	// Returns nil if not found.
+	Get(ctx context.Context, key *keys.EdX25519Key) (*Vault, error)
+	// Post events to a vault.
+	// Events with an ID the vault already has are ignored, so retrying a post
+	// whose response was lost doesn't add duplicates.
+	Post(ctx context.Context, key *keys.EdX25519Key, events []*PushEvent) error
+	// Events from a vault after index.
+	// If truncated, there are more results if you call again with the new index.
+	// Returns nil if not found.
+	Events(ctx context.Context, key *keys.EdX25519Key, index int64) (*Events, error)
+	// Status for vaults.
+	Status(ctx context.Context, vlts []*Vault) ([]*RemoteStatus, error)
+	// Delete a vault.
+	Delete(ctx context.Context, key *keys.EdX25519Key) error
+}
+
+var _ Remote = &Client{}
+
+// Snapshots is implemented by remotes that store vault snapshots, so new
+// devices can start from the latest snapshot instead of pulling every event.
+type Snapshots interface {
+	// PutSnapshot stores a snapshot of the vault at snapshot.Index, replacing
+	// an older snapshot.
+	PutSnapshot(ctx context.Context, key *keys.EdX25519Key, snapshot *Snapshot) error
+	// Snapshot returns the latest snapshot.
+	// Returns nil if there is no snapshot.
+	Snapshot(ctx context.Context, key *keys.EdX25519Key) (*Snapshot, error)
+}
+
+var _ Snapshots = &Client{}
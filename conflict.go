@@ -0,0 +1,367 @@
+package vault
+
+import (
+	"bytes"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Conflict is a key that was edited concurrently on different devices.
+type Conflict struct {
+	ID keys.ID
+	// Local key (Deleted if removed locally).
+	Local *api.Key
+	// Remote key (Deleted if removed remotely).
+	Remote *api.Key
+	// Timestamp when the conflict was detected.
+	Timestamp time.Time
+}
+
+// Resolver resolves a conflict, returning the key to keep (or a Deleted key
+// to remove it).
+// If it returns nil, the local key is kept and the conflict is unresolved (see
+// Keyring.Conflicts).
+//
+// Each device resolves the conflict on its own, so resolvers should be
+// deterministic and return the same result if local and remote are swapped,
+// otherwise the devices will disagree.
+type Resolver func(c *Conflict) (*api.Key, error)
+
+// ResolveLastWriterWins keeps the key with the later UpdatedAt.
+// This is the default Resolver.
+func ResolveLastWriterWins(c *Conflict) (*api.Key, error) {
+	return later(c.Local, c.Remote), nil
+}
+
+// ResolveMerge merges labels and keeps the other fields from the key with the
+// later UpdatedAt (or the notes from the other key if the later key has no
+// notes).
+// If a key was removed on one device and edited on another, the edited key is
+// kept.
+func ResolveMerge(c *Conflict) (*api.Key, error) {
+	if c.Local.Deleted {
+		return c.Remote, nil
+	}
+	if c.Remote.Deleted {
+		return c.Local, nil
+	}
+	winner, other := c.Local, c.Remote
+	if later(c.Local, c.Remote) == c.Remote {
+		winner, other = c.Remote, c.Local
+	}
+	out := *winner
+	out.Labels = mergeLabels(winner.Labels, other.Labels)
+	if out.Notes == "" {
+		out.Notes = other.Notes
+	}
+	return &out, nil
+}
+
+// ResolveKeepBoth keeps the local key and the remote key as a conflict copy,
+// to be resolved by the user (see Keyring.Conflicts).
+func ResolveKeepBoth(c *Conflict) (*api.Key, error) {
+	return nil, nil
+}
+
+// later returns the key with the later UpdatedAt.
+// If equal, the key with the greater (msgpack) encoding is returned, so the
+// result is the same on every device.
+func later(a *api.Key, b *api.Key) *api.Key {
+	if a.UpdatedAt != b.UpdatedAt {
+		if a.UpdatedAt > b.UpdatedAt {
+			return a
+		}
+		return b
+	}
+	ab, _ := msgpack.Marshal(a)
+	bb, _ := msgpack.Marshal(b)
+	if bytes.Compare(ab, bb) >= 0 {
+		return a
+	}
+	return b
+}
+
+func mergeLabels(a api.Labels, b api.Labels) api.Labels {
+	m := map[string]bool{}
+	out := api.Labels{}
+	for _, l := range append(append([]string{}, a...), b...) {
+		if m[l] {
+			continue
+		}
+		m[l] = true
+		out = append(out, l)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Conflicts returns unresolved conflicts.
+// Set or Remove the key to resolve the conflict.
+// Requires Unlock.
+func (k *Keyring) Conflicts() ([]*Conflict, error) {
+	c, err := k.vault.use()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	var rows []*conflictRow
+	if err := c.db.Select(&rows, "SELECT * FROM conflicts ORDER BY id"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out := make([]*Conflict, 0, len(rows))
+	for _, r := range rows {
+		conflict := &Conflict{ID: r.ID, Timestamp: tsutil.ParseMillis(r.Timestamp)}
+		if err := msgpack.Unmarshal(r.Local, &conflict.Local); err != nil {
+			return nil, err
+		}
+		if err := msgpack.Unmarshal(r.Remote, &conflict.Remote); err != nil {
+			return nil, err
+		}
+		out = append(out, conflict)
+	}
+	return out, nil
+}
+
+type conflictRow struct {
+	ID        keys.ID `db:"id"`
+	Local     []byte  `db:"local"`
+	Remote    []byte  `db:"remote"`
+	Timestamp int64   `db:"ts"`
+}
+
+func setConflictTx(tx *sqlx.Tx, c *Conflict) error {
+	local, err := msgpack.Marshal(c.Local)
+	if err != nil {
+		return err
+	}
+	remote, err := msgpack.Marshal(c.Remote)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO conflicts (id, local, remote, ts) VALUES ($1, $2, $3, $4)",
+		c.ID, local, remote, tsutil.Millis(c.Timestamp)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func clearConflictTx(tx *sqlx.Tx, kid keys.ID) error {
+	if _, err := tx.Exec("DELETE FROM conflicts WHERE id = $1", kid); err != nil {
+		return err
+	}
+	return nil
+}
+
+// version is a version vector for a key, the number of edits from each device.
+type version map[keys.ID]int64
+
+type versionOrder int
+
+const (
+	versionEqual versionOrder = iota
+	versionBefore
+	versionAfter
+	versionConcurrent
+)
+
+// compare returns if v is equal, before, after or concurrent to o.
+func (v version) compare(o version) versionOrder {
+	lt, gt := false, false
+	for id, n := range v {
+		if n > o[id] {
+			gt = true
+		} else if n < o[id] {
+			lt = true
+		}
+	}
+	for id, n := range o {
+		if _, ok := v[id]; !ok && n > 0 {
+			lt = true
+		}
+	}
+	switch {
+	case lt && gt:
+		return versionConcurrent
+	case lt:
+		return versionBefore
+	case gt:
+		return versionAfter
+	default:
+		return versionEqual
+	}
+}
+
+// merge returns the max of each device in v and o.
+func (v version) merge(o version) version {
+	out := version{}
+	for id, n := range v {
+		out[id] = n
+	}
+	for id, n := range o {
+		if n > out[id] {
+			out[id] = n
+		}
+	}
+	return out
+}
+
+// increment returns a copy of v with the count for device incremented.
+func (v version) increment(device keys.ID) version {
+	out := v.merge(nil)
+	out[device]++
+	return out
+}
+
+func getVersionTx(tx *sqlx.Tx, kid keys.ID) (version, error) {
+	var b []byte
+	if err := tx.Get(&b, "SELECT vv FROM versions WHERE id = $1", kid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return version{}, nil
+		}
+		return nil, err
+	}
+	var vv version
+	if err := msgpack.Unmarshal(b, &vv); err != nil {
+		return nil, err
+	}
+	if vv == nil {
+		vv = version{}
+	}
+	return vv, nil
+}
+
+func setVersionTx(tx *sqlx.Tx, kid keys.ID, vv version) error {
+	b, err := msgpack.Marshal(vv)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO versions (id, vv) VALUES ($1, $2)", kid, b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// keyEvent is the keyring event payload.
+// Events from earlier versions are an api.Key (without version).
+type keyEvent struct {
+	Key     *api.Key `msgpack:"k"`
+	Version version  `msgpack:"vv"`
+}
+
+func decodeKeyEvent(b []byte) (*keyEvent, error) {
+	var ke keyEvent
+	if err := msgpack.Unmarshal(b, &ke); err == nil && ke.Key != nil {
+		return &ke, nil
+	}
+	var key api.Key
+	if err := msgpack.Unmarshal(b, &key); err != nil {
+		return nil, err
+	}
+	return &keyEvent{Key: &key}, nil
+}
+
+// applyTx applies a key event from the remote, resolving conflicts with local
+// edits.
+func (k *Keyring) applyTx(tx *sqlx.Tx, ke *keyEvent) error {
+	key := ke.Key
+	if ke.Version == nil {
+		// Earlier versions, apply in order.
+		return applyKeyTx(tx, key)
+	}
+
+	lv, err := getVersionTx(tx, key.ID)
+	if err != nil {
+		return err
+	}
+	switch lv.compare(ke.Version) {
+	case versionEqual, versionAfter:
+		logger.Debugf("Skipping key %s (already have version)", key.ID)
+		return nil
+	case versionBefore:
+		if err := applyKeyTx(tx, key); err != nil {
+			return err
+		}
+		if err := clearConflictTx(tx, key.ID); err != nil {
+			return err
+		}
+		return setVersionTx(tx, key.ID, ke.Version)
+	}
+
+	local, err := getKeyTx(tx, key.ID)
+	if err != nil {
+		return err
+	}
+	if local == nil {
+		local = &api.Key{ID: key.ID, Deleted: true}
+	}
+	merged := lv.merge(ke.Version)
+	if local.Deleted && key.Deleted {
+		return setVersionTx(tx, key.ID, merged)
+	}
+
+	c := &Conflict{ID: key.ID, Local: local, Remote: key, Timestamp: k.vault.clock.Now()}
+	logger.Infof("Conflict for key %s", key.ID)
+	resolved, err := k.vault.resolver(c)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve conflict")
+	}
+	if resolved == nil {
+		if err := setConflictTx(tx, c); err != nil {
+			return err
+		}
+	} else {
+		if resolved.ID != key.ID {
+			return errors.Errorf("failed to resolve conflict: invalid key id")
+		}
+		if err := applyKeyTx(tx, resolved); err != nil {
+			return err
+		}
+		if err := clearConflictTx(tx, key.ID); err != nil {
+			return err
+		}
+	}
+	return setVersionTx(tx, key.ID, merged)
+}
+
+func applyKeyTx(tx *sqlx.Tx, key *api.Key) error {
+	if key.Deleted {
+		return deleteKeyTx(tx, key.ID)
+	}
+	return updateKeyTx(tx, key)
+}
+
+// addKeyEventTx increments the version for the key and adds the key event to
+// push.
+func addKeyEventTx(tx *sqlx.Tx, ck *api.Key, dk *keys.EdX25519Key, key *api.Key) error {
+	lv, err := getVersionTx(tx, key.ID)
+	if err != nil {
+		return err
+	}
+	vv := lv.increment(dk.ID())
+	b, err := msgpack.Marshal(&keyEvent{Key: key, Version: vv})
+	if err != nil {
+		return err
+	}
+	if err := syncer.AddTx(tx, ck.AsEdX25519(), b, syncer.SignedCipher{Sender: dk}); err != nil {
+		return err
+	}
+	if err := clearConflictTx(tx, key.ID); err != nil {
+		return err
+	}
+	return setVersionTx(tx, key.ID, vv)
+}
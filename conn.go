@@ -0,0 +1,149 @@
+package vault
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/vault/auth"
+)
+
+// conn is an open vault database.
+// Operations using the database hold a reference (see Vault.use), so Lock can
+// wait for them before closing it.
+type conn struct {
+	db *sqlx.DB
+	// mkID identifies the master key (see auth.MasterKeyID).
+	mkID     []byte
+	lock     *fileLock
+	readOnly bool
+	refs     sync.WaitGroup
+
+	// ctx is cancelled when locking, to stop syncs.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newConn(db *sqlx.DB, mk *[32]byte, lock *fileLock, readOnly bool) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{db: db, mkID: auth.MasterKeyID(mk), lock: lock, readOnly: readOnly, ctx: ctx, cancel: cancel}
+}
+
+// release a reference from Vault.use.
+func (c *conn) release() {
+	c.refs.Done()
+}
+
+// context returns a context that is also cancelled when locking.
+func (c *conn) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// use returns the open vault database, which isn't closed (by Lock) until
+// released.
+// Returns ErrLocked if locked, or being locked.
+// This resets the idle lock timer (see WithIdleLock).
+func (v *Vault) use() (*conn, error) {
+	v.mtx.Lock()
+	c := v.conn
+	if c != nil {
+		c.refs.Add(1)
+	}
+	v.mtx.Unlock()
+	if c == nil {
+		return nil, ErrLocked
+	}
+	v.touch()
+	return c, nil
+}
+
+// useWrite is like use, but returns ErrReadOnly if unlocked read-only (see
+// UnlockReadOnly).
+func (v *Vault) useWrite() (*conn, error) {
+	c, err := v.use()
+	if err != nil {
+		return nil, err
+	}
+	if c.readOnly {
+		c.release()
+		return nil, ErrReadOnly
+	}
+	return c, nil
+}
+
+// writable returns ErrLocked if locked, or ErrReadOnly if unlocked read-only.
+func (v *Vault) writable() error {
+	c := v.current()
+	if c == nil {
+		return ErrLocked
+	}
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// current returns the open vault database, or nil if locked.
+func (v *Vault) current() *conn {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.conn
+}
+
+func (v *Vault) setConn(db *sqlx.DB, mk *[32]byte, lock *fileLock, readOnly bool) {
+	v.mtx.Lock()
+	v.conn = newConn(db, mk, lock, readOnly)
+	v.mtx.Unlock()
+	v.startIdleTimer()
+	if v.auth != nil {
+		if err := v.auth.SetVaultKeyID(v.path, auth.MasterKeyID(mk)); err != nil {
+			logger.Warningf("Failed to record master key id: %v", err)
+		}
+	}
+}
+
+// closeConn closes the vault database, after cancelling syncs and waiting for
+// operations using it, and releases the file lock.
+// Operations that start after this fail with ErrLocked.
+// Returns false if already locked.
+// Requires umtx.
+func (v *Vault) closeConn() (bool, error) {
+	lock, err := v.closeDB()
+	if lock == nil {
+		return false, err
+	}
+	if rerr := lock.release(); rerr != nil && err == nil {
+		err = rerr
+	}
+	return true, err
+}
+
+// closeDB closes the vault database (see closeConn), returning the file lock,
+// which is still held.
+// Returns nil if already locked.
+// Requires umtx.
+func (v *Vault) closeDB() (*fileLock, error) {
+	v.mtx.Lock()
+	c := v.conn
+	v.conn = nil
+	v.mtx.Unlock()
+	if c == nil {
+		return nil, nil
+	}
+	v.stopIdleTimer()
+
+	c.cancel()
+	c.refs.Wait()
+	if err := c.db.Close(); err != nil {
+		return c.lock, err
+	}
+	return c.lock, nil
+}
@@ -0,0 +1,90 @@
+package vault_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockConcurrent(t *testing.T) {
+	ck := api.NewKey(keys.GenerateEdX25519Key())
+	vlt, closeFn := testutil.NewTestVaultWithRemote(t, remote.NewMem(), "testpassword", ck)
+	defer closeFn()
+
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		errs := make(chan error, 100)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if err := vlt.Keyring().Save(api.NewKey(keys.GenerateEdX25519Key())); err != nil {
+						errs <- err
+						return
+					}
+					if _, err := vlt.Keyring().Keys(); err != nil {
+						errs <- err
+						return
+					}
+					if _, err := vlt.Config().String("test"); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		err := vlt.Lock()
+		require.NoError(t, err)
+		wg.Wait()
+		close(errs)
+		// Operations either complete or fail with ErrLocked (never with a
+		// closed database).
+		for err := range errs {
+			require.Equal(t, vault.ErrLocked, err)
+		}
+
+		_, err = vlt.UnlockWithPassword("testpassword")
+		require.NoError(t, err)
+	}
+
+	err := vlt.Keyring().Sync(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestLockedAfterLock(t *testing.T) {
+	ck := api.NewKey(keys.GenerateEdX25519Key())
+	vlt, closeFn := testutil.NewTestVaultWithRemote(t, remote.NewMem(), "testpassword", ck)
+	defer closeFn()
+
+	cfg := vlt.Config()
+	err := cfg.Set("test", "value")
+	require.NoError(t, err)
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	_, err = cfg.String("test")
+	require.Equal(t, vault.ErrLocked, err)
+	_, err = vlt.Keyring().Keys()
+	require.Equal(t, vault.ErrLocked, err)
+	err = vlt.Keyring().Sync(context.TODO())
+	require.Equal(t, vault.ErrLocked, err)
+	_, err = vlt.ClientKey()
+	require.Equal(t, vault.ErrLocked, err)
+	_, err = vlt.DeviceKey()
+	require.Equal(t, vault.ErrLocked, err)
+
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	out, err := cfg.String("test")
+	require.NoError(t, err)
+	require.Equal(t, "value", out)
+}
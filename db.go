@@ -3,18 +3,20 @@ package vault
 import (
 	"encoding/hex"
 	"fmt"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/vault/migrate"
 	"github.com/keys-pub/vault/syncer"
 	"github.com/pkg/errors"
 
 	// For sqlite3 (sqlcipher driver)
-	_ "github.com/mutecomm/go-sqlcipher/v4"
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
 )
 
 func openDB(path string, mk *[32]byte) (*sqlx.DB, error) {
 	keyString := hex.EncodeToString(mk[:])
-	pragma := fmt.Sprintf("?_pragma_key=x'%s'&_pragma_cipher_page_size=4096", keyString)
+	pragma := fmt.Sprintf("?_pragma_key=x'%s'&_pragma_cipher_page_size=4096&%s", keyString, migrate.TxLock)
 
 	db, err := sqlx.Open("sqlite3", path+pragma)
 	if err != nil {
@@ -24,22 +26,125 @@ func openDB(path string, mk *[32]byte) (*sqlx.DB, error) {
 	return db, nil
 }
 
-func initTables(db *sqlx.DB) error {
-	logger.Debugf("Initializing tables...")
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS config (
-			key TEXT PRIMARY KEY NOT NULL,
-			value TEXT NOT NULL
-		);`,
-		// TODO: Indexes
+// isInvalidKey returns true if the error is from opening the database with
+// the wrong key (sqlcipher fails to decrypt it, so it's "not a database").
+func isInvalidKey(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && serr.Code == sqlite3.ErrNotADB
+}
+
+// openReadOnlyDB opens the vault database read-only (sqlite mode=ro).
+func openReadOnlyDB(path string, mk *[32]byte) (*sqlx.DB, error) {
+	keyString := hex.EncodeToString(mk[:])
+	pragma := fmt.Sprintf("?mode=ro&_pragma_key=x'%s'&_pragma_cipher_page_size=4096", keyString)
+
+	// The mode is a URI parameter, so the path is a (file:) URI.
+	db, err := sqlx.Open("sqlite3", "file:"+uriPathEscaper.Replace(path)+pragma)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open db")
+	}
+
+	version, err := migrate.Version(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
 	}
-	for _, stmt := range stmts {
-		if _, err := db.Exec(stmt); err != nil {
-			return err
-		}
+	// We can't migrate a read-only database.
+	if version < len(migrations) {
+		_ = db.Close()
+		return nil, errors.Errorf("vault database needs migration (unlock read-write first)")
 	}
-	if err := syncer.InitTables(db); err != nil {
+	if version > len(migrations) {
+		_ = db.Close()
+		return nil, errors.Errorf("database version %d is newer than supported version %d", version, len(migrations))
+	}
+	return db, nil
+}
+
+var uriPathEscaper = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+
+// rekeyDB changes the sqlcipher key from mk to newMK.
+func rekeyDB(path string, mk *[32]byte, newMK *[32]byte) error {
+	db, err := openDB(path, mk)
+	if err != nil {
 		return err
 	}
+	defer func() { _ = db.Close() }()
+	// Rekey applies to the connection, so make sure we only use one.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("SELECT count(*) FROM sqlite_master"); err != nil {
+		return errors.Wrapf(err, "failed to open db")
+	}
+	pragma := fmt.Sprintf(`PRAGMA rekey = "x'%s'"`, hex.EncodeToString(newMK[:])) // #nosec
+	if _, err := db.Exec(pragma); err != nil {
+		return errors.Wrapf(err, "failed to rekey db")
+	}
 	return nil
 }
+
+// migrations for the vault database, see migrate.Run.
+// Only add migrations to the end, and don't change existing migrations.
+var migrations = []migrate.Migration{
+	// 1: Initial tables
+	migrate.Steps(
+		migrate.Exec(
+			`CREATE TABLE IF NOT EXISTS config (
+				key TEXT PRIMARY KEY NOT NULL,
+				value TEXT NOT NULL
+			);`,
+			`CREATE TABLE IF NOT EXISTS keys (
+				id TEXT PRIMARY KEY NOT NULL,
+				type TEXT NOT NULL,
+				private BLOB,
+				public BLOB,
+				createdAt INTEGER,
+				updatedAt INTEGER,
+				notes TEXT,
+				labels TEXT,
+				ext JSON
+			);`,
+		),
+		syncer.CreateTables,
+	),
+	// 2: Rejected keyring events
+	migrate.Exec(
+		`CREATE TABLE IF NOT EXISTS rejected (
+			vid TEXT NOT NULL,
+			ridx INTEGER NOT NULL,
+			sender TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			PRIMARY KEY (vid, ridx)
+		);`,
+	),
+	// 3: Event IDs
+	syncer.AddEventIDs,
+	// 4: Key versions and conflicts
+	migrate.Exec(
+		`CREATE TABLE IF NOT EXISTS versions (
+			id TEXT PRIMARY KEY NOT NULL,
+			vv BLOB NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS conflicts (
+			id TEXT PRIMARY KEY NOT NULL,
+			local BLOB NOT NULL,
+			remote BLOB NOT NULL,
+			ts INTEGER NOT NULL
+		);`,
+	),
+	// 5: Snapshots
+	syncer.CreateCheckpoint,
+	// 6: Indexes
+	migrate.Steps(
+		syncer.CreateIndexes,
+		migrate.Exec(`CREATE INDEX IF NOT EXISTS keys_type ON keys (type);`),
+	),
+	// 7: Pruned event IDs
+	syncer.CreatePruned,
+}
+
+// initTables creates or migrates the vault database tables.
+func initTables(db *sqlx.DB) error {
+	logger.Debugf("Initializing tables...")
+	return migrate.Run(db, migrations)
+}
@@ -0,0 +1,251 @@
+package vault
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+)
+
+// DeviceLabel is the label for trusted device keys in the keyring.
+const DeviceLabel = "vault.device"
+
+// DeviceKey is the key for this device, used to sign keyring events.
+// It is created if it doesn't exist (or if read-only, returns ErrReadOnly).
+// Requires Unlock.
+func (v *Vault) DeviceKey() (*keys.EdX25519Key, error) {
+	c, err := v.use()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	if c.readOnly {
+		return readDeviceKey(c.db)
+	}
+	return deviceKey(c.db)
+}
+
+// readDeviceKey returns the device key without creating it.
+func readDeviceKey(db *sqlx.DB) (*keys.EdX25519Key, error) {
+	b, err := getConfigBytes(db, "deviceKey")
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, ErrReadOnly
+	}
+	if len(b) != 32 {
+		return nil, errors.Errorf("invalid device key")
+	}
+	return keys.NewEdX25519KeyFromSeed(keys.Bytes32(b)), nil
+}
+
+func deviceKey(db *sqlx.DB) (*keys.EdX25519Key, error) {
+	b, err := getConfigBytes(db, "deviceKey")
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		logger.Debugf("Generating device key...")
+		key := keys.GenerateEdX25519Key()
+		if err := setConfigBytes(db, "deviceKey", key.Seed()[:]); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if len(b) != 32 {
+		return nil, errors.Errorf("invalid device key")
+	}
+	return keys.NewEdX25519KeyFromSeed(keys.Bytes32(b)), nil
+}
+
+// TrustDevice adds a device key to the trusted device set.
+// Keyring events signed by trusted devices are applied, other events are
+// rejected (see Rejected). Events rejected because the device wasn't trusted
+// are applied when it is.
+// The trusted device set is synced, so other devices that trust this device
+// will also trust the added device.
+// Requires Unlock.
+func (k *Keyring) TrustDevice(kid keys.ID) error {
+	spk, err := keys.NewEdX25519PublicKeyFromID(kid)
+	if err != nil {
+		return err
+	}
+	return k.updateDevice(kid, func(key *api.Key) *api.Key {
+		if key == nil {
+			return api.NewKey(spk).WithLabels(DeviceLabel)
+		}
+		if key.HasLabel(DeviceLabel) {
+			return nil
+		}
+		return key.WithLabels(DeviceLabel)
+	})
+}
+
+// UntrustDevice removes a device key from the trusted device set.
+// The key stays in the keyring (without the device label), and events from
+// the device that were already applied are kept.
+// Requires Unlock.
+func (k *Keyring) UntrustDevice(kid keys.ID) error {
+	return k.updateDevice(kid, func(key *api.Key) *api.Key {
+		if key == nil || !key.HasLabel(DeviceLabel) {
+			return nil
+		}
+		labels := []string{}
+		for _, label := range key.Labels {
+			if label != DeviceLabel {
+				labels = append(labels, label)
+			}
+		}
+		key.Labels = labels
+		return key
+	})
+}
+
+// updateDevice updates the device key (if fn returns a key) and applies
+// rejected events from devices that are now trusted.
+func (k *Keyring) updateDevice(kid keys.ID, fn func(key *api.Key) *api.Key) error {
+	c, err := k.vault.useWrite()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	ck, err := k.check(c)
+	if err != nil {
+		return err
+	}
+	dk, err := deviceKey(c.db)
+	if err != nil {
+		return err
+	}
+	return syncer.Transact(c.db, func(tx *sqlx.Tx) error {
+		key, err := getKeyTx(tx, kid)
+		if err != nil {
+			return err
+		}
+		if key = fn(key); key != nil {
+			if err := addKeyEventTx(tx, ck, dk, key); err != nil {
+				return err
+			}
+			if err := updateKeyTx(tx, key); err != nil {
+				return err
+			}
+		}
+		return k.acceptTrustedTx(tx, ck, dk)
+	})
+}
+
+// Devices returns the trusted device keys.
+// This doesn't include the key for this device (see Vault.DeviceKey) unless
+// another device trusted it.
+// Requires Unlock.
+func (k *Keyring) Devices() ([]*api.Key, error) {
+	return k.KeysWithLabel(DeviceLabel)
+}
+
+// RejectedEvent is a keyring event that failed verification.
+type RejectedEvent struct {
+	VID         keys.ID `db:"vid"`
+	RemoteIndex int64   `db:"ridx"`
+	Sender      keys.ID `db:"sender"`
+	Reason      string  `db:"reason"`
+}
+
+// Rejected returns keyring events that were not applied because they failed
+// verification or weren't from a trusted device.
+// Requires Unlock.
+func (k *Keyring) Rejected() ([]*RejectedEvent, error) {
+	c, err := k.vault.use()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	var out []*RejectedEvent
+	if err := c.db.Select(&out, "SELECT * FROM rejected ORDER BY ridx"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func isTrustedTx(tx *sqlx.Tx, device *keys.EdX25519Key, sender keys.ID) (bool, error) {
+	if sender == device.ID() {
+		return true, nil
+	}
+	var count int
+	sqlLabel := "%^" + DeviceLabel + "$%"
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM keys WHERE id = $1 AND labels LIKE $2", sender, sqlLabel); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// acceptTrustedTx applies events that were rejected because the device wasn't
+// trusted, for devices that are trusted now.
+// Applying events can trust other devices, so this repeats until there are no
+// more events to apply.
+func (k *Keyring) acceptTrustedTx(tx *sqlx.Tx, ck *api.Key, dk *keys.EdX25519Key) error {
+	for {
+		var rejected []*RejectedEvent
+		if err := tx.Select(&rejected, "SELECT * FROM rejected WHERE vid = $1 AND reason = $2 ORDER BY ridx", ck.ID, untrustedDevice); err != nil {
+			return err
+		}
+		accepted := 0
+		for _, r := range rejected {
+			trusted, err := isTrustedTx(tx, dk, r.Sender)
+			if err != nil {
+				return err
+			}
+			if !trusted {
+				continue
+			}
+			event, err := syncer.PulledEventTx(tx, r.VID, r.RemoteIndex)
+			if err != nil {
+				return err
+			}
+			if event == nil {
+				logger.Warningf("Rejected event %s/%d is missing (pruned)", r.VID, r.RemoteIndex)
+				continue
+			}
+			accepted++
+			ke, sender, reason, err := openEventTx(tx, ck, dk, event)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				if err := rejectTx(tx, event, sender, reason); err != nil {
+					return err
+				}
+				continue
+			}
+			logger.Debugf("Accepting event %s/%d from %s", r.VID, r.RemoteIndex, r.Sender)
+			if err := k.applyTx(tx, ke); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM rejected WHERE vid = $1 AND ridx = $2", r.VID, r.RemoteIndex); err != nil {
+				return err
+			}
+		}
+		if accepted == 0 {
+			return nil
+		}
+	}
+}
+
+// untrustedDevice is the reason for events rejected because the device wasn't
+// trusted (see acceptTrustedTx).
+const untrustedDevice = "untrusted device"
+
+func rejectTx(tx *sqlx.Tx, event *Event, sender keys.ID, reason string) error {
+	logger.Warningf("Rejected event %s/%d from %q: %s", event.VID, event.RemoteIndex, sender, reason)
+	if _, err := tx.Exec("INSERT OR REPLACE INTO rejected (vid, ridx, sender, reason) VALUES ($1, $2, $3, $4)",
+		event.VID, event.RemoteIndex, sender, reason); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/keys-pub/vault/server"
+)
+
+func main() {
+	server.SetLogger(server.NewLogger(server.InfoLevel))
+
+	srv, err := server.New("/tmp/server.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Close()
+	srv.URL = "http://localhost:8080"
+
+	log.Printf("Listening on %s", srv.URL)
+	log.Fatal(http.ListenAndServe(":8080", srv))
+}
@@ -36,7 +36,7 @@ func (v *Vault) GenerateFIDO2HMACSecret(ctx context.Context, pin string, device
 	if v.fido2Plugin == nil {
 		return nil, errors.Errorf("no fido2 plugin set")
 	}
-	return auth.GenerateFIDO2HMACSecret(ctx, v.fido2Plugin, pin, device, appName)
+	return auth.GenerateFIDO2HMACSecret(ctx, v.fido2Plugin, pin, device, appName, v.fido2RP())
 }
 
 // SetupFIDO2HMACSecret sets up vault with a FIDO2 hmac-secret.
@@ -58,8 +58,8 @@ func (v *Vault) SetupFIDO2HMACSecret(ctx context.Context, hs *auth.FIDO2HMACSecr
 // RegisterFIDO2HMACSecret adds vault with a FIDO2 hmac-secret.
 // Requires recent Unlock.
 func (v *Vault) RegisterFIDO2HMACSecret(ctx context.Context, mk *[32]byte, hs *auth.FIDO2HMACSecret, pin string) (*auth.Auth, error) {
-	if v.db == nil {
-		return nil, ErrLocked
+	if err := v.writable(); err != nil {
+		return nil, err
 	}
 	if v.fido2Plugin == nil {
 		return nil, errors.Errorf("no fido2 plugin set")
@@ -77,8 +77,89 @@ func (v *Vault) UnlockWithFIDO2HMACSecret(ctx context.Context, pin string) (*[32
 	if err != nil {
 		return nil, err
 	}
-	if err := v.Unlock(mk); err != nil {
+	return v.unlock(mk)
+}
+
+// GenerateFIDO2ResidentKey creates a FIDO2 resident key (discoverable
+// credential) with hmac-secret on a device.
+// Requires a PIN.
+func (v *Vault) GenerateFIDO2ResidentKey(ctx context.Context, pin string, device string, appName string) (*auth.FIDO2HMACSecret, error) {
+	if v.fido2Plugin == nil {
+		return nil, errors.Errorf("no fido2 plugin set")
+	}
+	return auth.GenerateFIDO2ResidentKey(ctx, v.fido2Plugin, pin, device, appName, v.fido2RP())
+}
+
+// SetupFIDO2ResidentKey sets up vault with a FIDO2 resident key.
+// The master key is derived from the resident key, so the vault can be
+// unlocked on a new machine with only the vault database and the device (see
+// UnlockWithFIDO2ResidentKey).
+// A resident key can also be added to an existing vault with
+// RegisterFIDO2HMACSecret, but then it needs this auth database to unlock,
+// and behaves like any other hmac-secret auth (the master key can be
+// rotated).
+// The master key can't be rotated while the resident key it's derived from is
+// registered (see auth.ErrFIDO2ResidentKeyRotation).
+func (v *Vault) SetupFIDO2ResidentKey(ctx context.Context, hs *auth.FIDO2HMACSecret, pin string) (*[32]byte, error) {
+	if v.fido2Plugin == nil {
+		return nil, errors.Errorf("no fido2 plugin set")
+	}
+	_, mk, err := v.auth.SetupFIDO2ResidentKey(ctx, v.fido2Plugin, hs, pin)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Setup(mk); err != nil {
 		return nil, err
 	}
 	return mk, nil
 }
+
+// UnlockWithFIDO2ResidentKey opens vault with a FIDO2 resident key.
+// If the resident key isn't in the auth database, the master key derived from
+// the resident key is tried, and if it opens the vault, the resident key is
+// added to the auth database.
+func (v *Vault) UnlockWithFIDO2ResidentKey(ctx context.Context, pin string) (*[32]byte, error) {
+	_, mk, err := v.auth.FIDO2ResidentKey(ctx, v.fido2Plugin, pin, v.unlock)
+	if err != nil {
+		return nil, err
+	}
+	return v.unlock(mk)
+}
+
+// FIDO2ResidentKeys lists resident keys on a device.
+func (v *Vault) FIDO2ResidentKeys(ctx context.Context, device string, pin string) ([]*fido2.Credential, error) {
+	if v.fido2Plugin == nil {
+		return nil, errors.Errorf("no fido2 plugin set")
+	}
+	return auth.ListFIDO2ResidentKeys(ctx, v.fido2Plugin, device, pin, v.fido2RP())
+}
+
+// DeleteFIDO2ResidentKey deletes a resident key from a device (and its auth).
+// Returns auth.ErrFIDO2DeleteNotSupported if the FIDO2 plugin can't delete
+// resident keys.
+func (v *Vault) DeleteFIDO2ResidentKey(ctx context.Context, device string, pin string, credentialID []byte) error {
+	if v.fido2Plugin == nil {
+		return errors.Errorf("no fido2 plugin set")
+	}
+	return v.auth.DeleteFIDO2ResidentKey(ctx, v.fido2Plugin, device, pin, credentialID)
+}
+
+// MigrateFIDO2RelyingParty replaces FIDO2 credentials for other relying
+// parties with new credentials for the auth relying party (see
+// auth.WithRelyingParty).
+// Requires recent Unlock.
+func (v *Vault) MigrateFIDO2RelyingParty(ctx context.Context, mk *[32]byte, pin string, appName string) ([]*auth.Auth, error) {
+	if err := v.writable(); err != nil {
+		return nil, err
+	}
+	if v.fido2Plugin == nil {
+		return nil, errors.Errorf("no fido2 plugin set")
+	}
+	return v.auth.MigrateFIDO2RelyingParty(ctx, v.fido2Plugin, mk, pin, appName)
+}
+
+// fido2RP is the option for the auth relying party.
+func (v *Vault) fido2RP() auth.Option {
+	rp := v.auth.RelyingParty()
+	return auth.WithRelyingParty(rp.ID, rp.Name)
+}
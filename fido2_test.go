@@ -0,0 +1,125 @@
+package vault_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/auth/fido2test"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultFIDO2(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	fido2Plugin := fido2test.NewServer()
+	dev := fido2Plugin.AddDevice("Test Key")
+	dev.SetPIN("12345")
+	vlt.SetFIDO2Plugin(fido2Plugin)
+
+	devices, err := vlt.FIDO2Devices(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(devices))
+	require.Equal(t, dev.Path(), devices[0].Path)
+
+	hs, err := vlt.GenerateFIDO2HMACSecret(context.TODO(), "12345", dev.Path(), "test")
+	require.NoError(t, err)
+	mk, err := vlt.SetupFIDO2HMACSecret(context.TODO(), hs, "12345")
+	require.NoError(t, err)
+	require.Equal(t, vault.Unlocked, vlt.Status())
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	// Unplugged
+	dev.Unplug()
+	_, err = vlt.UnlockWithFIDO2HMACSecret(context.TODO(), "12345")
+	require.EqualError(t, err, "no devices found")
+	require.Equal(t, vault.Locked, vlt.Status())
+	dev.Plug()
+
+	// Invalid PIN
+	_, err = vlt.UnlockWithFIDO2HMACSecret(context.TODO(), "invalid")
+	require.Equal(t, fido2test.ErrPinInvalid, err)
+	require.Equal(t, vault.Locked, vlt.Status())
+
+	out, err := vlt.UnlockWithFIDO2HMACSecret(context.TODO(), "12345")
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+	require.Equal(t, vault.Unlocked, vlt.Status())
+}
+
+func TestVaultFIDO2ResidentKey(t *testing.T) {
+	var err error
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	defer func() { _ = os.Remove(path + ".lock") }()
+	authPath := testutil.Path()
+	defer func() { _ = os.Remove(authPath) }()
+	authDB, err := auth.NewDB(authPath)
+	require.NoError(t, err)
+	defer func() { _ = authDB.Close() }()
+	vlt, err := vault.New(path, authDB, vault.WithRemote(remote.NewMem()))
+	require.NoError(t, err)
+
+	pin := "12345"
+	fido2Plugin := fido2test.NewServer()
+	dev := fido2Plugin.AddDevice("Test Key")
+	dev.SetPIN(pin)
+	vlt.SetFIDO2Plugin(fido2Plugin)
+
+	hs, err := vlt.GenerateFIDO2ResidentKey(context.TODO(), pin, dev.Path(), "test")
+	require.NoError(t, err)
+	mk, err := vlt.SetupFIDO2ResidentKey(context.TODO(), hs, pin)
+	require.NoError(t, err)
+	err = vlt.SetClientKey(api.NewKey(keys.GenerateEdX25519Key()))
+	require.NoError(t, err)
+	err = vlt.Keyring().Set(api.NewKey(keys.GenerateEdX25519Key()))
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	out, err := vlt.UnlockWithFIDO2ResidentKey(context.TODO(), pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	// New machine with only the vault database (a new auth database)
+	authPath2 := testutil.Path()
+	defer func() { _ = os.Remove(authPath2) }()
+	authDB2, err := auth.NewDB(authPath2)
+	require.NoError(t, err)
+	defer func() { _ = authDB2.Close() }()
+	vlt2, err := vault.New(path, authDB2, vault.WithRemote(remote.NewMem()))
+	require.NoError(t, err)
+	vlt2.SetFIDO2Plugin(fido2Plugin)
+	require.Equal(t, vault.Locked, vlt2.Status())
+
+	out, err = vlt2.UnlockWithFIDO2ResidentKey(context.TODO(), pin)
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+	defer func() { _ = vlt2.Lock() }()
+	ks, err := vlt2.Keyring().Keys()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ks))
+
+	// List, delete
+	creds, err := vlt2.FIDO2ResidentKeys(context.TODO(), dev.Path(), pin)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(creds))
+	err = vlt2.DeleteFIDO2ResidentKey(context.TODO(), dev.Path(), pin, creds[0].ID)
+	require.NoError(t, err)
+	creds, err = vlt2.FIDO2ResidentKeys(context.TODO(), dev.Path(), pin)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(creds))
+}
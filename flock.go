@@ -0,0 +1,87 @@
+package vault
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInUse if the vault is unlocked by another process.
+type ErrInUse struct {
+	// PID of the process holding the lock, or 0 if unknown.
+	PID int
+}
+
+func (e ErrInUse) Error() string {
+	if e.PID == 0 {
+		return "vault is in use by another process"
+	}
+	return fmt.Sprintf("vault is in use by another process (pid %d)", e.PID)
+}
+
+// fileLock is an advisory lock on a file next to the vault database, held
+// while the vault is unlocked, so another process can't unlock (and sync) at
+// the same time.
+// A shared lock allows other shared locks (for read-only), an exclusive lock
+// doesn't allow any other lock.
+// The lock file contains the PID of the (last) holder.
+type fileLock struct {
+	path string
+	f    *os.File
+}
+
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// lockFile acquires the lock, or returns ErrInUse if it's held by another
+// process.
+func lockFile(path string, shared bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600) // #nosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock file")
+	}
+	ok, err := flock(f, shared)
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "failed to lock %s", path)
+	}
+	if !ok {
+		_ = f.Close()
+		return nil, ErrInUse{PID: lockPID(path)}
+	}
+	if err := f.Truncate(0); err != nil {
+		logger.Warningf("Failed to write lock file: %v", err)
+	} else if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		logger.Warningf("Failed to write lock file: %v", err)
+	}
+	return &fileLock{path: path, f: f}, nil
+}
+
+// release the lock.
+// The lock file isn't removed, since another process may be waiting to lock
+// it.
+func (l *fileLock) release() error {
+	if err := funlock(l.f); err != nil {
+		_ = l.f.Close()
+		return errors.Wrapf(err, "failed to unlock %s", l.path)
+	}
+	return l.f.Close()
+}
+
+// lockPID returns the PID in the lock file, or 0 if unknown.
+func lockPID(path string) int {
+	b, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,64 @@
+package vault_test
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLock(t *testing.T) {
+	var err error
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	defer func() { _ = os.Remove(path + ".lock") }()
+	authPath := testutil.Path()
+	defer func() { _ = os.Remove(authPath) }()
+	authDB, err := auth.NewDB(authPath)
+	require.NoError(t, err)
+	defer func() { _ = authDB.Close() }()
+
+	vlt, err := vault.New(path, authDB, vault.WithRemote(remote.NewMem()))
+	require.NoError(t, err)
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+
+	// Another process (a lock on a different file descriptor conflicts, even
+	// in the same process)
+	vlt2, err := vault.New(path, authDB, vault.WithRemote(remote.NewMem()))
+	require.NoError(t, err)
+	err = vlt2.Unlock(mk)
+	require.Equal(t, vault.ErrInUse{PID: os.Getpid()}, err)
+	require.EqualError(t, err, "vault is in use by another process (pid "+strconv.Itoa(os.Getpid())+")")
+	require.Equal(t, vault.Locked, vlt2.Status())
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+	err = vlt2.Unlock(mk)
+	require.NoError(t, err)
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.Equal(t, vault.ErrInUse{PID: os.Getpid()}, err)
+
+	// Rotation keeps the lock
+	_, err = vlt2.RotateMasterKey(mk)
+	require.NoError(t, err)
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.Equal(t, vault.ErrInUse{PID: os.Getpid()}, err)
+
+	err = vlt.Reset(context.TODO())
+	require.Equal(t, vault.ErrInUse{PID: os.Getpid()}, err)
+	require.Equal(t, vault.Unlocked, vlt2.Status())
+
+	err = vlt2.Lock()
+	require.NoError(t, err)
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+}
@@ -0,0 +1,32 @@
+package vault
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffset is where the locked byte is, past the PID, so other processes can
+// still read the PID (Windows locks are mandatory).
+const lockOffset = 1 << 31
+
+// flock locks the file, returning false if it's locked by another process.
+func flock(f *os.File, shared bool) (bool, error) {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if !shared {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := &windows.Overlapped{Offset: lockOffset}
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, ol); err != nil {
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func funlock(f *os.File) error {
+	ol := &windows.Overlapped{Offset: lockOffset}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, ol)
+}
@@ -0,0 +1,63 @@
+package vault
+
+import (
+	"time"
+)
+
+// startIdleTimer starts the idle lock timer (see WithIdleLock).
+func (v *Vault) startIdleTimer() {
+	if v.idleTimeout <= 0 {
+		return
+	}
+	v.smtx.Lock()
+	defer v.smtx.Unlock()
+	v.lastAccess = time.Now()
+	if v.idleTimer != nil {
+		v.idleTimer.Stop()
+	}
+	v.idleTimer = time.AfterFunc(v.idleTimeout, v.checkIdle)
+}
+
+// stopIdleTimer stops the idle lock timer.
+func (v *Vault) stopIdleTimer() {
+	v.smtx.Lock()
+	defer v.smtx.Unlock()
+	if v.idleTimer != nil {
+		v.idleTimer.Stop()
+		v.idleTimer = nil
+	}
+}
+
+// touch resets the idle lock timer.
+func (v *Vault) touch() {
+	if v.idleTimeout <= 0 {
+		return
+	}
+	v.smtx.Lock()
+	defer v.smtx.Unlock()
+	v.lastAccess = time.Now()
+}
+
+// checkIdle locks the vault if it wasn't accessed for the idle timeout,
+// otherwise checks again when it would be.
+// Instead of resetting the timer on each access, we only record the access
+// time.
+func (v *Vault) checkIdle() {
+	v.smtx.Lock()
+	if v.idleTimer == nil {
+		v.smtx.Unlock()
+		return
+	}
+	remaining := v.idleTimeout - time.Since(v.lastAccess)
+	if remaining > 0 {
+		v.idleTimer.Reset(remaining)
+		v.smtx.Unlock()
+		return
+	}
+	v.smtx.Unlock()
+
+	logger.Infof("Locking (idle for %s)...", v.idleTimeout)
+	if err := v.Lock(); err != nil {
+		logger.Warningf("Failed to lock: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package vault_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type statusRecorder struct {
+	mtx      sync.Mutex
+	statuses []vault.Status
+}
+
+func (r *statusRecorder) record(status vault.Status) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.statuses = append(r.statuses, status)
+}
+
+func (r *statusRecorder) get() []vault.Status {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]vault.Status{}, r.statuses...)
+}
+
+func TestIdleLock(t *testing.T) {
+	var err error
+	ck := api.NewKey(keys.GenerateEdX25519Key())
+	vlt, closeFn := testutil.NewTestVaultWithRemote(t, remote.NewMem(), "testpassword", ck, vault.WithIdleLock(200*time.Millisecond))
+	defer closeFn()
+
+	// Access keeps it unlocked
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err = vlt.Keyring().Keys()
+		require.NoError(t, err)
+	}
+	require.Equal(t, vault.Unlocked, vlt.Status())
+
+	time.Sleep(400 * time.Millisecond)
+	require.Equal(t, vault.Locked, vlt.Status())
+	_, err = vlt.Keyring().Keys()
+	require.Equal(t, vault.ErrLocked, err)
+
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, vault.Unlocked, vlt.Status())
+	time.Sleep(400 * time.Millisecond)
+	require.Equal(t, vault.Locked, vlt.Status())
+}
+
+func TestOnStatusChange(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	var rec statusRecorder
+	stop := vlt.OnStatusChange(rec.record)
+
+	_, err = vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+	// Already locked
+	err = vlt.Lock()
+	require.NoError(t, err)
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	// Already unlocked
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Reset(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, []vault.Status{vault.Unlocked, vault.Locked, vault.Unlocked, vault.Locked, vault.SetupNeeded}, rec.get())
+
+	stop()
+	_, err = vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, 5, len(rec.get()))
+}
@@ -3,6 +3,7 @@ package vault
 import (
 	"context"
 	"database/sql"
+	"strconv"
 	"sync"
 
 	"github.com/jmoiron/sqlx"
@@ -11,13 +12,11 @@ import (
 	"github.com/keys-pub/vault/client"
 	"github.com/keys-pub/vault/syncer"
 	"github.com/pkg/errors"
-	"github.com/vmihailenco/msgpack/v4"
 )
 
 // Keyring ...
 type Keyring struct {
 	vault *Vault
-	init  bool
 	smtx  sync.Mutex
 }
 
@@ -26,47 +25,9 @@ func NewKeyring(vault *Vault) *Keyring {
 	return &Keyring{vault: vault}
 }
 
-func (k *Keyring) initTables() error {
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS keys (
-			id TEXT PRIMARY KEY NOT NULL,
-			type TEXT NOT NULL,
-			private BLOB,
-			public BLOB,
-			createdAt INTEGER,
-			updatedAt INTEGER,
-			notes TEXT,
-			labels TEXT,
-			ext JSON
-		);`,
-		// TODO: Indexes
-	}
-	for _, stmt := range stmts {
-		if _, err := k.vault.DB().Exec(stmt); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (k *Keyring) initDB() error {
-	if k.vault.DB() == nil {
-		return ErrLocked
-	}
-	if !k.init {
-		if err := k.initTables(); err != nil {
-			return err
-		}
-		k.init = true
-	}
-	return nil
-}
-
-func (k *Keyring) check() (*api.Key, error) {
-	if err := k.initDB(); err != nil {
-		return nil, err
-	}
-	ck, err := k.vault.ClientKey()
+// check returns the client key.
+func (k *Keyring) check(c *conn) (*api.Key, error) {
+	ck, err := clientKey(c.db)
 	if err != nil {
 		return nil, err
 	}
@@ -77,19 +38,25 @@ func (k *Keyring) check() (*api.Key, error) {
 }
 
 // Set a key in the keyring.
+// This also resolves a conflict for the key (see Conflicts).
 // Requires Unlock.
 func (k *Keyring) Set(key *api.Key) error {
-	ck, err := k.check()
+	c, err := k.vault.useWrite()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	ck, err := k.check(c)
+	if err != nil {
+		return err
+	}
+	dk, err := deviceKey(c.db)
 	if err != nil {
 		return err
 	}
-	return syncer.Transact(k.vault.DB(), func(tx *sqlx.Tx) error {
+	return syncer.Transact(c.db, func(tx *sqlx.Tx) error {
 		logger.Debugf("Saving key %s", key.ID)
-		b, err := msgpack.Marshal(key)
-		if err != nil {
-			return err
-		}
-		if err := syncer.AddTx(tx, ck.AsEdX25519(), b, syncer.CryptoBoxSealCipher{}); err != nil {
+		if err := addKeyEventTx(tx, ck, dk, key); err != nil {
 			return err
 		}
 		if err := updateKeyTx(tx, key); err != nil {
@@ -106,6 +73,10 @@ func (k *Keyring) Save(key *api.Key) error {
 	}
 	go func() {
 		if err := k.Sync(context.Background()); err != nil {
+			if errors.Is(err, ErrLocked) || errors.Is(err, context.Canceled) {
+				logger.Debugf("Sync stopped (locked)")
+				return
+			}
 			logger.Warningf("Unable to sync: %v", err)
 		}
 	}()
@@ -113,20 +84,26 @@ func (k *Keyring) Save(key *api.Key) error {
 }
 
 // Remove a key.
+// This also resolves a conflict for the key (see Conflicts).
 // Requires Unlock.
 func (k *Keyring) Remove(kid keys.ID) error {
-	ck, err := k.check()
+	c, err := k.vault.useWrite()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	ck, err := k.check(c)
 	if err != nil {
 		return err
 	}
-	return syncer.Transact(k.vault.DB(), func(tx *sqlx.Tx) error {
-		key := api.NewKey(kid)
+	dk, err := deviceKey(c.db)
+	if err != nil {
+		return err
+	}
+	return syncer.Transact(c.db, func(tx *sqlx.Tx) error {
+		key := api.NewKey(kid).Updated(k.vault.clock.NowMillis())
 		key.Deleted = true
-		b, err := msgpack.Marshal(key)
-		if err != nil {
-			return err
-		}
-		if err := syncer.AddTx(tx, ck.AsEdX25519(), b, syncer.CryptoBoxSealCipher{}); err != nil {
+		if err := addKeyEventTx(tx, ck, dk, key); err != nil {
 			return err
 		}
 		return deleteKeyTx(tx, kid)
@@ -135,34 +112,42 @@ func (k *Keyring) Remove(kid keys.ID) error {
 
 // Keys in vault.
 func (k *Keyring) Keys() ([]*api.Key, error) {
-	if k.vault.DB() == nil {
-		return nil, ErrLocked
+	c, err := k.vault.use()
+	if err != nil {
+		return nil, err
 	}
-	return getKeys(k.vault.DB())
+	defer c.release()
+	return getKeys(c.db)
 }
 
 // KeysWithType in vault.
 func (k *Keyring) KeysWithType(typ string) ([]*api.Key, error) {
-	if err := k.initDB(); err != nil {
+	c, err := k.vault.use()
+	if err != nil {
 		return nil, err
 	}
-	return getKeysByType(k.vault.DB(), typ)
+	defer c.release()
+	return getKeysByType(c.db, typ)
 }
 
 // KeysWithLabel in vault.
 func (k *Keyring) KeysWithLabel(label string) ([]*api.Key, error) {
-	if err := k.initDB(); err != nil {
+	c, err := k.vault.use()
+	if err != nil {
 		return nil, err
 	}
-	return getKeysByLabel(k.vault.DB(), label)
+	defer c.release()
+	return getKeysByLabel(c.db, label)
 }
 
 // KeyWithLabel in vault.
 func (k *Keyring) KeyWithLabel(label string) (*api.Key, error) {
-	if err := k.initDB(); err != nil {
+	c, err := k.vault.use()
+	if err != nil {
 		return nil, err
 	}
-	ks, err := getKeysByLabel(k.vault.DB(), label)
+	defer c.release()
+	ks, err := getKeysByLabel(c.db, label)
 	if err != nil {
 		return nil, err
 	}
@@ -178,20 +163,24 @@ func (k *Keyring) KeyWithLabel(label string) (*api.Key, error) {
 // Get key by id.
 // Returns nil if not found.
 func (k *Keyring) Get(kid keys.ID) (*api.Key, error) {
-	if err := k.initDB(); err != nil {
+	c, err := k.vault.use()
+	if err != nil {
 		return nil, err
 	}
-	return getKey(k.vault.DB(), kid)
+	defer c.release()
+	return getKey(c.db, kid)
 }
 
 // Key by id.
 // If not found, returns keys.ErrNotFound.
 // You can use Get instead.
 func (k *Keyring) Key(kid keys.ID) (*api.Key, error) {
-	if err := k.initDB(); err != nil {
+	c, err := k.vault.use()
+	if err != nil {
 		return nil, err
 	}
-	key, err := getKey(k.vault.DB(), kid)
+	defer c.release()
+	key, err := getKey(c.db, kid)
 	if err != nil {
 		return nil, err
 	}
@@ -207,69 +196,185 @@ func (k *Keyring) Sync(ctx context.Context) error {
 	k.smtx.Lock()
 	defer k.smtx.Unlock()
 
-	ck, err := k.check()
+	c, err := k.vault.useWrite()
 	if err != nil {
 		return err
 	}
+	defer c.release()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
 
-	s := syncer.New(k.vault.DB(), k.vault.Client(), k.receive)
-	if err := s.Sync(ctx, ck); err != nil {
+	ck, err := k.check(c)
+	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (k *Keyring) receive(ctx *syncer.Context, events []*Event) error {
-	ck, err := k.vault.ClientKey()
+	// Device key is created here if needed, since we can't create it while
+	// receiving (in a transaction).
+	dk, err := deviceKey(c.db)
 	if err != nil {
 		return err
 	}
+	receiver := func(ctx *syncer.Context, events []*Event) error {
+		return k.receive(ctx, ck, dk, events)
+	}
+
+	s := syncer.New(c.db, k.vault.Remote(), receiver)
+	s.SetSnapshotReceiver(func(ctx *syncer.Context, snapshot *client.Snapshot) (bool, error) {
+		return k.receiveSnapshot(ctx, ck, dk, snapshot)
+	})
+	if err := s.Sync(ctx, ck); err != nil {
+		return err
+	}
+	return k.prune(c, ck)
+}
+
+func (k *Keyring) receive(ctx *syncer.Context, ck *api.Key, dk *keys.EdX25519Key, events []*Event) error {
 	for _, event := range events {
-		b, err := keys.CryptoBoxSealOpen(event.Data, ck.AsX25519())
+		ke, sender, reason, err := openEventTx(ctx.Tx, ck, dk, event)
 		if err != nil {
 			return err
 		}
-		var key api.Key
-		if err := msgpack.Unmarshal(b, &key); err != nil {
-			return err
-		}
-		if key.Deleted {
-			if err := deleteKeyTx(ctx.Tx, key.ID); err != nil {
-				return err
-			}
-		} else {
-			if err := updateKeyTx(ctx.Tx, &key); err != nil {
+		if reason != "" {
+			if err := rejectTx(ctx.Tx, event, sender, reason); err != nil {
 				return err
 			}
+			continue
+		}
+		if err := k.applyTx(ctx.Tx, ke); err != nil {
+			return err
+		}
+	}
+	return k.acceptTrustedTx(ctx.Tx, ck, dk)
+}
+
+// openEventTx decrypts and verifies a pulled keyring event.
+// Returns the reason (and sender, if signed) if the event is rejected.
+//
+// Events are signed by a device (see SignedCipher), with the event ID, and are
+// only applied from trusted devices (see TrustDevice).
+// Events from before events were signed are unsigned, and are only applied if
+// they are before the first signed event (see openUnsignedTx).
+func openEventTx(tx *sqlx.Tx, ck *api.Key, dk *keys.EdX25519Key, event *Event) (*keyEvent, keys.ID, string, error) {
+	signed, err := syncer.OpenSigned(event.Data, ck.AsEdX25519())
+	if err == syncer.ErrUnsigned {
+		ke, reason, err := openUnsignedTx(tx, ck, event)
+		return ke, "", reason, err
+	}
+	if err != nil {
+		sender := keys.ID("")
+		if signed != nil {
+			sender = signed.Sender
 		}
+		return nil, sender, err.Error(), nil
+	}
+	if err := setSignedIndexTx(tx, event.RemoteIndex); err != nil {
+		return nil, "", "", err
+	}
+	if event.ID != "" && signed.ID != event.ID {
+		return nil, signed.Sender, "event id mismatch", nil
+	}
+	trusted, err := isTrustedTx(tx, dk, signed.Sender)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if !trusted {
+		return nil, signed.Sender, untrustedDevice, nil
+	}
+	ke, err := decodeKeyEvent(signed.Data)
+	if err != nil {
+		return nil, signed.Sender, "invalid key", nil
+	}
+	return ke, signed.Sender, "", nil
+}
+
+// openUnsignedTx opens an unsigned (legacy) keyring event.
+// Unsigned events are only applied if they are before the first signed event
+// (the history from before the vault's devices signed events), since anyone
+// with the vault key can add an unsigned event.
+// Devices that don't sign events should be updated, since their events after
+// the first signed event are rejected.
+func openUnsignedTx(tx *sqlx.Tx, ck *api.Key, event *Event) (*keyEvent, string, error) {
+	index, err := signedIndexTx(tx)
+	if err != nil {
+		return nil, "", err
+	}
+	if index > 0 && event.RemoteIndex > index {
+		return nil, "unsigned event", nil
+	}
+	b, err := syncer.OpenUnsigned(event.Data, ck.AsEdX25519())
+	if err != nil {
+		return nil, err.Error(), nil
+	}
+	ke, err := decodeKeyEvent(b)
+	if err != nil {
+		return nil, "invalid key", nil
+	}
+	return ke, "", nil
+}
+
+// signedIndexTx returns the remote index of the first signed event, or 0 if
+// none.
+func signedIndexTx(tx *sqlx.Tx) (int64, error) {
+	var value string
+	if err := tx.Get(&value, "SELECT value FROM config WHERE key = $1", "signedIndex"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func setSignedIndexTx(tx *sqlx.Tx, index int64) error {
+	current, err := signedIndexTx(tx)
+	if err != nil {
+		return err
+	}
+	if current > 0 && current <= index {
+		return nil
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO config (key, value) VALUES ($1, $2)", "signedIndex", strconv.FormatInt(index, 10)); err != nil {
+		return err
 	}
 	return nil
 }
 
 // Find looks for local key and if not found, syncs and retries.
+// If read-only (see Vault.UnlockReadOnly), doesn't sync.
 func (k *Keyring) Find(ctx context.Context, kid keys.ID) (*api.Key, error) {
-	if _, err := k.check(); err != nil {
+	c, err := k.vault.use()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	if _, err := k.check(c); err != nil {
 		return nil, err
 	}
 
-	key, err := getKey(k.vault.DB(), kid)
+	key, err := getKey(c.db, kid)
 	if err != nil {
 		return nil, err
 	}
-	if key == nil {
+	if key == nil && !c.readOnly {
 		if err := k.Sync(ctx); err != nil {
 			return nil, err
 		}
 	}
-	return getKey(k.vault.DB(), kid)
+	return getKey(c.db, kid)
 }
 
 func (k *Keyring) Vaults() ([]*client.Vault, error) {
-	if _, err := k.check(); err != nil {
+	c, err := k.vault.use()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	if _, err := k.check(c); err != nil {
 		return nil, err
 	}
 
-	return getVaults(k.vault.DB())
+	return getVaults(c.db)
 }
 
 func updateKeyTx(tx *sqlx.Tx, key *api.Key) error {
@@ -303,6 +408,17 @@ func getKey(db *sqlx.DB, kid keys.ID) (*api.Key, error) {
 	return &key, nil
 }
 
+func getKeyTx(tx *sqlx.Tx, kid keys.ID) (*api.Key, error) {
+	var key api.Key
+	if err := tx.Get(&key, "SELECT * FROM keys WHERE id = $1", kid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
 func getKeys(db *sqlx.DB) ([]*api.Key, error) {
 	var vks []*api.Key
 	if err := db.Select(&vks, "SELECT * FROM keys ORDER BY id"); err != nil {
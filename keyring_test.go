@@ -1,13 +1,17 @@
 package vault_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/keys-pub/keys"
 	"github.com/keys-pub/keys/api"
 	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/syncer"
 	"github.com/keys-pub/vault/testutil"
 	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
 func TestKeyring(t *testing.T) {
@@ -53,3 +57,75 @@ func TestKeyring(t *testing.T) {
 	require.Equal(t, out[0].ID, bobKey.ID)
 	require.Equal(t, out[1].ID, charlieKey.ID)
 }
+
+func TestKeyringReindex(t *testing.T) {
+	var err error
+	ctx := context.TODO()
+
+	rm := remote.NewMem()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	ck, err := rm.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+	vlt, closeFn := testutil.NewTestVaultWithRemote(t, rm, "testpassword", ck)
+	defer closeFn()
+	kr := vlt.Keyring()
+
+	bobKey := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x02))).WithLabels("bob")
+	err = kr.Set(bobKey)
+	require.NoError(t, err)
+	charlieKey := api.NewKey(keys.NewX25519KeyFromSeed(testutil.Seed(0x03))).WithLabels("charlie")
+	err = kr.Set(charlieKey)
+	require.NoError(t, err)
+	err = kr.Sync(ctx)
+	require.NoError(t, err)
+	// Pending (not pushed)
+	bobKey = bobKey.WithNotes("bob notes")
+	err = kr.Set(bobKey)
+	require.NoError(t, err)
+
+	drift, err := kr.Verify()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(drift))
+
+	// Corrupt keys table
+	_, err = vlt.DB().Exec("DELETE FROM keys WHERE id = $1", charlieKey.ID)
+	require.NoError(t, err)
+	_, err = vlt.DB().Exec("UPDATE keys SET notes = 'corrupt' WHERE id = $1", bobKey.ID)
+	require.NoError(t, err)
+
+	drift, err = kr.Verify()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(drift))
+
+	err = kr.Reindex(ctx)
+	require.NoError(t, err)
+
+	drift, err = kr.Verify()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(drift))
+	out, err := kr.Key(bobKey.ID)
+	require.NoError(t, err)
+	require.Equal(t, bobKey, out)
+	out, err = kr.Key(charlieKey.ID)
+	require.NoError(t, err)
+	require.Equal(t, charlieKey, out)
+
+	// Unsigned (legacy) pending event, and a pulled event that can't be opened
+	daveKey := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x04))).WithLabels("dave")
+	b, err := msgpack.Marshal(daveKey)
+	require.NoError(t, err)
+	err = vlt.Add(ck.AsEdX25519(), b, syncer.CryptoBoxSealCipher{})
+	require.NoError(t, err)
+	_, err = vlt.DB().Exec("INSERT INTO pull (id, data, ridx, rts, vid) VALUES ($1, $2, $3, $4, $5)", "invalid", []byte{0x01}, 100, 0, ck.ID)
+	require.NoError(t, err)
+
+	err = kr.Reindex(ctx)
+	require.NoError(t, err)
+	out, err = kr.Key(daveKey.ID)
+	require.NoError(t, err)
+	require.Equal(t, daveKey, out)
+	rejected, err := kr.Rejected()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rejected))
+	require.Equal(t, int64(100), rejected[0].RemoteIndex)
+}
@@ -0,0 +1,131 @@
+// Package migrate runs versioned (up) migrations for sqlite databases, using
+// PRAGMA user_version for the schema version.
+package migrate
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Migration migrates the database schema (up) by one version.
+// It's run in a transaction with setting the new version.
+//
+// Databases created before migrations have version 0 (and may already have
+// some of the tables or columns), so migrations should be idempotent (CREATE
+// ... IF NOT EXISTS, AddColumn).
+type Migration func(tx *sqlx.Tx) error
+
+// TxLock is the (sqlite3 driver) DSN parameter for transactions to BEGIN
+// IMMEDIATE, which databases that are migrated (see Run) should be opened
+// with, so concurrent processes wait for a migration instead of both applying
+// it.
+const TxLock = "_txlock=immediate"
+
+// Version returns the database schema version.
+func Version(db *sqlx.DB) (int, error) {
+	var version int
+	if err := db.Get(&version, "PRAGMA user_version"); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Run migrations newer than the database version, in order.
+// The migration at index i migrates to version i+1.
+// Returns an error if the database version is newer than the migrations, for
+// example if the database was opened by a newer version.
+//
+// The version is read again in the transaction for each migration, so if the
+// database is opened with TxLock, a migration another process applied first
+// is skipped.
+func Run(db *sqlx.DB, migrations []Migration) error {
+	version, err := Version(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return errors.Errorf("database version %d is newer than supported version %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := transact(db, func(tx *sqlx.Tx) error {
+			var current int
+			if err := tx.Get(&current, "PRAGMA user_version"); err != nil {
+				return err
+			}
+			if current > i {
+				// Migrated by another process
+				return nil
+			}
+			if err := migrations[i](tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		}); err != nil {
+			return errors.Wrapf(err, "failed to migrate to version %d", i+1)
+		}
+	}
+	return nil
+}
+
+// Exec returns a Migration that executes statements.
+func Exec(stmts ...string) Migration {
+	return func(tx *sqlx.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// AddColumn returns a Migration that adds a column to a table, if the column
+// doesn't exist.
+func AddColumn(table string, column string, def string) Migration {
+	return func(tx *sqlx.Tx) error {
+		var count int
+		if err := tx.Get(&count, "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, column); err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+		return err
+	}
+}
+
+// Steps returns a Migration that runs migrations in order (in the same
+// transaction), for a version that has more than one step.
+func Steps(migrations ...Migration) Migration {
+	return func(tx *sqlx.Tx) error {
+		for _, m := range migrations {
+			if err := m(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func transact(db *sqlx.DB, txFn func(*sqlx.Tx) error) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	err = txFn(tx)
+	return err
+}
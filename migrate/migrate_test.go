@@ -0,0 +1,108 @@
+package migrate_test
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/vault/migrate"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	_ "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+func TestRun(t *testing.T) {
+	var err error
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	db, err := sqlx.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Table created before migrations
+	_, err = db.Exec("CREATE TABLE test (id TEXT PRIMARY KEY NOT NULL, b TEXT)")
+	require.NoError(t, err)
+
+	migrations := []migrate.Migration{
+		migrate.Exec(`CREATE TABLE IF NOT EXISTS test (id TEXT PRIMARY KEY NOT NULL);`),
+		migrate.Steps(
+			migrate.AddColumn("test", "b", "TEXT"),
+			migrate.AddColumn("test", "c", "INTEGER NOT NULL DEFAULT 0"),
+		),
+	}
+	err = migrate.Run(db, migrations)
+	require.NoError(t, err)
+	version, err := migrate.Version(db)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	_, err = db.Exec("INSERT INTO test (id, b, c) VALUES ('1', 'b', 1)")
+	require.NoError(t, err)
+
+	// Again (no-op)
+	err = migrate.Run(db, migrations)
+	require.NoError(t, err)
+
+	// Failed migration is rolled back
+	failing := append(migrations,
+		migrate.Steps(
+			migrate.AddColumn("test", "d", "TEXT"),
+			func(tx *sqlx.Tx) error { return errors.Errorf("test failure") },
+		))
+	err = migrate.Run(db, failing)
+	require.EqualError(t, err, "failed to migrate to version 3: test failure")
+	version, err = migrate.Version(db)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	var count int
+	err = db.Get(&count, "SELECT COUNT(*) FROM pragma_table_info('test') WHERE name = 'd'")
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// Newer version
+	err = migrate.Run(db, migrations[:1])
+	require.EqualError(t, err, "database version 2 is newer than supported version 1")
+}
+
+func TestRunConcurrent(t *testing.T) {
+	var err error
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+
+	// Not idempotent, so fails if applied twice
+	migrations := []migrate.Migration{
+		migrate.Exec(`CREATE TABLE test (id TEXT PRIMARY KEY NOT NULL);`),
+		migrate.Exec(`CREATE TABLE test2 (id TEXT PRIMARY KEY NOT NULL);`),
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := sqlx.Open("sqlite3", path+"?"+migrate.TxLock)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+			errs <- migrate.Run(db, migrations)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	db, err := sqlx.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+	version, err := migrate.Version(db)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+}
@@ -1,14 +1,23 @@
 package vault
 
 import (
+	"time"
+
 	"github.com/keys-pub/keys/tsutil"
 	"github.com/keys-pub/vault/client"
 )
 
 // Options for vault.
 type Options struct {
-	Client *client.Client
-	Clock  tsutil.Clock
+	Remote   client.Remote
+	Clock    tsutil.Clock
+	Resolver Resolver
+	Prune    PrunePolicy
+
+	Session    SessionStore
+	SessionTTL time.Duration
+
+	IdleTimeout time.Duration
 }
 
 // Option for Vault.
@@ -16,7 +25,9 @@ type Option func(*Options)
 
 func newOptions(opts ...Option) *Options {
 	options := &Options{
-		Clock: tsutil.NewClock(),
+		Clock:    tsutil.NewClock(),
+		Resolver: ResolveLastWriterWins,
+		Prune:    PruneNever,
 	}
 	for _, o := range opts {
 		o(options)
@@ -32,8 +43,58 @@ func WithClock(clock tsutil.Clock) Option {
 }
 
 // WithClient ...
+// If client is nil, the default client is used (see WithRemote).
 func WithClient(client *client.Client) Option {
 	return func(o *Options) {
-		o.Client = client
+		if client != nil {
+			o.Remote = client
+		}
+	}
+}
+
+// WithRemote sets the remote to sync with.
+// Defaults to the getchill.app client.
+func WithRemote(remote client.Remote) Option {
+	return func(o *Options) {
+		o.Remote = remote
+	}
+}
+
+// WithResolver sets how conflicting keyring edits from different devices are
+// resolved.
+// Defaults to ResolveLastWriterWins.
+func WithResolver(resolver Resolver) Option {
+	return func(o *Options) {
+		o.Resolver = resolver
+	}
+}
+
+// WithPrunePolicy sets when pulled events are removed from the local pull
+// table.
+// Defaults to PruneNever, since events rejected from a device that isn't
+// trusted yet are applied from the pull table when it's trusted (see
+// TrustDevice).
+func WithPrunePolicy(policy PrunePolicy) Option {
+	return func(o *Options) {
+		o.Prune = policy
+	}
+}
+
+// WithSession caches the master key in a session store for ttl after unlock,
+// so other processes can unlock with UnlockWithSession (see
+// NewKernelSessionStore).
+func WithSession(store SessionStore, ttl time.Duration) Option {
+	return func(o *Options) {
+		o.Session = store
+		o.SessionTTL = ttl
+	}
+}
+
+// WithIdleLock locks the vault after it hasn't been accessed (keyring or
+// config) for the timeout.
+// Defaults to 0, which never locks.
+func WithIdleLock(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.IdleTimeout = timeout
 	}
 }
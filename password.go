@@ -19,8 +19,8 @@ func (v *Vault) SetupPassword(password string) (*[32]byte, error) {
 
 // RegisterPassword adds a password.
 func (v *Vault) RegisterPassword(mk *[32]byte, password string) (*auth.Auth, error) {
-	if v.db == nil {
-		return nil, ErrLocked
+	if err := v.writable(); err != nil {
+		return nil, err
 	}
 	reg, err := v.auth.RegisterPassword(password, mk)
 	if err != nil {
@@ -35,8 +35,17 @@ func (v *Vault) UnlockWithPassword(password string) (*[32]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := v.Unlock(mk); err != nil {
+	return v.unlock(mk)
+}
+
+// ChangePassword changes a password for this vault, if the old password is
+// valid.
+// Requires Unlock (not read-only).
+func (v *Vault) ChangePassword(old string, new string) (*auth.Auth, error) {
+	c, err := v.useWrite()
+	if err != nil {
 		return nil, err
 	}
-	return mk, nil
+	defer c.release()
+	return v.auth.ChangePassword(c.mkID, old, new)
 }
@@ -20,8 +20,8 @@ func (v *Vault) SetupPaperKey(paperKey string) (*[32]byte, error) {
 
 // RegisterPaperKey adds a paper key.
 func (v *Vault) RegisterPaperKey(mk *[32]byte, paperKey string) (*auth.Auth, error) {
-	if v.db == nil {
-		return nil, ErrLocked
+	if err := v.writable(); err != nil {
+		return nil, err
 	}
 	reg, err := v.auth.RegisterPaperKey(paperKey, mk)
 	if err != nil {
@@ -36,8 +36,5 @@ func (v *Vault) UnlockWithPaperKey(paperKey string) (*[32]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := v.Unlock(mk); err != nil {
-		return nil, err
-	}
-	return mk, nil
+	return v.unlock(mk)
 }
@@ -4,3 +4,4 @@ var OpenDB = openDB
 var InitTables = initTables
 var GetConfig = getConfig
 var SetConfig = setConfig
+var RekeyDB = rekeyDB
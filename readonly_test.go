@@ -0,0 +1,118 @@
+package vault_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnlockReadOnly(t *testing.T) {
+	var err error
+	ctx := context.TODO()
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	defer func() { _ = os.Remove(path + ".lock") }()
+	authPath := testutil.Path()
+	defer func() { _ = os.Remove(authPath) }()
+	authDB, err := auth.NewDB(authPath)
+	require.NoError(t, err)
+	defer func() { _ = authDB.Close() }()
+
+	rm := remote.NewMem()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	ck, err := rm.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+
+	vlt, err := vault.New(path, authDB, vault.WithRemote(rm))
+	require.NoError(t, err)
+
+	mk := keys.Rand32()
+	err = vlt.UnlockReadOnly(mk)
+	require.Equal(t, vault.ErrSetupNeeded, err)
+
+	err = vlt.Setup(mk)
+	require.NoError(t, err)
+	err = vlt.SetClientKey(ck)
+	require.NoError(t, err)
+	ak := api.NewKey(alice).WithLabels("alice")
+	err = vlt.Keyring().Set(ak)
+	require.NoError(t, err)
+	err = vlt.Config().Set("name", "alice")
+	require.NoError(t, err)
+
+	err = vlt.UnlockReadOnly(mk)
+	require.EqualError(t, err, "already unlocked (not read-only)")
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	err = vlt.UnlockReadOnly(keys.Rand32())
+	require.Error(t, err)
+	require.Equal(t, vault.Locked, vlt.Status())
+
+	err = vlt.UnlockReadOnly(mk)
+	require.NoError(t, err)
+	require.Equal(t, vault.Unlocked, vlt.Status())
+	require.True(t, vlt.ReadOnly())
+
+	// Reads
+	out, err := vlt.Keyring().Get(ak.ID)
+	require.NoError(t, err)
+	require.Equal(t, ak.ID, out.ID)
+	name, err := vlt.Config().String("name")
+	require.NoError(t, err)
+	require.Equal(t, "alice", name)
+
+	// Writes
+	bk := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x02)))
+	err = vlt.Keyring().Set(bk)
+	require.Equal(t, vault.ErrReadOnly, err)
+	err = vlt.Keyring().Remove(ak.ID)
+	require.Equal(t, vault.ErrReadOnly, err)
+	err = vlt.Keyring().Sync(ctx)
+	require.Equal(t, vault.ErrReadOnly, err)
+	_, err = vlt.Keyring().Verify()
+	require.Equal(t, vault.ErrReadOnly, err)
+	err = vlt.Config().Set("name", "bob")
+	require.Equal(t, vault.ErrReadOnly, err)
+	_, err = vlt.RegisterPassword(mk, "testpassword")
+	require.Equal(t, vault.ErrReadOnly, err)
+	_, err = vlt.ChangePassword("testpassword", "testpassword2")
+	require.Equal(t, vault.ErrReadOnly, err)
+	_, err = vlt.RotateMasterKey(mk)
+	require.Equal(t, vault.ErrReadOnly, err)
+	require.True(t, vlt.ReadOnly())
+
+	err = vlt.Unlock(mk)
+	require.EqualError(t, err, "already unlocked read-only")
+
+	// Another process can unlock read-only, but not read-write
+	vlt2, err := vault.New(path, authDB, vault.WithRemote(rm))
+	require.NoError(t, err)
+	err = vlt2.UnlockReadOnly(mk)
+	require.NoError(t, err)
+	out, err = vlt2.Keyring().Get(ak.ID)
+	require.NoError(t, err)
+	require.Equal(t, ak.ID, out.ID)
+	err = vlt2.Lock()
+	require.NoError(t, err)
+	err = vlt2.Unlock(mk)
+	require.Equal(t, vault.ErrInUse{PID: os.Getpid()}, err)
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+	require.False(t, vlt.ReadOnly())
+	err = vlt2.Unlock(mk)
+	require.NoError(t, err)
+	err = vlt.UnlockReadOnly(mk)
+	require.Equal(t, vault.ErrInUse{PID: os.Getpid()}, err)
+	err = vlt2.Lock()
+	require.NoError(t, err)
+}
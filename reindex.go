@@ -0,0 +1,259 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Reindex rebuilds the keys table (and key versions and conflicts) from the
+// checkpoint (snapshot), the pulled events after it and the events not pushed
+// yet.
+// Events are replayed in order in a single transaction.
+// Events that were rejected when pulled (see Rejected) are skipped, other
+// events are verified (signature) but not checked against the trusted
+// devices again, since they were checked when pulled.
+// Pulled events that can't be opened or decoded are rejected, and pending
+// events that can't are skipped, so the replay doesn't fail.
+// Requires Unlock.
+func (k *Keyring) Reindex(ctx context.Context) error {
+	k.smtx.Lock()
+	defer k.smtx.Unlock()
+
+	c, err := k.vault.useWrite()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	ck, err := k.check(c)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Reindexing keyring...")
+	return syncer.Transact(c.db, func(tx *sqlx.Tx) error {
+		return k.replayTx(ctx, tx, ck)
+	})
+}
+
+// Drift is a difference between the keys table and the keys from replaying
+// the events (see Reindex).
+type Drift struct {
+	ID keys.ID
+	// Key in the keys table, or nil if missing.
+	Key *api.Key
+	// Expected key from the events, or nil if missing.
+	Expected *api.Key
+}
+
+// Verify replays the events (like Reindex, without saving) and returns the
+// keys that differ from the keys table.
+// If there is drift, you can Reindex.
+// The events are replayed in a transaction that is rolled back, so this isn't
+// available if unlocked read-only (ErrReadOnly).
+// Requires Unlock.
+func (k *Keyring) Verify() ([]*Drift, error) {
+	k.smtx.Lock()
+	defer k.smtx.Unlock()
+
+	c, err := k.vault.useWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	ck, err := k.check(c)
+	if err != nil {
+		return nil, err
+	}
+	current, err := getKeys(c.db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	// Always rollback, we only want the replayed keys.
+	defer func() { _ = tx.Rollback() }()
+	if err := k.replayTx(context.Background(), tx, ck); err != nil {
+		return nil, err
+	}
+	expected, err := getKeysTx(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return drift(current, expected)
+}
+
+func drift(current []*api.Key, expected []*api.Key) ([]*Drift, error) {
+	em := map[keys.ID]*api.Key{}
+	for _, key := range expected {
+		em[key.ID] = key
+	}
+	out := []*Drift{}
+	for _, key := range current {
+		exp, ok := em[key.ID]
+		delete(em, key.ID)
+		if !ok {
+			out = append(out, &Drift{ID: key.ID, Key: key})
+			continue
+		}
+		eq, err := keysEqual(key, exp)
+		if err != nil {
+			return nil, err
+		}
+		if !eq {
+			out = append(out, &Drift{ID: key.ID, Key: key, Expected: exp})
+		}
+	}
+	for _, key := range expected {
+		if _, ok := em[key.ID]; ok {
+			out = append(out, &Drift{ID: key.ID, Expected: key})
+		}
+	}
+	return out, nil
+}
+
+func keysEqual(a *api.Key, b *api.Key) (bool, error) {
+	ab, err := msgpack.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := msgpack.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ab, bb), nil
+}
+
+func (k *Keyring) replayTx(ctx context.Context, tx *sqlx.Tx, ck *api.Key) error {
+	for _, table := range []string{"keys", "versions", "conflicts"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return err
+		}
+	}
+
+	// Checkpoint (snapshot), which includes the pulled events up to its index
+	index := int64(0)
+	checkpoint, err := syncer.CheckpointTx(tx, ck.ID)
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		index = checkpoint.Index
+		signed, err := syncer.OpenSigned(checkpoint.Data, ck.AsEdX25519())
+		if err != nil {
+			return errors.Wrapf(err, "invalid checkpoint")
+		}
+		var ks keyringSnapshot
+		if err := msgpack.Unmarshal(signed.Data, &ks); err != nil {
+			return errors.Wrapf(err, "invalid checkpoint")
+		}
+		if err := k.applySnapshotTx(tx, &ks); err != nil {
+			return err
+		}
+	}
+
+	// Pulled (after the checkpoint)
+	seen := map[string]bool{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		events, err := syncer.PulledTx(tx, ck.ID, index, 1000)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			index = event.RemoteIndex
+			if event.ID != "" {
+				if seen[event.ID] {
+					continue
+				}
+				seen[event.ID] = true
+			}
+			rejected, err := isRejectedTx(tx, event)
+			if err != nil {
+				return err
+			}
+			if rejected {
+				continue
+			}
+			ke, err := openReplayEvent(ck, event.Data)
+			if err != nil {
+				// Reject (like receive) instead of failing the replay.
+				if err := rejectTx(tx, event, "", err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := k.applyTx(tx, ke); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Pending push
+	pending, err := syncer.PendingTx(tx, ck.ID)
+	if err != nil {
+		return err
+	}
+	for i, b := range pending {
+		ke, err := openReplayEvent(ck, b)
+		if err != nil {
+			logger.Warningf("Skipping pending event %d: %v", i, err)
+			continue
+		}
+		if err := k.applyTx(tx, ke); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openReplayEvent opens a pulled event that wasn't rejected, or a pending
+// event.
+// Unsigned events (from before events were signed) were accepted when pulled
+// (see openUnsignedTx), or added by this device.
+func openReplayEvent(ck *api.Key, data []byte) (*keyEvent, error) {
+	var b []byte
+	signed, err := syncer.OpenSigned(data, ck.AsEdX25519())
+	switch {
+	case err == syncer.ErrUnsigned:
+		b, err = syncer.OpenUnsigned(data, ck.AsEdX25519())
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		b = signed.Data
+	}
+	ke, err := decodeKeyEvent(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key")
+	}
+	return ke, nil
+}
+
+func isRejectedTx(tx *sqlx.Tx, event *Event) (bool, error) {
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM rejected WHERE vid = $1 AND ridx = $2", event.VID, event.RemoteIndex); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,553 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/client"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Dir is a remote backed by a directory, for example on a shared or removable
+// filesystem.
+//
+// Each vault is a subdirectory with a vault file and an events directory with
+// an event file for each remote index.
+// Event files are written to a temporary file and then hard linked to the
+// index, which fails if the index already exists, so multiple processes (or
+// machines) can post to the same directory.
+// Event IDs are claimed as files in an ids directory before the event is
+// added, and the claim records the event index once the event is added, so
+// events already posted are ignored. A claim without an event (a post that
+// didn't finish) is taken over after claimTimeout.
+// The latest snapshot is a snapshot file, replaced by renaming.
+type Dir struct {
+	path  string
+	clock tsutil.Clock
+	limit int
+}
+
+type dirVault struct {
+	Token     string `msgpack:"token"`
+	Timestamp int64  `msgpack:"ts"`
+}
+
+type dirEvent struct {
+	ID        string `msgpack:"id,omitempty"`
+	Data      []byte `msgpack:"dat"`
+	Timestamp int64  `msgpack:"ts"`
+}
+
+var _ client.Remote = &Dir{}
+var _ client.Snapshots = &Dir{}
+
+// NewDir creates a directory remote.
+// The directory is created if it doesn't exist.
+func NewDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &Dir{
+		path:  path,
+		clock: tsutil.NewClock(),
+		limit: DefaultLimit,
+	}, nil
+}
+
+// SetClock sets the clock.
+func (d *Dir) SetClock(clock tsutil.Clock) {
+	d.clock = clock
+}
+
+// SetLimit sets the max number of events returned from Events.
+func (d *Dir) SetLimit(limit int) {
+	d.limit = limit
+}
+
+func (d *Dir) vaultPath(vid keys.ID) string {
+	return filepath.Join(d.path, vid.String())
+}
+
+func (d *Dir) eventsPath(vid keys.ID) string {
+	return filepath.Join(d.vaultPath(vid), "events")
+}
+
+func (d *Dir) idsPath(vid keys.ID) string {
+	return filepath.Join(d.vaultPath(vid), "ids")
+}
+
+func eventName(index int64) string {
+	return fmt.Sprintf("%015d", index)
+}
+
+// Register a vault.
+func (d *Dir) Register(ctx context.Context, key *keys.EdX25519Key, account *keys.EdX25519Key) (*api.Key, error) {
+	if err := os.Mkdir(d.vaultPath(key.ID()), 0700); err != nil {
+		if os.IsExist(err) {
+			return nil, errors.Errorf("vault already exists")
+		}
+		return nil, err
+	}
+	if err := os.Mkdir(d.eventsPath(key.ID()), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(d.idsPath(key.ID()), 0700); err != nil {
+		return nil, err
+	}
+	vlt := &dirVault{
+		Token:     newToken(),
+		Timestamp: d.clock.NowMillis(),
+	}
+	b, err := msgpack.Marshal(vlt)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.vaultPath(key.ID()), "vault"), b, 0600); err != nil {
+		return nil, err
+	}
+	out := api.NewKey(key).Created(vlt.Timestamp)
+	out.SetExtString("token", vlt.Token)
+	return out, nil
+}
+
+func (d *Dir) vault(vid keys.ID) (*dirVault, error) {
+	b, err := ioutil.ReadFile(filepath.Join(d.vaultPath(vid), "vault")) // #nosec
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var vlt dirVault
+	if err := msgpack.Unmarshal(b, &vlt); err != nil {
+		return nil, err
+	}
+	return &vlt, nil
+}
+
+// Get a vault.
+// Returns nil if not found.
+func (d *Dir) Get(ctx context.Context, key *keys.EdX25519Key) (*client.Vault, error) {
+	vlt, err := d.vault(key.ID())
+	if err != nil {
+		return nil, err
+	}
+	if vlt == nil {
+		return nil, nil
+	}
+	return &client.Vault{ID: key.ID(), Token: vlt.Token, Timestamp: vlt.Timestamp}, nil
+}
+
+// Post events to a vault.
+// Events with an ID the vault already has are ignored.
+func (d *Dir) Post(ctx context.Context, key *keys.EdX25519Key, events []*client.PushEvent) error {
+	vlt, err := d.vault(key.ID())
+	if err != nil {
+		return err
+	}
+	if vlt == nil {
+		return keys.NewErrNotFound(key.ID().String())
+	}
+	indexes, err := d.indexes(key.ID())
+	if err != nil {
+		return err
+	}
+	next := int64(1)
+	if len(indexes) > 0 {
+		next = indexes[len(indexes)-1] + 1
+	}
+	for _, e := range events {
+		claimed, err := d.claimID(key.ID(), e.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		index, err := d.add(key.ID(), e, next)
+		if err != nil {
+			_ = d.releaseID(key.ID(), e.ID)
+			return err
+		}
+		if err := d.setIDIndex(key.ID(), e.ID, index); err != nil {
+			return err
+		}
+		next = index + 1
+	}
+	return nil
+}
+
+// claimTimeout is how long a claimed event ID without an event is left for
+// the post that claimed it, before another post can take it over.
+const claimTimeout = time.Minute
+
+func (d *Dir) idPath(vid keys.ID, id string) (string, error) {
+	if !isValidID(id) {
+		return "", errors.Errorf("invalid event id")
+	}
+	return filepath.Join(d.idsPath(vid), id), nil
+}
+
+// claimID creates the file for an event ID, so only one Post adds the event.
+// Returns false if the ID was already claimed, and the vault has the event or
+// the claim is recent (another post is adding it).
+// A claim without an event that is older than claimTimeout (the post that
+// claimed it didn't finish) is taken over.
+// Events without an ID are always added.
+func (d *Dir) claimID(vid keys.ID, id string) (bool, error) {
+	if id == "" {
+		return true, nil
+	}
+	path, err := d.idPath(vid, id)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(d.idsPath(vid), 0700); err != nil {
+		return false, err
+	}
+	created, err := createExcl(path)
+	if err != nil || created {
+		return created, err
+	}
+
+	ok, err := d.hasEvent(vid, id)
+	if err != nil || ok {
+		return false, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return createExcl(path)
+		}
+		return false, err
+	}
+	if time.Since(fi.ModTime()) < claimTimeout {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return createExcl(path)
+}
+
+// createExcl creates an empty file, returning false if it already exists.
+func createExcl(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600) // #nosec
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setIDIndex records the index of the event for a claimed event ID.
+func (d *Dir) setIDIndex(vid keys.ID, id string, index int64) error {
+	if id == "" {
+		return nil
+	}
+	path, err := d.idPath(vid, id)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.FormatInt(index, 10)), 0600)
+}
+
+// hasEvent returns true if the vault has an event with the ID.
+// Uses the index in the ID file if it was recorded, otherwise looks through
+// the events (for a post that added the event but didn't record the index).
+func (d *Dir) hasEvent(vid keys.ID, id string) (bool, error) {
+	path, err := d.idPath(vid, id)
+	if err != nil {
+		return false, err
+	}
+	b, err := ioutil.ReadFile(path) // #nosec
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if index, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+		event, err := d.event(vid, index)
+		if err == nil && event.ID == id {
+			return true, nil
+		}
+	}
+	indexes, err := d.indexes(vid)
+	if err != nil {
+		return false, err
+	}
+	for i := len(indexes) - 1; i >= 0; i-- {
+		event, err := d.event(vid, indexes[i])
+		if err != nil {
+			return false, err
+		}
+		if event.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseID removes a claimed event ID if the event couldn't be added, so the
+// event is added on retry.
+func (d *Dir) releaseID(vid keys.ID, id string) error {
+	if id == "" {
+		return nil
+	}
+	path, err := d.idPath(vid, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// isValidID returns true if the event ID is safe to use as a file name.
+func isValidID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// add event at the next available index starting at next.
+func (d *Dir) add(vid keys.ID, e *client.PushEvent, next int64) (int64, error) {
+	mb, err := msgpack.Marshal(&dirEvent{ID: e.ID, Data: e.Data, Timestamp: d.clock.NowMillis()})
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(d.eventsPath(vid), ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(mb); err != nil {
+		_ = tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	for index := next; ; index++ {
+		err := os.Link(tmp.Name(), filepath.Join(d.eventsPath(vid), eventName(index)))
+		if err == nil {
+			return index, nil
+		}
+		if !os.IsExist(err) {
+			return 0, err
+		}
+	}
+}
+
+// indexes returns the sorted event indexes for a vault.
+func (d *Dir) indexes(vid keys.ID) ([]int64, error) {
+	files, err := ioutil.ReadDir(d.eventsPath(vid))
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]int64, 0, len(files))
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		index, err := strconv.ParseInt(f.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes, nil
+}
+
+func (d *Dir) event(vid keys.ID, index int64) (*client.Event, error) {
+	b, err := ioutil.ReadFile(filepath.Join(d.eventsPath(vid), eventName(index))) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	var e dirEvent
+	if err := msgpack.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &client.Event{
+		ID:              e.ID,
+		VID:             vid,
+		Data:            e.Data,
+		RemoteIndex:     index,
+		RemoteTimestamp: tsutil.ParseMillis(e.Timestamp),
+	}, nil
+}
+
+// Events from a vault after index.
+// Returns nil if not found.
+func (d *Dir) Events(ctx context.Context, key *keys.EdX25519Key, index int64) (*client.Events, error) {
+	vlt, err := d.vault(key.ID())
+	if err != nil {
+		return nil, err
+	}
+	if vlt == nil {
+		return nil, nil
+	}
+	indexes, err := d.indexes(key.ID())
+	if err != nil {
+		return nil, err
+	}
+	events := []*client.Event{}
+	truncated := false
+	next := index
+	for _, i := range indexes {
+		if i <= index {
+			continue
+		}
+		if len(events) >= d.limit {
+			truncated = true
+			break
+		}
+		event, err := d.event(key.ID(), i)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		next = i
+	}
+	return &client.Events{
+		Events:    events,
+		Index:     next,
+		Truncated: truncated,
+	}, nil
+}
+
+// Status for vaults.
+func (d *Dir) Status(ctx context.Context, vlts []*client.Vault) ([]*client.RemoteStatus, error) {
+	out := []*client.RemoteStatus{}
+	for _, v := range vlts {
+		vlt, err := d.vault(v.ID)
+		if err != nil {
+			return nil, err
+		}
+		if vlt == nil {
+			continue
+		}
+		if v.Token != vlt.Token {
+			return nil, errors.Errorf("invalid token")
+		}
+		st := &client.RemoteStatus{ID: v.ID, Timestamp: vlt.Timestamp}
+		indexes, err := d.indexes(v.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(indexes) > 0 {
+			last, err := d.event(v.ID, indexes[len(indexes)-1])
+			if err != nil {
+				return nil, err
+			}
+			st.Index = last.RemoteIndex
+			st.Timestamp = tsutil.Millis(last.RemoteTimestamp)
+		}
+		out = append(out, st)
+	}
+	sortStatus(out)
+	return out, nil
+}
+
+func (d *Dir) snapshotPath(vid keys.ID) string {
+	return filepath.Join(d.vaultPath(vid), "snapshot")
+}
+
+func (d *Dir) snapshot(vid keys.ID) (*client.Snapshot, error) {
+	b, err := ioutil.ReadFile(d.snapshotPath(vid)) // #nosec
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshot client.Snapshot
+	if err := msgpack.Unmarshal(b, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// PutSnapshot stores a vault snapshot.
+func (d *Dir) PutSnapshot(ctx context.Context, key *keys.EdX25519Key, snapshot *client.Snapshot) error {
+	vlt, err := d.vault(key.ID())
+	if err != nil {
+		return err
+	}
+	if vlt == nil {
+		return keys.NewErrNotFound(key.ID().String())
+	}
+	indexes, err := d.indexes(key.ID())
+	if err != nil {
+		return err
+	}
+	last := int64(0)
+	if len(indexes) > 0 {
+		last = indexes[len(indexes)-1]
+	}
+	current, err := d.snapshot(key.ID())
+	if err != nil {
+		return err
+	}
+	if err := checkSnapshot(snapshot, current, last); err != nil {
+		return err
+	}
+	b, err := msgpack.Marshal(&client.Snapshot{Index: snapshot.Index, Data: snapshot.Data, Timestamp: d.clock.NowMillis()})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(d.vaultPath(key.ID()), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.snapshotPath(key.ID()))
+}
+
+// Snapshot returns the latest vault snapshot.
+// Returns nil if not found.
+func (d *Dir) Snapshot(ctx context.Context, key *keys.EdX25519Key) (*client.Snapshot, error) {
+	return d.snapshot(key.ID())
+}
+
+// Delete a vault.
+func (d *Dir) Delete(ctx context.Context, key *keys.EdX25519Key) error {
+	vlt, err := d.vault(key.ID())
+	if err != nil {
+		return err
+	}
+	if vlt == nil {
+		return keys.NewErrNotFound(key.ID().String())
+	}
+	return os.RemoveAll(d.vaultPath(key.ID()))
+}
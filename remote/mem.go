@@ -0,0 +1,233 @@
+// Package remote provides client.Remote implementations that don't require a
+// server, such as in memory (for testing) or a (shared) directory.
+package remote
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/keys/encoding"
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/client"
+	"github.com/pkg/errors"
+)
+
+// DefaultLimit is the max number of events returned from Events.
+const DefaultLimit = 1000
+
+// Mem is an in memory remote.
+type Mem struct {
+	mtx    sync.Mutex
+	vaults map[keys.ID]*memVault
+	clock  tsutil.Clock
+	limit  int
+}
+
+type memVault struct {
+	token     string
+	timestamp int64
+	events    []*client.Event
+	ids       map[string]bool
+	snapshot  *client.Snapshot
+}
+
+var _ client.Remote = &Mem{}
+var _ client.Snapshots = &Mem{}
+
+// NewMem creates an in memory remote.
+func NewMem() *Mem {
+	return &Mem{
+		vaults: map[keys.ID]*memVault{},
+		clock:  tsutil.NewClock(),
+		limit:  DefaultLimit,
+	}
+}
+
+// SetClock sets the clock.
+func (m *Mem) SetClock(clock tsutil.Clock) {
+	m.clock = clock
+}
+
+// SetLimit sets the max number of events returned from Events.
+func (m *Mem) SetLimit(limit int) {
+	m.limit = limit
+}
+
+// Register a vault.
+func (m *Mem) Register(ctx context.Context, key *keys.EdX25519Key, account *keys.EdX25519Key) (*api.Key, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.vaults[key.ID()]; ok {
+		return nil, errors.Errorf("vault already exists")
+	}
+	vlt := &memVault{
+		token:     newToken(),
+		timestamp: m.clock.NowMillis(),
+		ids:       map[string]bool{},
+	}
+	m.vaults[key.ID()] = vlt
+	out := api.NewKey(key).Created(vlt.timestamp)
+	out.SetExtString("token", vlt.token)
+	return out, nil
+}
+
+// Get a vault.
+// Returns nil if not found.
+func (m *Mem) Get(ctx context.Context, key *keys.EdX25519Key) (*client.Vault, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	vlt, ok := m.vaults[key.ID()]
+	if !ok {
+		return nil, nil
+	}
+	return &client.Vault{ID: key.ID(), Token: vlt.token, Timestamp: vlt.timestamp}, nil
+}
+
+// Post events to a vault.
+// Events with an ID the vault already has are ignored.
+func (m *Mem) Post(ctx context.Context, key *keys.EdX25519Key, events []*client.PushEvent) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	vlt, ok := m.vaults[key.ID()]
+	if !ok {
+		return keys.NewErrNotFound(key.ID().String())
+	}
+	for _, e := range events {
+		if e.ID != "" {
+			if vlt.ids[e.ID] {
+				continue
+			}
+			vlt.ids[e.ID] = true
+		}
+		vlt.events = append(vlt.events, &client.Event{
+			ID:              e.ID,
+			VID:             key.ID(),
+			Data:            e.Data,
+			RemoteIndex:     int64(len(vlt.events) + 1),
+			RemoteTimestamp: m.clock.Now(),
+		})
+	}
+	return nil
+}
+
+// Events from a vault after index.
+// Returns nil if not found.
+func (m *Mem) Events(ctx context.Context, key *keys.EdX25519Key, index int64) (*client.Events, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	vlt, ok := m.vaults[key.ID()]
+	if !ok {
+		return nil, nil
+	}
+	if index < 0 || index > int64(len(vlt.events)) {
+		return nil, errors.Errorf("invalid index")
+	}
+	events := vlt.events[index:]
+	truncated := false
+	if len(events) > m.limit {
+		events = events[:m.limit]
+		truncated = true
+	}
+	out := make([]*client.Event, 0, len(events))
+	for _, e := range events {
+		ec := *e
+		out = append(out, &ec)
+	}
+	return &client.Events{
+		Events:    out,
+		Index:     index + int64(len(out)),
+		Truncated: truncated,
+	}, nil
+}
+
+// Status for vaults.
+func (m *Mem) Status(ctx context.Context, vlts []*client.Vault) ([]*client.RemoteStatus, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	out := []*client.RemoteStatus{}
+	for _, v := range vlts {
+		vlt, ok := m.vaults[v.ID]
+		if !ok {
+			continue
+		}
+		if v.Token != vlt.token {
+			return nil, errors.Errorf("invalid token")
+		}
+		st := &client.RemoteStatus{ID: v.ID, Timestamp: vlt.timestamp}
+		if len(vlt.events) > 0 {
+			last := vlt.events[len(vlt.events)-1]
+			st.Index = last.RemoteIndex
+			st.Timestamp = tsutil.Millis(last.RemoteTimestamp)
+		}
+		out = append(out, st)
+	}
+	sortStatus(out)
+	return out, nil
+}
+
+// PutSnapshot stores a vault snapshot.
+func (m *Mem) PutSnapshot(ctx context.Context, key *keys.EdX25519Key, snapshot *client.Snapshot) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	vlt, ok := m.vaults[key.ID()]
+	if !ok {
+		return keys.NewErrNotFound(key.ID().String())
+	}
+	if err := checkSnapshot(snapshot, vlt.snapshot, int64(len(vlt.events))); err != nil {
+		return err
+	}
+	vlt.snapshot = &client.Snapshot{Index: snapshot.Index, Data: snapshot.Data, Timestamp: m.clock.NowMillis()}
+	return nil
+}
+
+// Snapshot returns the latest vault snapshot.
+// Returns nil if not found.
+func (m *Mem) Snapshot(ctx context.Context, key *keys.EdX25519Key) (*client.Snapshot, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	vlt, ok := m.vaults[key.ID()]
+	if !ok || vlt.snapshot == nil {
+		return nil, nil
+	}
+	out := *vlt.snapshot
+	return &out, nil
+}
+
+// Delete a vault.
+func (m *Mem) Delete(ctx context.Context, key *keys.EdX25519Key) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.vaults[key.ID()]; !ok {
+		return keys.NewErrNotFound(key.ID().String())
+	}
+	delete(m.vaults, key.ID())
+	return nil
+}
+
+func newToken() string {
+	return encoding.MustEncode(keys.RandBytes(32), encoding.Base62)
+}
+
+// checkSnapshot checks a snapshot is for an existing index and isn't older than
+// the current snapshot.
+func checkSnapshot(snapshot *client.Snapshot, current *client.Snapshot, last int64) error {
+	if snapshot == nil || len(snapshot.Data) == 0 {
+		return errors.Errorf("invalid snapshot")
+	}
+	if snapshot.Index <= 0 || snapshot.Index > last {
+		return errors.Errorf("invalid snapshot index")
+	}
+	if current != nil && snapshot.Index < current.Index {
+		return errors.Errorf("snapshot is older than current snapshot")
+	}
+	return nil
+}
+
+func sortStatus(sts []*client.RemoteStatus) {
+	sort.Slice(sts, func(i, j int) bool {
+		return sts[i].Timestamp > sts[j].Timestamp
+	})
+}
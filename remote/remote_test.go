@@ -0,0 +1,216 @@
+package remote_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMem(t *testing.T) {
+	mem := remote.NewMem()
+	mem.SetClock(tsutil.NewTestClock())
+	mem.SetLimit(10)
+	testRemote(t, mem)
+}
+
+func TestDir(t *testing.T) {
+	path := filepath.Join(os.TempDir(), keys.RandFileName())
+	defer func() { _ = os.RemoveAll(path) }()
+	dir, err := remote.NewDir(path)
+	require.NoError(t, err)
+	dir.SetClock(tsutil.NewTestClock())
+	dir.SetLimit(10)
+	testRemote(t, dir)
+}
+
+func TestDirConcurrentPost(t *testing.T) {
+	path := filepath.Join(os.TempDir(), keys.RandFileName())
+	defer func() { _ = os.RemoveAll(path) }()
+	ctx := context.TODO()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	vk := keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0))
+
+	dir, err := remote.NewDir(path)
+	require.NoError(t, err)
+	_, err = dir.Register(ctx, vk, alice)
+	require.NoError(t, err)
+
+	data := []*client.PushEvent{}
+	for i := 0; i < 20; i++ {
+		data = append(data, &client.PushEvent{ID: fmt.Sprintf("id%d", i), Data: []byte(fmt.Sprintf("msg%d", i))})
+	}
+
+	// Posting the same events at the same time adds each event once.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dir, err := remote.NewDir(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- dir.Post(ctx, vk, data)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	events, err := dir.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 20, len(events.Events))
+}
+
+func TestDirUnfinishedPost(t *testing.T) {
+	path := filepath.Join(os.TempDir(), keys.RandFileName())
+	defer func() { _ = os.RemoveAll(path) }()
+	ctx := context.TODO()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	vk := keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0))
+
+	dir, err := remote.NewDir(path)
+	require.NoError(t, err)
+	_, err = dir.Register(ctx, vk, alice)
+	require.NoError(t, err)
+
+	// Post that claimed the ID but didn't add the event
+	idPath := filepath.Join(path, vk.ID().String(), "ids", "id0")
+	err = ioutil.WriteFile(idPath, []byte{}, 0600)
+	require.NoError(t, err)
+
+	// Recent claim is left for the post that claimed it
+	err = dir.Post(ctx, vk, []*client.PushEvent{{ID: "id0", Data: []byte("msg0")}})
+	require.NoError(t, err)
+	events, err := dir.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(events.Events))
+
+	// Stale claim is taken over
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(idPath, old, old)
+	require.NoError(t, err)
+	err = dir.Post(ctx, vk, []*client.PushEvent{{ID: "id0", Data: []byte("msg0")}})
+	require.NoError(t, err)
+	events, err = dir.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events.Events))
+	require.Equal(t, "id0", events.Events[0].ID)
+
+	// Post that added the event but didn't record the index
+	err = ioutil.WriteFile(idPath, []byte{}, 0600)
+	require.NoError(t, err)
+	err = os.Chtimes(idPath, old, old)
+	require.NoError(t, err)
+	err = dir.Post(ctx, vk, []*client.PushEvent{{ID: "id0", Data: []byte("msg0")}})
+	require.NoError(t, err)
+	events, err = dir.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events.Events))
+}
+
+func testRemote(t *testing.T, rm client.Remote) {
+	var err error
+	ctx := context.TODO()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	vk := keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0))
+
+	vlt, err := rm.Get(ctx, vk)
+	require.NoError(t, err)
+	require.Nil(t, vlt)
+	events, err := rm.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Nil(t, events)
+	err = rm.Post(ctx, vk, []*client.PushEvent{{ID: "id0", Data: []byte("test")}})
+	require.EqualError(t, err, vk.ID().String()+" not found")
+
+	key, err := rm.Register(ctx, vk, alice)
+	require.NoError(t, err)
+	require.Equal(t, vk.ID(), key.ID)
+	token := key.ExtString("token")
+	require.NotEmpty(t, token)
+	_, err = rm.Register(ctx, vk, alice)
+	require.EqualError(t, err, "vault already exists")
+
+	vlt, err = rm.Get(ctx, vk)
+	require.NoError(t, err)
+	require.Equal(t, token, vlt.Token)
+
+	data := []*client.PushEvent{}
+	for i := 0; i < 15; i++ {
+		data = append(data, &client.PushEvent{ID: fmt.Sprintf("id%d", i), Data: []byte(fmt.Sprintf("msg%d", i))})
+	}
+	err = rm.Post(ctx, vk, data)
+	require.NoError(t, err)
+
+	// Post again (existing IDs are ignored)
+	err = rm.Post(ctx, vk, data[10:])
+	require.NoError(t, err)
+
+	events, err = rm.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(events.Events))
+	require.True(t, events.Truncated)
+	require.Equal(t, int64(10), events.Index)
+	require.Equal(t, []byte("msg0"), events.Events[0].Data)
+	require.Equal(t, "id0", events.Events[0].ID)
+	require.Equal(t, int64(1), events.Events[0].RemoteIndex)
+	require.Equal(t, vk.ID(), events.Events[0].VID)
+
+	events, err = rm.Events(ctx, vk, events.Index)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(events.Events))
+	require.False(t, events.Truncated)
+	require.Equal(t, int64(15), events.Index)
+	require.Equal(t, []byte("msg14"), events.Events[4].Data)
+
+	events, err = rm.Events(ctx, vk, events.Index)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(events.Events))
+
+	// Snapshots
+	snapshots := rm.(client.Snapshots)
+	snapshot, err := snapshots.Snapshot(ctx, vk)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+	err = snapshots.PutSnapshot(ctx, vk, &client.Snapshot{Index: 16, Data: []byte("snapshot")})
+	require.EqualError(t, err, "invalid snapshot index")
+	err = snapshots.PutSnapshot(ctx, vk, &client.Snapshot{Index: 10, Data: []byte("snapshot10")})
+	require.NoError(t, err)
+	snapshot, err = snapshots.Snapshot(ctx, vk)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), snapshot.Index)
+	require.Equal(t, []byte("snapshot10"), snapshot.Data)
+	err = snapshots.PutSnapshot(ctx, vk, &client.Snapshot{Index: 5, Data: []byte("snapshot5")})
+	require.EqualError(t, err, "snapshot is older than current snapshot")
+
+	status, err := rm.Status(ctx, []*client.Vault{{ID: vk.ID(), Token: token}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(status))
+	require.Equal(t, int64(15), status[0].Index)
+
+	_, err = rm.Status(ctx, []*client.Vault{{ID: vk.ID(), Token: "invalid"}})
+	require.EqualError(t, err, "invalid token")
+
+	err = rm.Delete(ctx, vk)
+	require.NoError(t, err)
+	vlt, err = rm.Get(ctx, vk)
+	require.NoError(t, err)
+	require.Nil(t, vlt)
+}
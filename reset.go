@@ -0,0 +1,164 @@
+package vault
+
+import (
+	"context"
+	"os"
+
+	"github.com/keys-pub/keys/api"
+	"github.com/pkg/errors"
+)
+
+// ResetOptions for Reset.
+type ResetOptions struct {
+	// DeleteRemote deletes the remote vault for the client key.
+	DeleteRemote bool
+}
+
+// ResetOption for Reset.
+type ResetOption func(*ResetOptions)
+
+// WithDeleteRemote deletes the remote vault on Reset.
+// Requires Unlock.
+func WithDeleteRemote() ResetOption {
+	return func(o *ResetOptions) {
+		o.DeleteRemote = true
+	}
+}
+
+// Reset vault.
+// Locks the vault, ends the session (see WithSession), overwrites and removes
+// the vault database and removes the auth methods for it (see
+// auth.DB.Clear).
+// If locked, the auth methods for the master key the vault was last unlocked
+// with are removed (see auth.DB.VaultKeyID), so you can reset if you lost
+// your password.
+// With WithDeleteRemote, the remote vault is deleted after the local reset.
+// Afterwards the vault status is SetupNeeded.
+func (v *Vault) Reset(ctx context.Context, opt ...ResetOption) error {
+	logger.Debugf("Reset...")
+	var opts ResetOptions
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	var ck *api.Key
+	if opts.DeleteRemote {
+		k, err := v.ClientKey()
+		if err != nil {
+			return err
+		}
+		if k == nil {
+			return errors.Errorf("no client key")
+		}
+		ck = k
+	}
+
+	locked, err := v.reset()
+	if locked {
+		v.notifyStatus(Locked)
+	}
+	if err != nil {
+		return err
+	}
+	v.notifyStatus(SetupNeeded)
+
+	if ck != nil {
+		if err := v.deleteRemote(ctx, ck); err != nil {
+			return err
+		}
+	}
+	logger.Debugf("Reset complete")
+	return nil
+}
+
+// reset locks and removes the vault database and auth methods.
+// Returns true if the vault was locked.
+func (v *Vault) reset() (bool, error) {
+	v.umtx.Lock()
+	defer v.umtx.Unlock()
+
+	var mkID []byte
+	if c := v.current(); c != nil {
+		mkID = c.mkID
+	} else if v.auth != nil {
+		id, err := v.auth.VaultKeyID(v.path)
+		if err != nil {
+			return false, err
+		}
+		mkID = id
+	}
+	locked, err := v.closeConn()
+	if err != nil {
+		return locked, errors.Wrapf(err, "failed to close db")
+	}
+	// Don't reset if another process has it unlocked.
+	lock, err := lockFile(lockPath(v.path), false)
+	if err != nil {
+		return locked, err
+	}
+	defer func() { _ = lock.release() }()
+
+	if err := v.EndSession(); err != nil {
+		return locked, errors.Wrapf(err, "failed to end session")
+	}
+
+	for _, path := range []string{v.path, v.path + "-wal", v.path + "-shm", v.path + "-journal"} {
+		if err := wipeFile(path); err != nil {
+			return locked, err
+		}
+	}
+
+	if v.auth != nil && mkID != nil {
+		if err := v.auth.Clear(mkID); err != nil {
+			return locked, errors.Wrapf(err, "failed to clear auth")
+		}
+		if err := v.auth.SetVaultKeyID(v.path, nil); err != nil {
+			return locked, err
+		}
+	}
+	return locked, nil
+}
+
+func (v *Vault) deleteRemote(ctx context.Context, ck *api.Key) error {
+	logger.Debugf("Deleting remote %s", ck.ID)
+	if err := v.remote.Delete(ctx, ck.AsEdX25519()); err != nil {
+		return errors.Wrapf(err, "failed to delete remote")
+	}
+	return nil
+}
+
+// wipeFile overwrites a file with zeros and removes it.
+// If the file doesn't exist, this is a no-op.
+func wipeFile(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0) // #nosec
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 4096)
+	for remaining := fi.Size(); remaining > 0; {
+		n := int64(len(zeros))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			_ = f.Close()
+			return errors.Wrapf(err, "failed to overwrite %s", path)
+		}
+		remaining -= n
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
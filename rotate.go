@@ -0,0 +1,125 @@
+package vault
+
+import (
+	"bytes"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault/auth"
+	"github.com/pkg/errors"
+)
+
+// RotateMasterKey changes the master key.
+// The vault database is rekeyed and the new master key is sealed for each auth
+// method (see auth.DB.StageRotation), so the old master key can't be used to
+// get the new one.
+//
+// Rotation doesn't change auth methods, so anyone who can authenticate with
+// one (for example if they know the password) can also unlock with the new
+// master key. Remove or change those auth methods (see RemoveAuth and
+// ChangePassword) before rotating.
+// The master key can't be rotated if it's derived from a FIDO2 resident key
+// (auth.ErrFIDO2ResidentKeyRotation), while that resident key is registered.
+//
+// If the rotation is interrupted after the database was rekeyed, it is
+// completed on the next unlock with an auth method (see Unlock).
+// Requires Unlock.
+func (v *Vault) RotateMasterKey(mk *[32]byte) (*[32]byte, error) {
+	newMK, err := v.rotate(mk)
+	if err != nil && err != ErrLocked && err != ErrReadOnly && v.current() == nil {
+		// Failed to re-open the database
+		v.notifyStatus(Locked)
+	}
+	return newMK, err
+}
+
+func (v *Vault) rotate(mk *[32]byte) (*[32]byte, error) {
+	logger.Debugf("Rotate master key...")
+	v.umtx.Lock()
+	defer v.umtx.Unlock()
+	if err := v.writable(); err != nil {
+		return nil, err
+	}
+	if mk == nil {
+		return nil, errors.Errorf("nil master key")
+	}
+	if !bytes.Equal(auth.MasterKeyID(mk), v.current().mkID) {
+		return nil, errors.Errorf("invalid master key")
+	}
+	newMK := keys.Rand32()
+
+	if v.auth != nil {
+		if err := v.auth.StageRotation(mk, newMK); err != nil {
+			return nil, errors.Wrapf(err, "failed to rotate master key")
+		}
+	}
+
+	// The vault stays unlocked (from the caller's view), so we close and open
+	// the database directly, without status notifications, and keep the file
+	// lock.
+	lock, err := v.closeDB()
+	if err != nil {
+		_ = lock.release()
+		return nil, errors.Wrapf(err, "failed to close db")
+	}
+	if err := rekeyDB(v.path, mk, newMK); err != nil {
+		if v.auth != nil {
+			if cerr := v.auth.CancelRotation(); cerr != nil {
+				logger.Warningf("Failed to cancel rotation: %v", cerr)
+			}
+		}
+		if _, _, uerr := v.openConn(mk, lock, false); uerr != nil {
+			logger.Warningf("Failed to unlock after failed rotation: %v", uerr)
+		}
+		return nil, errors.Wrapf(err, "failed to rotate master key")
+	}
+
+	if v.auth != nil {
+		if err := v.auth.CommitRotation(); err != nil {
+			_ = lock.release()
+			return nil, errors.Wrapf(err, "failed to rotate master key")
+		}
+	}
+
+	if _, _, err := v.openConn(newMK, lock, false); err != nil {
+		return nil, err
+	}
+	v.setSession(newMK)
+	logger.Debugf("Rotated master key")
+	return newMK, nil
+}
+
+// resumeRotation completes a master key rotation that was interrupted after
+// the vault database was rekeyed.
+// The new master key is only available if mk is from an auth method (see
+// auth.DB.PendingRotation), and if not resume, returns ErrRotationPending.
+// Returns nil if there is no rotation to resume.
+func (v *Vault) resumeRotation(mk *[32]byte, resume bool) (*sqlx.DB, *[32]byte, error) {
+	if v.auth == nil {
+		return nil, nil, nil
+	}
+	newMK, err := v.auth.PendingRotation(mk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if newMK == nil {
+		return nil, nil, nil
+	}
+	if !resume {
+		return nil, nil, ErrRotationPending
+	}
+	logger.Infof("Resuming master key rotation...")
+	db, err := openDB(v.path, newMK)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := initTables(db); err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	if err := v.auth.CommitRotation(); err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	return db, newMK, nil
+}
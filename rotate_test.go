@@ -0,0 +1,124 @@
+package vault_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateMasterKey(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	defer env.CloseFn()
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+	paperKey := keys.RandPhrase()
+	_, err = vlt.RegisterPaperKey(mk, paperKey)
+	require.NoError(t, err)
+	err = vlt.Config().Set("key1", "val1")
+	require.NoError(t, err)
+
+	_, err = vlt.RotateMasterKey(keys.Rand32())
+	require.Error(t, err)
+
+	newMK, err := vlt.RotateMasterKey(mk)
+	require.NoError(t, err)
+	require.NotEqual(t, mk, newMK)
+	require.Equal(t, vault.Unlocked, vlt.Status())
+	val, err := vlt.Config().String("key1")
+	require.NoError(t, err)
+	require.Equal(t, "val1", val)
+
+	// Old master key
+	err = vlt.Lock()
+	require.NoError(t, err)
+	err = vlt.Unlock(mk)
+	require.Error(t, err)
+
+	// Password
+	out, err := vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, newMK, out)
+	val, err = vlt.Config().String("key1")
+	require.NoError(t, err)
+	require.Equal(t, "val1", val)
+
+	// Paper key
+	err = vlt.Lock()
+	require.NoError(t, err)
+	out, err = vlt.UnlockWithPaperKey(paperKey)
+	require.NoError(t, err)
+	require.Equal(t, newMK, out)
+}
+
+func TestRotateMasterKeyResume(t *testing.T) {
+	var err error
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	defer func() { _ = os.Remove(path + ".lock") }()
+	authPath := testutil.Path()
+	defer func() { _ = os.Remove(authPath) }()
+	authDB, err := auth.NewDB(authPath)
+	require.NoError(t, err)
+	defer func() { _ = authDB.Close() }()
+
+	vlt, err := vault.New(path, authDB, vault.WithRemote(remote.NewMem()))
+	require.NoError(t, err)
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Config().Set("key1", "val1")
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	// Interrupted before the database was rekeyed
+	err = authDB.StageRotation(mk, keys.Rand32())
+	require.NoError(t, err)
+	err = vlt.Unlock(mk)
+	require.NoError(t, err)
+	pending, err := authDB.PendingRotation(mk)
+	require.NoError(t, err)
+	require.Nil(t, pending)
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	// Interrupted after the database was rekeyed
+	newMK := keys.Rand32()
+	err = authDB.StageRotation(mk, newMK)
+	require.NoError(t, err)
+	err = vault.RekeyDB(path, mk, newMK)
+	require.NoError(t, err)
+
+	// The old master key can't get the new master key
+	err = vlt.Unlock(mk)
+	require.Equal(t, vault.ErrRotationPending, err)
+	require.Equal(t, vault.Locked, vlt.Status())
+
+	out, err := vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	require.Equal(t, newMK, out)
+	val, err := vlt.Config().String("key1")
+	require.NoError(t, err)
+	require.Equal(t, "val1", val)
+	pending, err = authDB.PendingRotation(mk)
+	require.NoError(t, err)
+	require.Nil(t, pending)
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+	err = vlt.Unlock(mk)
+	require.Error(t, err)
+	err = vlt.Unlock(newMK)
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+}
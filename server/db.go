@@ -0,0 +1,194 @@
+package server
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/migrate"
+	"github.com/pkg/errors"
+
+	// For sqlite3 (we use sqlcipher driver because it would conflict with vault
+	// if we used regular sqlite driver).
+	_ "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+type account struct {
+	ID        keys.ID `db:"id"`
+	Email     string  `db:"email"`
+	Code      string  `db:"code"`
+	Verified  bool    `db:"verified"`
+	CreatedAt int64   `db:"createdAt"`
+	// CodeAt is when the code was sent.
+	CodeAt int64 `db:"codeAt"`
+	// Attempts is the number of failed attempts for the code.
+	Attempts int `db:"attempts"`
+}
+
+type vault struct {
+	ID        keys.ID `db:"id"`
+	Token     string  `db:"token"`
+	Account   keys.ID `db:"account"`
+	CreatedAt int64   `db:"createdAt"`
+}
+
+func openDB(path string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("sqlite3", path+"?"+migrate.TxLock)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open db")
+	}
+	if err := initTables(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrations for the server database, see migrate.Run.
+// Only add migrations to the end, and don't change existing migrations.
+var migrations = []migrate.Migration{
+	// 1: Initial tables
+	migrate.Exec(
+		`CREATE TABLE IF NOT EXISTS accounts (
+			id TEXT PRIMARY KEY NOT NULL,
+			email TEXT NOT NULL,
+			code TEXT NOT NULL,
+			verified BOOL NOT NULL,
+			createdAt INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS vaults (
+			id TEXT PRIMARY KEY NOT NULL,
+			token TEXT NOT NULL,
+			account TEXT NOT NULL,
+			createdAt INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS events (
+			vid TEXT NOT NULL,
+			idx INTEGER NOT NULL,
+			id TEXT NOT NULL DEFAULT '',
+			data BLOB NOT NULL,
+			ts INTEGER NOT NULL,
+			PRIMARY KEY (vid, idx)
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS events_id ON events (vid, id) WHERE id != '';`,
+		`CREATE TABLE IF NOT EXISTS snapshots (
+			vid TEXT PRIMARY KEY NOT NULL,
+			idx INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			ts INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS nonces (
+			nonce TEXT PRIMARY KEY NOT NULL,
+			ts INTEGER NOT NULL
+		);`,
+	),
+	// 2: Verify code expiry and failed attempts
+	migrate.Steps(
+		migrate.AddColumn("accounts", "codeAt", "INTEGER NOT NULL DEFAULT 0"),
+		migrate.AddColumn("accounts", "attempts", "INTEGER NOT NULL DEFAULT 0"),
+		migrate.Exec(`UPDATE accounts SET codeAt = createdAt;`),
+	),
+	// 3: IDs of compacted events (for dedupe)
+	migrate.Exec(
+		`CREATE TABLE IF NOT EXISTS compacted (
+			vid TEXT NOT NULL,
+			id TEXT NOT NULL,
+			PRIMARY KEY (vid, id)
+		);`,
+	),
+}
+
+func initTables(db *sqlx.DB) error {
+	return migrate.Run(db, migrations)
+}
+
+func getAccount(db *sqlx.DB, aid keys.ID) (*account, error) {
+	var acct account
+	if err := db.Get(&acct, "SELECT * FROM accounts WHERE id = $1", aid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &acct, nil
+}
+
+func getVault(db *sqlx.DB, vid keys.ID) (*vault, error) {
+	var vlt vault
+	if err := db.Get(&vlt, "SELECT * FROM vaults WHERE id = $1", vid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &vlt, nil
+}
+
+// listEvents returns events after index (up to limit) and if there are more
+// events.
+func listEvents(db *sqlx.DB, vid keys.ID, index int64, limit int) ([]*client.RemoteEvent, bool, error) {
+	var rows []*struct {
+		ID        string `db:"id"`
+		Data      []byte `db:"data"`
+		Index     int64  `db:"idx"`
+		Timestamp int64  `db:"ts"`
+	}
+	if err := db.Select(&rows, "SELECT id, data, idx, ts FROM events WHERE vid = $1 AND idx > $2 ORDER BY idx LIMIT $3", vid, index, limit+1); err != nil {
+		return nil, false, err
+	}
+	truncated := false
+	if len(rows) > limit {
+		rows = rows[:limit]
+		truncated = true
+	}
+	out := make([]*client.RemoteEvent, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, &client.RemoteEvent{ID: r.ID, Data: r.Data, Index: r.Index, Timestamp: r.Timestamp})
+	}
+	return out, truncated, nil
+}
+
+// lastEvent returns the last index and timestamp for a vault.
+func lastEvent(db *sqlx.DB, vid keys.ID) (int64, int64, error) {
+	var last struct {
+		Index     sql.NullInt64 `db:"idx"`
+		Timestamp sql.NullInt64 `db:"ts"`
+	}
+	if err := db.Get(&last, "SELECT idx, ts FROM events WHERE vid = $1 ORDER BY idx DESC LIMIT 1", vid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	return last.Index.Int64, last.Timestamp.Int64, nil
+}
+
+// addEventsTx adds events, skipping events with an ID the vault already has
+// (including compacted events).
+func addEventsTx(tx *sqlx.Tx, vid keys.ID, evs []*client.PushEvent, ts int64) error {
+	var last sql.NullInt64
+	if err := tx.Get(&last, "SELECT MAX(idx) FROM events WHERE vid = $1", vid); err != nil {
+		return err
+	}
+	index := last.Int64
+	for _, e := range evs {
+		if e.ID != "" {
+			var count int
+			if err := tx.Get(&count, `SELECT
+				(SELECT COUNT(*) FROM events WHERE vid = $1 AND id = $2) +
+				(SELECT COUNT(*) FROM compacted WHERE vid = $1 AND id = $2)`, vid, e.ID); err != nil {
+				return err
+			}
+			if count > 0 {
+				logger.Debugf("Skipping existing event %s", e.ID)
+				continue
+			}
+		}
+		index++
+		if _, err := tx.Exec("INSERT INTO events (vid, idx, id, data, ts) VALUES ($1, $2, $3, $4, $5)", vid, index, e.ID, e.Data, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package server
+
+import "github.com/keys-pub/keys/tsutil"
+
+// Options for Server.
+type Options struct {
+	Clock   tsutil.Clock
+	Emailer Emailer
+	// Limit is the max number of events returned from a request.
+	Limit int
+	// Compact removes events covered by a snapshot.
+	Compact bool
+}
+
+// Option for Server.
+type Option func(*Options)
+
+func newOptions(opts ...Option) *Options {
+	options := &Options{
+		Clock: tsutil.NewClock(),
+		Limit: 1000,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+	return options
+}
+
+// WithClock ...
+func WithClock(clock tsutil.Clock) Option {
+	return func(o *Options) {
+		o.Clock = clock
+	}
+}
+
+// WithEmailer ...
+func WithEmailer(emailer Emailer) Option {
+	return func(o *Options) {
+		o.Emailer = emailer
+	}
+}
+
+// WithLimit sets the max number of events returned from a request.
+func WithLimit(limit int) Option {
+	return func(o *Options) {
+		o.Limit = limit
+	}
+}
+
+// WithCompaction removes events covered by a snapshot when a snapshot is
+// stored.
+// Clients that don't support snapshots won't be able to pull the removed
+// events.
+func WithCompaction() Option {
+	return func(o *Options) {
+		o.Compact = true
+	}
+}
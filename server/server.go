@@ -0,0 +1,582 @@
+// Package server is a reference (self-hostable) vault server, implementing the
+// HTTP API used by client.Client.
+//
+// Requests for a vault (or account) are signed by the vault (or account) key,
+// see github.com/keys-pub/keys/http.
+//
+//	PUT /account/{aid}                 Create account (JSON {email}), or send a new code if not verified.
+//	POST /account/{aid}/verify-email   Verify account email (JSON {code}).
+//	PUT /vault/{vid}                   Register vault (signed by account).
+//	GET /vault/{vid}                   Get vault (JSON {id, token, ts}).
+//	DELETE /vault/{vid}                Delete vault.
+//	GET /vault/{vid}/events?idx=N      Events after index (msgpack {vault, idx, trunc}).
+//	POST /vault/{vid}/events           Add events (msgpack [{id, dat}]), ignoring existing IDs.
+//	GET /vault/{vid}/snapshot          Latest snapshot (msgpack {idx, dat, ts}).
+//	PUT /vault/{vid}/snapshot          Store snapshot (msgpack {idx, dat}).
+//	POST /vaults/status                Status for vaults (JSON {vaults: {vid: token}}).
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	khttp "github.com/keys-pub/keys/http"
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Max request body size.
+const maxBody = 16 * 1024 * 1024
+
+// Verify code expiry and max failed attempts, after which a new code is needed
+// (PUT /account/{aid}).
+const (
+	verifyCodeExpiry   = 15 * time.Minute
+	verifyCodeAttempts = 5
+)
+
+// Emailer sends emails.
+type Emailer interface {
+	SendVerificationEmail(email string, code string) error
+}
+
+// Server for vaults.
+type Server struct {
+	db      *sqlx.DB
+	clock   tsutil.Clock
+	emailer Emailer
+	limit   int
+	compact bool
+
+	// URL (base) for the server, used to verify request signatures.
+	URL string
+}
+
+// New creates a Server with a sqlite database at path.
+func New(path string, opt ...Option) (*Server, error) {
+	opts := newOptions(opt...)
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		db:      db,
+		clock:   opts.Clock,
+		emailer: opts.Emailer,
+		limit:   opts.Limit,
+		compact: opts.Compact,
+	}, nil
+}
+
+// Close server db.
+func (s *Server) Close() error {
+	return s.db.Close()
+}
+
+// errHTTP is an error with a HTTP status.
+type errHTTP struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e errHTTP) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+func newErrHTTP(code int, msg string) errHTTP {
+	return errHTTP{Code: code, Message: msg}
+}
+
+var errNotFound = newErrHTTP(http.StatusNotFound, "not found")
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("%s %s", r.Method, r.URL.Path)
+	if err := s.route(w, r); err != nil {
+		writeErr(w, err)
+	}
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) error {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "account":
+		aid, err := keys.ParseID(parts[1])
+		if err != nil {
+			return newErrHTTP(http.StatusBadRequest, "invalid account id")
+		}
+		if r.Method == http.MethodPut {
+			return s.putAccount(w, r, aid)
+		}
+	case len(parts) == 3 && parts[0] == "account" && parts[2] == "verify-email":
+		aid, err := keys.ParseID(parts[1])
+		if err != nil {
+			return newErrHTTP(http.StatusBadRequest, "invalid account id")
+		}
+		if r.Method == http.MethodPost {
+			return s.postAccountVerify(w, r, aid)
+		}
+	case len(parts) == 2 && parts[0] == "vault":
+		vid, err := keys.ParseID(parts[1])
+		if err != nil {
+			return newErrHTTP(http.StatusBadRequest, "invalid vault id")
+		}
+		switch r.Method {
+		case http.MethodPut:
+			return s.putVault(w, r, vid)
+		case http.MethodGet:
+			return s.getVault(w, r, vid)
+		case http.MethodDelete:
+			return s.deleteVault(w, r, vid)
+		}
+	case len(parts) == 3 && parts[0] == "vault" && parts[2] == "events":
+		vid, err := keys.ParseID(parts[1])
+		if err != nil {
+			return newErrHTTP(http.StatusBadRequest, "invalid vault id")
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return s.getEvents(w, r, vid)
+		case http.MethodPost:
+			return s.postEvents(w, r, vid)
+		}
+	case len(parts) == 3 && parts[0] == "vault" && parts[2] == "snapshot":
+		vid, err := keys.ParseID(parts[1])
+		if err != nil {
+			return newErrHTTP(http.StatusBadRequest, "invalid vault id")
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return s.getSnapshot(w, r, vid)
+		case http.MethodPut:
+			return s.putSnapshot(w, r, vid)
+		}
+	case len(parts) == 2 && parts[0] == "vaults" && parts[1] == "status":
+		if r.Method == http.MethodPost {
+			return s.postStatus(w, r)
+		}
+	default:
+		return errNotFound
+	}
+	return newErrHTTP(http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// auth checks the request is signed by the key with kid.
+func (s *Server) auth(r *http.Request, body []byte, kid keys.ID) error {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return newErrHTTP(http.StatusUnauthorized, "missing auth")
+	}
+	urs, err := url.Parse(s.URL + r.URL.String())
+	if err != nil {
+		return err
+	}
+	res, err := khttp.Authorize(r.Context(), &khttp.Auth{
+		Method:      r.Method,
+		URL:         urs,
+		ContentHash: khttp.ContentHash(body),
+		Header:      header,
+		Now:         s.clock.Now(),
+		NonceCheck:  s.checkNonce,
+	})
+	if err != nil {
+		logger.Infof("Auth failed: %v", err)
+		return newErrHTTP(http.StatusForbidden, "invalid auth")
+	}
+	if res.KID != kid {
+		return newErrHTTP(http.StatusForbidden, "invalid auth key")
+	}
+	return nil
+}
+
+// checkNonce fails if the nonce was used recently.
+func (s *Server) checkNonce(ctx context.Context, nonce string) error {
+	now := s.clock.NowMillis()
+	// Signed requests are only valid for 30 minutes, so we can forget older
+	// nonces.
+	if _, err := s.db.Exec("DELETE FROM nonces WHERE ts < $1", now-60*60*1000); err != nil {
+		return err
+	}
+	res, err := s.db.Exec("INSERT OR IGNORE INTO nonces (nonce, ts) VALUES ($1, $2)", nonce, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.Errorf("nonce collision")
+	}
+	return nil
+}
+
+type accountCreateRequest struct {
+	Email string `json:"email"`
+}
+
+func (s *Server) putAccount(w http.ResponseWriter, r *http.Request, aid keys.ID) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if err := s.auth(r, body, aid); err != nil {
+		return err
+	}
+	var req accountCreateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return newErrHTTP(http.StatusBadRequest, "invalid request")
+	}
+	if req.Email == "" {
+		return newErrHTTP(http.StatusBadRequest, "no email")
+	}
+	acct, err := getAccount(s.db, aid)
+	if err != nil {
+		return err
+	}
+	code := verifyCode()
+	now := s.clock.NowMillis()
+	switch {
+	case acct == nil:
+		if _, err := s.db.Exec("INSERT INTO accounts (id, email, code, verified, createdAt, codeAt, attempts) VALUES ($1, $2, $3, $4, $5, $6, 0)",
+			aid, req.Email, code, false, now, now); err != nil {
+			return err
+		}
+	case !acct.Verified:
+		// New code
+		if _, err := s.db.Exec("UPDATE accounts SET email = $1, code = $2, codeAt = $3, attempts = 0 WHERE id = $4",
+			req.Email, code, now, aid); err != nil {
+			return err
+		}
+	default:
+		return newErrHTTP(http.StatusConflict, "account already exists")
+	}
+	if s.emailer != nil {
+		if err := s.emailer.SendVerificationEmail(req.Email, code); err != nil {
+			return err
+		}
+	} else {
+		logger.Warningf("No emailer, verification code for %s: %s", req.Email, code)
+	}
+	return writeJSON(w, struct{}{})
+}
+
+type accountVerifyEmailRequest struct {
+	Code string `json:"code"`
+}
+
+func (s *Server) postAccountVerify(w http.ResponseWriter, r *http.Request, aid keys.ID) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if err := s.auth(r, body, aid); err != nil {
+		return err
+	}
+	var req accountVerifyEmailRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return newErrHTTP(http.StatusBadRequest, "invalid request")
+	}
+	acct, err := getAccount(s.db, aid)
+	if err != nil {
+		return err
+	}
+	if acct == nil {
+		return errNotFound
+	}
+	if acct.Verified {
+		return writeJSON(w, struct{}{})
+	}
+	if acct.Attempts >= verifyCodeAttempts {
+		return newErrHTTP(http.StatusTooManyRequests, "too many attempts (request a new code)")
+	}
+	if s.clock.NowMillis()-acct.CodeAt > int64(verifyCodeExpiry/time.Millisecond) {
+		return newErrHTTP(http.StatusForbidden, "code expired (request a new code)")
+	}
+	if req.Code == "" || subtle.ConstantTimeCompare([]byte(req.Code), []byte(acct.Code)) != 1 {
+		if _, err := s.db.Exec("UPDATE accounts SET attempts = attempts + 1 WHERE id = $1", aid); err != nil {
+			return err
+		}
+		return newErrHTTP(http.StatusForbidden, "invalid code")
+	}
+	if _, err := s.db.Exec("UPDATE accounts SET verified = $1, code = '' WHERE id = $2", true, aid); err != nil {
+		return err
+	}
+	return writeJSON(w, struct{}{})
+}
+
+// putVault registers a vault.
+// The request is signed by the account key.
+func (s *Server) putVault(w http.ResponseWriter, r *http.Request, vid keys.ID) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	aid, err := authKID(r)
+	if err != nil {
+		return err
+	}
+	if err := s.auth(r, body, aid); err != nil {
+		return err
+	}
+	acct, err := getAccount(s.db, aid)
+	if err != nil {
+		return err
+	}
+	if acct == nil {
+		return newErrHTTP(http.StatusForbidden, "no account")
+	}
+	if !acct.Verified {
+		return newErrHTTP(http.StatusForbidden, "account email not verified")
+	}
+	existing, err := getVault(s.db, vid)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return newErrHTTP(http.StatusConflict, "vault already exists")
+	}
+	vlt := &vault{
+		ID:        vid,
+		Token:     newToken(),
+		Account:   aid,
+		CreatedAt: s.clock.NowMillis(),
+	}
+	if _, err := s.db.NamedExec("INSERT INTO vaults (id, token, account, createdAt) VALUES (:id, :token, :account, :createdAt)", vlt); err != nil {
+		return err
+	}
+	return writeJSON(w, &client.Vault{ID: vlt.ID, Token: vlt.Token, Timestamp: vlt.CreatedAt})
+}
+
+// vault returns an existing vault for an (authorized) request.
+func (s *Server) vault(r *http.Request, body []byte, vid keys.ID) (*vault, error) {
+	if err := s.auth(r, body, vid); err != nil {
+		return nil, err
+	}
+	vlt, err := getVault(s.db, vid)
+	if err != nil {
+		return nil, err
+	}
+	if vlt == nil {
+		return nil, errNotFound
+	}
+	return vlt, nil
+}
+
+func (s *Server) getVault(w http.ResponseWriter, r *http.Request, vid keys.ID) error {
+	vlt, err := s.vault(r, nil, vid)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &client.Vault{ID: vlt.ID, Token: vlt.Token, Timestamp: vlt.CreatedAt})
+}
+
+func (s *Server) deleteVault(w http.ResponseWriter, r *http.Request, vid keys.ID) error {
+	if _, err := s.vault(r, nil, vid); err != nil {
+		return err
+	}
+	if err := syncer.Transact(s.db, func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec("DELETE FROM events WHERE vid = $1", vid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM compacted WHERE vid = $1", vid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM snapshots WHERE vid = $1", vid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM vaults WHERE id = $1", vid); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return writeJSON(w, struct{}{})
+}
+
+type eventsResponse struct {
+	Vault     []*client.RemoteEvent `json:"vault" msgpack:"vault"`
+	Index     int64                 `json:"idx" msgpack:"idx"`
+	Truncated bool                  `json:"truncated,omitempty" msgpack:"trunc,omitempty"`
+}
+
+func (s *Server) getEvents(w http.ResponseWriter, r *http.Request, vid keys.ID) error {
+	if _, err := s.vault(r, nil, vid); err != nil {
+		return err
+	}
+	index := int64(0)
+	if idx := r.URL.Query().Get("idx"); idx != "" {
+		i, err := strconv.ParseInt(idx, 10, 64)
+		if err != nil {
+			return newErrHTTP(http.StatusBadRequest, "invalid index")
+		}
+		index = i
+	}
+	evs, truncated, err := listEvents(s.db, vid, index, s.limit)
+	if err != nil {
+		return err
+	}
+	if len(evs) > 0 {
+		index = evs[len(evs)-1].Index
+	}
+	return writeMsgpack(w, &eventsResponse{Vault: evs, Index: index, Truncated: truncated})
+}
+
+func (s *Server) postEvents(w http.ResponseWriter, r *http.Request, vid keys.ID) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.vault(r, body, vid); err != nil {
+		return err
+	}
+	evs, err := unmarshalPush(body)
+	if err != nil {
+		return newErrHTTP(http.StatusBadRequest, "invalid request")
+	}
+	ts := s.clock.NowMillis()
+	if err := syncer.Transact(s.db, func(tx *sqlx.Tx) error {
+		return addEventsTx(tx, vid, evs, ts)
+	}); err != nil {
+		return err
+	}
+	return writeJSON(w, struct{}{})
+}
+
+// unmarshalPush decodes events to add, also accepting events without IDs
+// (msgpack [][]byte) from older clients.
+func unmarshalPush(b []byte) ([]*client.PushEvent, error) {
+	var evs []*client.PushEvent
+	if err := msgpack.Unmarshal(b, &evs); err == nil {
+		return evs, nil
+	}
+	var data [][]byte
+	if err := msgpack.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	evs = make([]*client.PushEvent, 0, len(data))
+	for _, d := range data {
+		evs = append(evs, &client.PushEvent{Data: d})
+	}
+	return evs, nil
+}
+
+type statusRequest struct {
+	Vaults map[keys.ID]string `json:"vaults,omitempty" msgpack:"vaults,omitempty"`
+}
+
+type statusResponse struct {
+	Vaults []*client.RemoteStatus `json:"vaults,omitempty" msgpack:"vaults,omitempty"`
+}
+
+// postStatus returns status for vaults.
+// Vaults are authorized by token, unknown vaults are skipped.
+func (s *Server) postStatus(w http.ResponseWriter, r *http.Request) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	var req statusRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return newErrHTTP(http.StatusBadRequest, "invalid request")
+	}
+	out := []*client.RemoteStatus{}
+	for vid, token := range req.Vaults {
+		vlt, err := getVault(s.db, vid)
+		if err != nil {
+			return err
+		}
+		if vlt == nil {
+			continue
+		}
+		if vlt.Token != token {
+			return newErrHTTP(http.StatusForbidden, "invalid token")
+		}
+		index, ts, err := lastEvent(s.db, vid)
+		if err != nil {
+			return err
+		}
+		if ts == 0 {
+			ts = vlt.CreatedAt
+		}
+		out = append(out, &client.RemoteStatus{ID: vid, Index: index, Timestamp: ts})
+	}
+	return writeJSON(w, &statusResponse{Vaults: out})
+}
+
+// authKID returns the key ID from the (unverified) auth header.
+func authKID(r *http.Request) (keys.ID, error) {
+	header := r.Header.Get("Authorization")
+	strs := strings.Split(header, ":")
+	if len(strs) != 2 {
+		return "", newErrHTTP(http.StatusUnauthorized, "invalid auth")
+	}
+	kid, err := keys.ParseID(strs[0])
+	if err != nil {
+		return "", newErrHTTP(http.StatusUnauthorized, "invalid auth")
+	}
+	return kid, nil
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return []byte{}, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxBody {
+		return nil, newErrHTTP(http.StatusRequestEntityTooLarge, "request too large")
+	}
+	return b, nil
+}
+
+func writeJSON(w http.ResponseWriter, i interface{}) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return err
+}
+
+func writeMsgpack(w http.ResponseWriter, i interface{}) error {
+	b, err := msgpack.Marshal(i)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-msgpack")
+	_, err = w.Write(b)
+	return err
+}
+
+func writeErr(w http.ResponseWriter, err error) {
+	var herr errHTTP
+	if !errors.As(err, &herr) {
+		logger.Errorf("Error: %v", err)
+		herr = newErrHTTP(http.StatusInternalServerError, "internal error")
+	}
+	b, _ := json.Marshal(struct {
+		Error errHTTP `json:"error"`
+	}{herr})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(herr.Code)
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,297 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/keys/tsutil"
+	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/server"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+type testEmailer struct {
+	codes map[string]string
+}
+
+func (t *testEmailer) SendVerificationEmail(email string, code string) error {
+	t.codes[email] = code
+	return nil
+}
+
+func testServer(t *testing.T, opt ...server.Option) (*client.Client, *testEmailer, func()) {
+	clock := tsutil.NewTestClock()
+	path := testutil.Path()
+	emailer := &testEmailer{codes: map[string]string{}}
+	opt = append([]server.Option{server.WithClock(clock), server.WithEmailer(emailer), server.WithLimit(10)}, opt...)
+	srv, err := server.New(path, opt...)
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(srv)
+	srv.URL = httpServer.URL
+
+	cl, err := client.New(httpServer.URL)
+	require.NoError(t, err)
+	cl.SetHTTPClient(httpServer.Client())
+	cl.SetClock(clock)
+
+	closeFn := func() {
+		httpServer.Close()
+		_ = srv.Close()
+		_ = os.Remove(path)
+	}
+	return cl, emailer, closeFn
+}
+
+func TestServer(t *testing.T) {
+	var err error
+	cl, emailer, closeFn := testServer(t)
+	defer closeFn()
+	ctx := context.TODO()
+
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	vk := keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0))
+
+	// Register without account
+	_, err = cl.Register(ctx, vk, alice)
+	require.Error(t, err)
+
+	err = cl.AccountCreate(ctx, alice, "alice@example.com")
+	require.NoError(t, err)
+	code := emailer.codes["alice@example.com"]
+	require.NotEmpty(t, code)
+
+	// Register without verified email
+	_, err = cl.Register(ctx, vk, alice)
+	require.Error(t, err)
+
+	err = cl.AccountVerify(ctx, alice, "000000x")
+	require.Error(t, err)
+	err = cl.AccountVerify(ctx, alice, code)
+	require.NoError(t, err)
+
+	vlt, err := cl.Get(ctx, vk)
+	require.NoError(t, err)
+	require.Nil(t, vlt)
+
+	key, err := cl.Register(ctx, vk, alice)
+	require.NoError(t, err)
+	token := key.ExtString("token")
+	require.NotEmpty(t, token)
+
+	vlt, err = cl.Get(ctx, vk)
+	require.NoError(t, err)
+	require.Equal(t, token, vlt.Token)
+
+	data := []*client.PushEvent{}
+	for i := 0; i < 15; i++ {
+		data = append(data, &client.PushEvent{ID: fmt.Sprintf("id%d", i), Data: []byte(fmt.Sprintf("msg%d", i))})
+	}
+	err = cl.Post(ctx, vk, data)
+	require.NoError(t, err)
+
+	// Post again (existing IDs are ignored)
+	err = cl.Post(ctx, vk, data[10:])
+	require.NoError(t, err)
+
+	events, err := cl.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(events.Events))
+	require.True(t, events.Truncated)
+	require.Equal(t, int64(10), events.Index)
+	require.Equal(t, []byte("msg0"), events.Events[0].Data)
+	require.Equal(t, "id0", events.Events[0].ID)
+
+	events, err = cl.Events(ctx, vk, events.Index)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(events.Events))
+	require.False(t, events.Truncated)
+	require.Equal(t, int64(15), events.Index)
+
+	snapshot, err := cl.Snapshot(ctx, vk)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+	err = cl.PutSnapshot(ctx, vk, &client.Snapshot{Index: 16, Data: []byte("snapshot")})
+	require.Error(t, err)
+	err = cl.PutSnapshot(ctx, vk, &client.Snapshot{Index: 10, Data: []byte("snapshot10")})
+	require.NoError(t, err)
+	snapshot, err = cl.Snapshot(ctx, vk)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), snapshot.Index)
+	require.Equal(t, []byte("snapshot10"), snapshot.Data)
+	err = cl.PutSnapshot(ctx, vk, &client.Snapshot{Index: 5, Data: []byte("snapshot5")})
+	require.Error(t, err)
+
+	status, err := cl.Status(ctx, []*client.Vault{{ID: vk.ID(), Token: token}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(status))
+	require.Equal(t, int64(15), status[0].Index)
+
+	_, err = cl.Status(ctx, []*client.Vault{{ID: vk.ID(), Token: "invalid"}})
+	require.Error(t, err)
+
+	// Wrong key
+	other := keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa1))
+	err = cl.Post(ctx, other, data)
+	require.Error(t, err)
+
+	err = cl.Delete(ctx, vk)
+	require.NoError(t, err)
+	vlt, err = cl.Get(ctx, vk)
+	require.NoError(t, err)
+	require.Nil(t, vlt)
+}
+
+func TestAccountVerifyAttempts(t *testing.T) {
+	var err error
+	cl, emailer, closeFn := testServer(t)
+	defer closeFn()
+	ctx := context.TODO()
+
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	err = cl.AccountCreate(ctx, alice, "alice@example.com")
+	require.NoError(t, err)
+	code := emailer.codes["alice@example.com"]
+
+	for i := 0; i < 5; i++ {
+		err = cl.AccountVerify(ctx, alice, "invalid")
+		require.Error(t, err)
+	}
+	// Locked out, even with the right code
+	err = cl.AccountVerify(ctx, alice, code)
+	require.Error(t, err)
+
+	// New code
+	err = cl.AccountCreate(ctx, alice, "alice@example.com")
+	require.NoError(t, err)
+	err = cl.AccountVerify(ctx, alice, emailer.codes["alice@example.com"])
+	require.NoError(t, err)
+
+	err = cl.AccountCreate(ctx, alice, "alice@example.com")
+	require.Error(t, err)
+}
+
+func TestServerSync(t *testing.T) {
+	var err error
+	cl, emailer, closeFn := testServer(t)
+	defer closeFn()
+	ctx := context.TODO()
+
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	err = cl.AccountCreate(ctx, alice, "alice@example.com")
+	require.NoError(t, err)
+	err = cl.AccountVerify(ctx, alice, emailer.codes["alice@example.com"])
+	require.NoError(t, err)
+	ck, err := cl.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+
+	v1, closeFn1 := testutil.NewTestVaultWithRemote(t, cl, "testpassword1", ck)
+	defer closeFn1()
+	v2, closeFn2 := testutil.NewTestVaultWithRemote(t, cl, "testpassword2", ck)
+	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
+
+	for i := 0; i < 25; i++ {
+		err = v1.Keyring().Set(api.NewKey(keys.GenerateEdX25519Key()).WithLabels("test"))
+		require.NoError(t, err)
+	}
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err := v2.Keyring().KeysWithLabel("test")
+	require.NoError(t, err)
+	require.Equal(t, 25, len(out))
+}
+
+func TestServerCompaction(t *testing.T) {
+	var err error
+	cl, emailer, closeFn := testServer(t, server.WithCompaction())
+	defer closeFn()
+	ctx := context.TODO()
+
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	vk := keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0))
+	err = cl.AccountCreate(ctx, alice, "alice@example.com")
+	require.NoError(t, err)
+	err = cl.AccountVerify(ctx, alice, emailer.codes["alice@example.com"])
+	require.NoError(t, err)
+	_, err = cl.Register(ctx, vk, alice)
+	require.NoError(t, err)
+
+	data := []*client.PushEvent{}
+	for i := 0; i < 5; i++ {
+		data = append(data, &client.PushEvent{ID: fmt.Sprintf("id%d", i), Data: []byte(fmt.Sprintf("msg%d", i))})
+	}
+	err = cl.Post(ctx, vk, data)
+	require.NoError(t, err)
+
+	// Snapshot at last event, keeps last event
+	err = cl.PutSnapshot(ctx, vk, &client.Snapshot{Index: 5, Data: []byte("snapshot5")})
+	require.NoError(t, err)
+	events, err := cl.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events.Events))
+	require.Equal(t, int64(5), events.Events[0].RemoteIndex)
+
+	// Next index continues
+	err = cl.Post(ctx, vk, []*client.PushEvent{{ID: "id5", Data: []byte("msg5")}})
+	require.NoError(t, err)
+	events, err = cl.Events(ctx, vk, 5)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events.Events))
+	require.Equal(t, int64(6), events.Events[0].RemoteIndex)
+
+	// Retry of compacted events isn't added again
+	err = cl.Post(ctx, vk, data)
+	require.NoError(t, err)
+	events, err = cl.Events(ctx, vk, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(events.Events))
+	require.Equal(t, int64(6), events.Events[1].RemoteIndex)
+}
+
+func TestPostLegacy(t *testing.T) {
+	testPostLegacy(t, http.StatusBadRequest)
+	testPostLegacy(t, http.StatusInternalServerError)
+}
+
+func testPostLegacy(t *testing.T, status int) {
+	var err error
+	ctx := context.TODO()
+
+	// Remote that only accepts events without IDs (msgpack [][]byte).
+	posts := [][][]byte{}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var data [][]byte
+		if err := msgpack.Unmarshal(b, &data); err != nil {
+			http.Error(w, "invalid request", status)
+			return
+		}
+		posts = append(posts, data)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer httpServer.Close()
+
+	cl, err := client.New(httpServer.URL)
+	require.NoError(t, err)
+	cl.SetHTTPClient(httpServer.Client())
+
+	key := keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0))
+	err = cl.Post(ctx, key, []*client.PushEvent{{ID: "1", Data: []byte("a")}})
+	require.NoError(t, err)
+	err = cl.Post(ctx, key, []*client.PushEvent{{ID: "2", Data: []byte("b")}})
+	require.NoError(t, err)
+	require.Equal(t, [][][]byte{{[]byte("a")}, {[]byte("b")}}, posts)
+}
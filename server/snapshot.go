@@ -0,0 +1,104 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func getSnapshot(db *sqlx.DB, vid keys.ID) (*client.Snapshot, error) {
+	var snapshot client.Snapshot
+	if err := db.Get(&snapshot, "SELECT idx, data, ts FROM snapshots WHERE vid = $1", vid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (s *Server) getSnapshot(w http.ResponseWriter, r *http.Request, vid keys.ID) error {
+	if _, err := s.vault(r, nil, vid); err != nil {
+		return err
+	}
+	snapshot, err := getSnapshot(s.db, vid)
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return errNotFound
+	}
+	return writeMsgpack(w, snapshot)
+}
+
+func (s *Server) putSnapshot(w http.ResponseWriter, r *http.Request, vid keys.ID) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.vault(r, body, vid); err != nil {
+		return err
+	}
+	var snapshot client.Snapshot
+	if err := msgpack.Unmarshal(body, &snapshot); err != nil || len(snapshot.Data) == 0 {
+		return newErrHTTP(http.StatusBadRequest, "invalid snapshot")
+	}
+	last, _, err := lastEvent(s.db, vid)
+	if err != nil {
+		return err
+	}
+	if snapshot.Index <= 0 || snapshot.Index > last {
+		return newErrHTTP(http.StatusBadRequest, "invalid snapshot index")
+	}
+	current, err := getSnapshot(s.db, vid)
+	if err != nil {
+		return err
+	}
+	if current != nil && snapshot.Index < current.Index {
+		return newErrHTTP(http.StatusConflict, "snapshot is older than current snapshot")
+	}
+
+	ts := s.clock.NowMillis()
+	if err := syncer.Transact(s.db, func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO snapshots (vid, idx, data, ts) VALUES ($1, $2, $3, $4)",
+			vid, snapshot.Index, snapshot.Data, ts); err != nil {
+			return err
+		}
+		if s.compact {
+			return compactTx(tx, vid, snapshot.Index)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return writeJSON(w, struct{}{})
+}
+
+// compactTx removes events covered by a snapshot at index.
+// The last event is kept, for the next index and status.
+// The IDs of removed events are kept in compacted, so a retried post of a
+// compacted event isn't added again.
+func compactTx(tx *sqlx.Tx, vid keys.ID, index int64) error {
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO compacted (vid, id)
+		SELECT vid, id FROM events WHERE vid = $1 AND idx <= $2 AND id != '' AND
+		idx < (SELECT MAX(idx) FROM events WHERE vid = $1)`, vid, index); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM events WHERE vid = $1 AND idx <= $2 AND
+		idx < (SELECT MAX(idx) FROM events WHERE vid = $1)`, vid, index)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	logger.Infof("Compacted %d events (<=%d) for %s", n, index, vid)
+	return nil
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/encoding"
+)
+
+func newToken() string {
+	return encoding.MustEncode(keys.RandBytes(32), encoding.Base62)
+}
+
+// verifyCode returns a random 6 digit code.
+func verifyCode() string {
+	n := binary.BigEndian.Uint32(keys.RandBytes(4)) % 1000000
+	return fmt.Sprintf("%06d", n)
+}
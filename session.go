@@ -0,0 +1,100 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSessionExpired if there is no session, or it expired.
+var ErrSessionExpired = errors.New("session expired")
+
+// SessionStore caches the master key for a session, so other processes can
+// unlock without auth (see UnlockWithSession).
+type SessionStore interface {
+	// Set the master key for name, which expires after ttl.
+	Set(name string, mk *[32]byte, ttl time.Duration) error
+	// Get the master key for name, or nil if not found or expired.
+	Get(name string) (*[32]byte, error)
+	// Delete the master key for name.
+	Delete(name string) error
+}
+
+// UnlockWithSession opens vault with the master key from the session (see
+// WithSession), set when the vault was last unlocked.
+// Returns ErrSessionExpired if there is no session, or it expired.
+func (v *Vault) UnlockWithSession() (*[32]byte, error) {
+	if v.session == nil {
+		return nil, errors.Errorf("no session store")
+	}
+	if _, err := os.Stat(v.path); os.IsNotExist(err) {
+		return nil, ErrSetupNeeded
+	}
+	name, err := v.sessionName()
+	if err != nil {
+		return nil, err
+	}
+	mk, err := v.session.Get(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get session")
+	}
+	if mk == nil {
+		return nil, ErrSessionExpired
+	}
+	// The session isn't extended, so it expires ttl after the last unlock with
+	// auth.
+	if _, err := v.open(mk, false); err != nil {
+		// The session is for a different master key (or vault). Other errors
+		// (ErrInUse, a failed migration) keep the session.
+		if isInvalidKey(err) {
+			if derr := v.session.Delete(name); derr != nil {
+				logger.Warningf("Failed to delete session: %v", derr)
+			}
+		}
+		return nil, err
+	}
+	return mk, nil
+}
+
+// EndSession removes the master key from the session.
+// Lock doesn't end the session, so other processes can still unlock with it
+// until it expires.
+func (v *Vault) EndSession() error {
+	if v.session == nil {
+		return nil
+	}
+	name, err := v.sessionName()
+	if err != nil {
+		return err
+	}
+	return v.session.Delete(name)
+}
+
+// setSession saves the master key to the session, if there is a session store.
+func (v *Vault) setSession(mk *[32]byte) {
+	if v.session == nil {
+		return
+	}
+	name, err := v.sessionName()
+	if err != nil {
+		logger.Warningf("Failed to save session: %v", err)
+		return
+	}
+	if err := v.session.Set(name, mk, v.sessionTTL); err != nil {
+		logger.Warningf("Failed to save session: %v", err)
+	}
+}
+
+// sessionName is unique for the vault path.
+func (v *Vault) sessionName() (string, error) {
+	path, err := filepath.Abs(v.path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(path))
+	return "vault:" + hex.EncodeToString(h[:8]), nil
+}
@@ -0,0 +1,81 @@
+package vault
+
+import (
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type kernelSessionStore struct {
+	ring int
+}
+
+// NewKernelSessionStore stores sessions in the Linux kernel session keyring
+// (keyctl), which the kernel removes when the key expires or the login session
+// ends.
+func NewKernelSessionStore() (SessionStore, error) {
+	return &kernelSessionStore{ring: unix.KEY_SPEC_SESSION_KEYRING}, nil
+}
+
+func (s *kernelSessionStore) Set(name string, mk *[32]byte, ttl time.Duration) error {
+	if ttl < time.Second {
+		return errors.Errorf("session ttl too short")
+	}
+	id, err := unix.AddKey("user", name, mk[:], s.ring)
+	if err != nil {
+		return errors.Wrapf(err, "failed to add key")
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, int(ttl/time.Second), 0, 0); err != nil {
+		_, _ = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+		return errors.Wrapf(err, "failed to set key timeout")
+	}
+	return nil
+}
+
+func (s *kernelSessionStore) Get(name string) (*[32]byte, error) {
+	id, err := s.find(name)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+	b := make([]byte, 32)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, b, 0)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read key")
+	}
+	if n != 32 {
+		return nil, errors.Errorf("invalid session key")
+	}
+	return keys.Bytes32(b), nil
+}
+
+func (s *kernelSessionStore) Delete(name string) error {
+	id, err := s.find(name)
+	if err != nil || id == 0 {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0); err != nil && !isKeyNotFound(err) {
+		return errors.Wrapf(err, "failed to invalidate key")
+	}
+	return nil
+}
+
+// find returns the key ID, or 0 if not found.
+func (s *kernelSessionStore) find(name string) (int, error) {
+	id, err := unix.KeyctlSearch(s.ring, "user", name, 0)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "failed to search keyring")
+	}
+	return id, nil
+}
+
+func isKeyNotFound(err error) bool {
+	return err == unix.ENOKEY || err == unix.EKEYEXPIRED || err == unix.EKEYREVOKED
+}
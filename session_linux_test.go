@@ -0,0 +1,35 @@
+package vault_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelSessionStore(t *testing.T) {
+	store, err := vault.NewKernelSessionStore()
+	require.NoError(t, err)
+
+	name := "vault:test-" + keys.RandFileName()
+	mk := keys.Rand32()
+	if err := store.Set(name, mk, time.Minute); err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	defer func() { _ = store.Delete(name) }()
+
+	out, err := store.Get(name)
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+
+	err = store.Delete(name)
+	require.NoError(t, err)
+	out, err = store.Get(name)
+	require.NoError(t, err)
+	require.Nil(t, out)
+
+	_, err = store.Get("vault:notfound")
+	require.NoError(t, err)
+}
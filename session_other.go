@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package vault
+
+import "github.com/pkg/errors"
+
+// NewKernelSessionStore is only supported on Linux.
+func NewKernelSessionStore() (SessionStore, error) {
+	return nil, errors.Errorf("kernel keyring not supported on this platform")
+}
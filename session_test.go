@@ -0,0 +1,140 @@
+package vault_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/remote"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// memSessionStore is a SessionStore with a fake time.
+type memSessionStore struct {
+	now      time.Time
+	sessions map[string]*memSession
+}
+
+type memSession struct {
+	mk     *[32]byte
+	expire time.Time
+}
+
+func newMemSessionStore() *memSessionStore {
+	return &memSessionStore{now: time.Now(), sessions: map[string]*memSession{}}
+}
+
+func (s *memSessionStore) Set(name string, mk *[32]byte, ttl time.Duration) error {
+	s.sessions[name] = &memSession{mk: mk, expire: s.now.Add(ttl)}
+	return nil
+}
+
+func (s *memSessionStore) Get(name string) (*[32]byte, error) {
+	session, ok := s.sessions[name]
+	if !ok || !s.now.Before(session.expire) {
+		return nil, nil
+	}
+	return session.mk, nil
+}
+
+func (s *memSessionStore) Delete(name string) error {
+	delete(s.sessions, name)
+	return nil
+}
+
+func TestUnlockWithSession(t *testing.T) {
+	var err error
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	defer func() { _ = os.Remove(path + ".lock") }()
+	authPath := testutil.Path()
+	defer func() { _ = os.Remove(authPath) }()
+	authDB, err := auth.NewDB(authPath)
+	require.NoError(t, err)
+	defer func() { _ = authDB.Close() }()
+
+	store := newMemSessionStore()
+	vlt, err := vault.New(path, authDB, vault.WithRemote(remote.NewMem()), vault.WithSession(store, time.Hour))
+	require.NoError(t, err)
+
+	_, err = vlt.UnlockWithSession()
+	require.Equal(t, vault.ErrSetupNeeded, err)
+
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+	_, err = vlt.UnlockWithSession()
+	require.Equal(t, vault.ErrSessionExpired, err)
+
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	// Another process
+	vlt2, err := vault.New(path, authDB, vault.WithRemote(remote.NewMem()), vault.WithSession(store, time.Hour))
+	require.NoError(t, err)
+	out, err := vlt2.UnlockWithSession()
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+	require.Equal(t, vault.Unlocked, vlt2.Status())
+	err = vlt2.Lock()
+	require.NoError(t, err)
+
+	// In use keeps the session
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	_, err = vlt2.UnlockWithSession()
+	require.Equal(t, vault.ErrInUse{PID: os.Getpid()}, err)
+	require.Equal(t, 1, len(store.sessions))
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	// Unlocking with the session doesn't extend it
+	store.now = store.now.Add(59 * time.Minute)
+	_, err = vlt2.UnlockWithSession()
+	require.NoError(t, err)
+	err = vlt2.Lock()
+	require.NoError(t, err)
+	store.now = store.now.Add(time.Minute)
+	_, err = vlt2.UnlockWithSession()
+	require.Equal(t, vault.ErrSessionExpired, err)
+	require.Equal(t, vault.Locked, vlt2.Status())
+
+	// Wrong key deletes the session
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+	for _, session := range store.sessions {
+		session.mk = keys.Rand32()
+	}
+	_, err = vlt2.UnlockWithSession()
+	require.Error(t, err)
+	require.Empty(t, store.sessions)
+
+	// End session
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.EndSession()
+	require.NoError(t, err)
+	_, err = vlt2.UnlockWithSession()
+	require.Equal(t, vault.ErrSessionExpired, err)
+
+	// Reset ends the session
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Reset(context.TODO())
+	require.NoError(t, err)
+	require.Empty(t, store.sessions)
+
+	// No session store
+	vlt3, err := vault.New(path, authDB, vault.WithRemote(remote.NewMem()))
+	require.NoError(t, err)
+	_, err = vlt3.UnlockWithSession()
+	require.EqualError(t, err, "no session store")
+}
@@ -0,0 +1,28 @@
+package vault
+
+import (
+	"github.com/keys-pub/vault/auth"
+)
+
+// RegisterShamir adds a recovery key split into n shares, any k of which can
+// unlock the vault (see UnlockWithShamir).
+// The shares are not stored, each should be given to a different person.
+func (v *Vault) RegisterShamir(mk *[32]byte, n int, k int) (*auth.Auth, []string, error) {
+	if err := v.writable(); err != nil {
+		return nil, nil, err
+	}
+	reg, shares, err := v.auth.RegisterShamir(mk, n, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reg, shares, nil
+}
+
+// UnlockWithShamir opens vault with recovery key shares.
+func (v *Vault) UnlockWithShamir(shares []string) (*[32]byte, error) {
+	_, mk, err := v.auth.Shamir(shares)
+	if err != nil {
+		return nil, err
+	}
+	return v.unlock(mk)
+}
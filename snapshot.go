@@ -0,0 +1,187 @@
+package vault
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/api"
+	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/syncer"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// PrunePolicy is when pulled events are removed from the local pull table.
+type PrunePolicy string
+
+const (
+	// PruneSnapshot removes pulled events covered by a snapshot (applied or
+	// published).
+	// Rejected events that are pruned can't be applied if the device is
+	// trusted later. Pruned event IDs are kept, so they are still deduped.
+	PruneSnapshot PrunePolicy = "snapshot"
+	// PruneNever keeps all pulled events.
+	PruneNever PrunePolicy = "never"
+)
+
+// keyringSnapshot is the keyring at a remote index.
+// Versions includes removed keys.
+type keyringSnapshot struct {
+	Keys     []*api.Key          `msgpack:"keys"`
+	Versions map[keys.ID]version `msgpack:"vv"`
+}
+
+// PublishSnapshot syncs and then publishes a snapshot of the keyring to the
+// remote, so new devices can start from the snapshot instead of pulling every
+// event.
+// The snapshot is signed by the device key, and is only applied by devices
+// that trust this device, so a new device should trust this device (see
+// TrustDevice) before it syncs, to start from the snapshot.
+// Otherwise the new device pulls the events, which are applied when it trusts
+// the devices that signed them.
+// Requires Unlock.
+func (k *Keyring) PublishSnapshot(ctx context.Context) error {
+	if err := k.Sync(ctx); err != nil {
+		return err
+	}
+
+	k.smtx.Lock()
+	defer k.smtx.Unlock()
+
+	c, err := k.vault.useWrite()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	ck, err := k.check(c)
+	if err != nil {
+		return err
+	}
+	dk, err := deviceKey(c.db)
+	if err != nil {
+		return err
+	}
+	db := c.db
+	index, err := syncer.PullIndex(db, ck.ID)
+	if err != nil {
+		return err
+	}
+	if index == 0 {
+		return errors.Errorf("nothing to snapshot")
+	}
+
+	var ks keyringSnapshot
+	if err := syncer.Transact(db, func(tx *sqlx.Tx) error {
+		var err error
+		ks.Keys, err = getKeysTx(tx)
+		if err != nil {
+			return err
+		}
+		ks.Versions, err = getVersionsTx(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	b, err := msgpack.Marshal(&ks)
+	if err != nil {
+		return err
+	}
+	encrypted, err := syncer.SignedCipher{Sender: dk}.Encrypt(b, ck.AsEdX25519())
+	if err != nil {
+		return err
+	}
+
+	s := syncer.New(db, k.vault.Remote(), nil)
+	if err := s.PushSnapshot(ctx, ck, &client.Snapshot{Index: index, Data: encrypted}); err != nil {
+		return err
+	}
+	return k.prune(c, ck)
+}
+
+func (k *Keyring) receiveSnapshot(ctx *syncer.Context, ck *api.Key, dk *keys.EdX25519Key, snapshot *client.Snapshot) (bool, error) {
+	signed, err := syncer.OpenSigned(snapshot.Data, ck.AsEdX25519())
+	if err != nil {
+		logger.Warningf("Invalid snapshot (ridx=%d): %v", snapshot.Index, err)
+		return false, nil
+	}
+	trusted, err := isTrustedTx(ctx.Tx, dk, signed.Sender)
+	if err != nil {
+		return false, err
+	}
+	if !trusted {
+		logger.Warningf("Snapshot (ridx=%d) from untrusted device %s", snapshot.Index, signed.Sender)
+		return false, nil
+	}
+	var ks keyringSnapshot
+	if err := msgpack.Unmarshal(signed.Data, &ks); err != nil {
+		logger.Warningf("Invalid snapshot (ridx=%d): %v", snapshot.Index, err)
+		return false, nil
+	}
+	if err := k.applySnapshotTx(ctx.Tx, &ks); err != nil {
+		return false, err
+	}
+	// Events after a snapshot are signed (see openUnsignedTx).
+	if err := setSignedIndexTx(ctx.Tx, snapshot.Index); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// applySnapshotTx applies each key (and removed key) in the snapshot like a
+// keyring event.
+func (k *Keyring) applySnapshotTx(tx *sqlx.Tx, ks *keyringSnapshot) error {
+	found := map[keys.ID]bool{}
+	for _, key := range ks.Keys {
+		found[key.ID] = true
+		if err := k.applyTx(tx, &keyEvent{Key: key, Version: ks.Versions[key.ID]}); err != nil {
+			return err
+		}
+	}
+	for kid, vv := range ks.Versions {
+		if found[kid] {
+			continue
+		}
+		if err := k.applyTx(tx, &keyEvent{Key: &api.Key{ID: kid, Deleted: true}, Version: vv}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) prune(c *conn, ck *api.Key) error {
+	if k.vault.prune != PruneSnapshot {
+		return nil
+	}
+	return syncer.Prune(c.db, ck.ID)
+}
+
+func getKeysTx(tx *sqlx.Tx) ([]*api.Key, error) {
+	var out []*api.Key
+	if err := tx.Select(&out, "SELECT * FROM keys ORDER BY id"); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func getVersionsTx(tx *sqlx.Tx) (map[keys.ID]version, error) {
+	var rows []*struct {
+		ID keys.ID `db:"id"`
+		VV []byte  `db:"vv"`
+	}
+	if err := tx.Select(&rows, "SELECT id, vv FROM versions"); err != nil {
+		return nil, err
+	}
+	out := map[keys.ID]version{}
+	for _, r := range rows {
+		var vv version
+		if err := msgpack.Unmarshal(r.VV, &vv); err != nil {
+			return nil, err
+		}
+		out[r.ID] = vv
+	}
+	return out, nil
+}
@@ -0,0 +1,29 @@
+package vault
+
+import (
+	"github.com/keys-pub/vault/auth"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// RegisterSSHAgent adds ssh-agent auth for an Ed25519 key in the agent (see
+// auth.SSHAgentKeys and auth.DialSSHAgent).
+func (v *Vault) RegisterSSHAgent(mk *[32]byte, ag agent.Agent, key ssh.PublicKey) (*auth.Auth, error) {
+	if err := v.writable(); err != nil {
+		return nil, err
+	}
+	reg, err := v.auth.RegisterSSHAgent(ag, key, mk)
+	if err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// UnlockWithSSHAgent opens vault with a key in the ssh-agent.
+func (v *Vault) UnlockWithSSHAgent(ag agent.Agent) (*[32]byte, error) {
+	_, mk, err := v.auth.SSHAgent(ag)
+	if err != nil {
+		return nil, err
+	}
+	return v.unlock(mk)
+}
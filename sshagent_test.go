@@ -0,0 +1,48 @@
+package vault_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestVaultSSHAgent(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	// Agent over a connection (like a socket)
+	keyring := agent.NewKeyring()
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	err = keyring.Add(agent.AddedKey{PrivateKey: sk})
+	require.NoError(t, err)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() { _ = agent.ServeAgent(keyring, c2) }()
+	ag := agent.NewClient(c1)
+
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+
+	sshKeys, err := auth.SSHAgentKeys(ag)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sshKeys))
+	_, err = vlt.RegisterSSHAgent(mk, ag, sshKeys[0])
+	require.NoError(t, err)
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	out, err := vlt.UnlockWithSSHAgent(ag)
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+}
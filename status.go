@@ -0,0 +1,35 @@
+package vault
+
+// OnStatusChange calls fn after the vault status changes (Locked, Unlocked or
+// SetupNeeded), for example after Unlock, Lock (including an idle lock, see
+// WithIdleLock) or Reset.
+// fn is called from the goroutine that changed the status, and should not
+// block.
+// Returns a function to stop notifications.
+func (v *Vault) OnStatusChange(fn func(status Status)) func() {
+	v.smtx.Lock()
+	defer v.smtx.Unlock()
+	if v.listeners == nil {
+		v.listeners = map[int]func(Status){}
+	}
+	id := v.nextListener
+	v.nextListener++
+	v.listeners[id] = fn
+	return func() {
+		v.smtx.Lock()
+		defer v.smtx.Unlock()
+		delete(v.listeners, id)
+	}
+}
+
+func (v *Vault) notifyStatus(status Status) {
+	v.smtx.Lock()
+	fns := make([]func(Status), 0, len(v.listeners))
+	for _, fn := range v.listeners {
+		fns = append(fns, fn)
+	}
+	v.smtx.Unlock()
+	for _, fn := range fns {
+		fn(status)
+	}
+}
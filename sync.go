@@ -24,6 +24,14 @@ func (v *Vault) Sync(ctx context.Context, vid keys.ID, receiver syncer.Receiver)
 		return keys.NewErrNotFound(vid.String())
 	}
 
-	s := syncer.New(v.db, v.client, receiver)
+	c, err := v.useWrite()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	s := syncer.New(c.db, v.remote, receiver)
 	return s.Sync(ctx, vk)
 }
@@ -8,8 +8,11 @@ import (
 	"github.com/keys-pub/keys/api"
 	"github.com/keys-pub/keys/encoding"
 	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/remote"
 	"github.com/keys-pub/vault/syncer"
 	"github.com/keys-pub/vault/testutil"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"github.com/vmihailenco/msgpack/v4"
 )
@@ -45,6 +48,7 @@ func TestSyncKeyring(t *testing.T) {
 	t.Logf("Client #2")
 	v2, closeFn2 := testutil.NewTestVaultWithSetup(t, env, "testpassword2", ck)
 	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
 
 	err = v2.Keyring().Sync(ctx)
 	require.NoError(t, err)
@@ -89,6 +93,83 @@ func TestSyncKeyring(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestSyncUntrusted(t *testing.T) {
+	// vault.SetLogger(vault.NewLogger(vault.DebugLevel))
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	defer env.CloseFn()
+
+	ctx := context.TODO()
+
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	testutil.AccountCreate(t, env, alice, "alice@getchill.app")
+	ck := testutil.RegisterClient(t, env, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+
+	v1, closeFn1 := testutil.NewTestVaultWithSetup(t, env, "testpassword1", ck)
+	defer closeFn1()
+
+	t.Logf("Untrusted")
+	v2, closeFn2 := testutil.NewTestVaultWithSetup(t, env, "testpassword2", ck)
+	defer closeFn2()
+
+	bob := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x02))).WithLabels("bob")
+	err = v2.Keyring().Set(bob)
+	require.NoError(t, err)
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	t.Logf("Client #1")
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err := v1.Keyring().Get(bob.ID)
+	require.NoError(t, err)
+	require.Nil(t, out)
+
+	dk2, err := v2.DeviceKey()
+	require.NoError(t, err)
+	rejected, err := v1.Keyring().Rejected()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rejected))
+	require.Equal(t, dk2.ID(), rejected[0].Sender)
+	require.Equal(t, "untrusted device", rejected[0].Reason)
+
+	// Rejected events are applied on trust
+	err = v1.Keyring().TrustDevice(dk2.ID())
+	require.NoError(t, err)
+	out, err = v1.Keyring().Get(bob.ID)
+	require.NoError(t, err)
+	require.NotNil(t, out)
+	rejected, err = v1.Keyring().Rejected()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(rejected))
+
+	// Events after trust are applied
+	charlie := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x03))).WithLabels("charlie")
+	err = v2.Keyring().Set(charlie)
+	require.NoError(t, err)
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err = v1.Keyring().Get(charlie.ID)
+	require.NoError(t, err)
+	require.NotNil(t, out)
+
+	// Untrust keeps the key (without the device label)
+	err = v1.Keyring().UntrustDevice(dk2.ID())
+	require.NoError(t, err)
+	out, err = v1.Keyring().Get(dk2.ID())
+	require.NoError(t, err)
+	require.NotNil(t, out)
+	require.False(t, out.HasLabel(vault.DeviceLabel))
+	devices, err := v1.Keyring().Devices()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(devices))
+	out, err = v1.Keyring().Get(charlie.ID)
+	require.NoError(t, err)
+	require.NotNil(t, out)
+}
+
 func TestSyncCreateFind(t *testing.T) {
 	// vault.SetLogger(vault.NewLogger(vault.DebugLevel))
 	var err error
@@ -115,6 +196,7 @@ func TestSyncCreateFind(t *testing.T) {
 	t.Logf("Client #2")
 	v2, closeFn2 := testutil.NewTestVaultWithSetup(t, env, "testpassword2", ck)
 	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
 
 	err = v2.Keyring().Sync(context.TODO())
 	require.NoError(t, err)
@@ -187,6 +269,7 @@ func TestSyncMessages(t *testing.T) {
 	t.Logf("Client #2")
 	v2, closeFn2 := testutil.NewTestVaultWithSetup(t, env, "testpassword2", ck)
 	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
 
 	msgs2 := []*message{}
 	receiver2 := func(ctx *syncer.Context, events []*vault.Event) error {
@@ -316,3 +399,356 @@ func TestSyncBulk(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2000, len(outs))
 }
+
+func TestSyncRemote(t *testing.T) {
+	// vault.SetLogger(vault.NewLogger(vault.DebugLevel))
+	var err error
+	ctx := context.TODO()
+
+	rm := remote.NewMem()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	ck, err := rm.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+
+	t.Logf("Client #1")
+	v1, closeFn1 := testutil.NewTestVaultWithRemote(t, rm, "testpassword1", ck)
+	defer closeFn1()
+	t.Logf("Client #2")
+	v2, closeFn2 := testutil.NewTestVaultWithRemote(t, rm, "testpassword2", ck)
+	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
+
+	ak := api.NewKey(alice).WithLabels("alice")
+	err = v1.Keyring().Set(ak)
+	require.NoError(t, err)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err := v2.Keyring().Key(alice.ID())
+	require.NoError(t, err)
+	require.Equal(t, ak, out)
+}
+
+// lostRemote is a remote where the response to the next Post is lost.
+type lostRemote struct {
+	*remote.Mem
+	lose bool
+}
+
+func (r *lostRemote) Post(ctx context.Context, key *keys.EdX25519Key, events []*client.PushEvent) error {
+	if err := r.Mem.Post(ctx, key, events); err != nil {
+		return err
+	}
+	if r.lose {
+		r.lose = false
+		return errors.Errorf("response lost")
+	}
+	return nil
+}
+
+func TestSyncPushRetry(t *testing.T) {
+	var err error
+	ctx := context.TODO()
+
+	rm := &lostRemote{Mem: remote.NewMem()}
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	ck, err := rm.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+
+	v1, closeFn1 := testutil.NewTestVaultWithRemote(t, rm, "testpassword1", ck)
+	defer closeFn1()
+	v2, closeFn2 := testutil.NewTestVaultWithRemote(t, rm, "testpassword2", ck)
+	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	events, err := rm.Events(ctx, ck.AsEdX25519(), 0)
+	require.NoError(t, err)
+	start := events.Index
+
+	err = v1.Keyring().Set(api.NewKey(alice).WithLabels("alice"))
+	require.NoError(t, err)
+	rm.lose = true
+	err = v1.Keyring().Sync(ctx)
+	require.EqualError(t, err, "failed to push vault: response lost")
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	events, err = rm.Events(ctx, ck.AsEdX25519(), start)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events.Events))
+	require.NotEmpty(t, events.Events[0].ID)
+
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err := v2.Keyring().KeysWithLabel("alice")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(out))
+}
+
+func testSyncConflict(t *testing.T, resolver vault.Resolver) (*api.Key, *api.Key, *vault.Vault, *vault.Vault, func()) {
+	var err error
+	ctx := context.TODO()
+
+	rm := remote.NewMem()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	ck, err := rm.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+
+	v1, closeFn1 := testutil.NewTestVaultWithRemote(t, rm, "testpassword1", ck, vault.WithResolver(resolver))
+	v2, closeFn2 := testutil.NewTestVaultWithRemote(t, rm, "testpassword2", ck, vault.WithResolver(resolver))
+	closeFn := func() {
+		closeFn1()
+		closeFn2()
+	}
+	testutil.TrustDevices(t, v1, v2)
+
+	err = v1.Keyring().Set(api.NewKey(alice).WithLabels("alice").Updated(1))
+	require.NoError(t, err)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	// Edit on both (offline)
+	k1 := api.NewKey(alice).WithLabels("alice", "v1").WithNotes("v1 notes").Updated(2)
+	err = v1.Keyring().Set(k1)
+	require.NoError(t, err)
+	k2 := api.NewKey(alice).WithLabels("alice", "v2").Updated(3)
+	err = v2.Keyring().Set(k2)
+	require.NoError(t, err)
+
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	return k1, k2, v1, v2, closeFn
+}
+
+func TestSyncConflictLastWriterWins(t *testing.T) {
+	_, k2, v1, v2, closeFn := testSyncConflict(t, vault.ResolveLastWriterWins)
+	defer closeFn()
+
+	for _, vlt := range []*vault.Vault{v1, v2} {
+		out, err := vlt.Keyring().Key(k2.ID)
+		require.NoError(t, err)
+		require.Equal(t, k2, out)
+		conflicts, err := vlt.Keyring().Conflicts()
+		require.NoError(t, err)
+		require.Equal(t, 0, len(conflicts))
+	}
+}
+
+func TestSyncConflictMerge(t *testing.T) {
+	_, k2, v1, v2, closeFn := testSyncConflict(t, vault.ResolveMerge)
+	defer closeFn()
+
+	for _, vlt := range []*vault.Vault{v1, v2} {
+		out, err := vlt.Keyring().Key(k2.ID)
+		require.NoError(t, err)
+		require.Equal(t, api.Labels{"alice", "v1", "v2"}, out.Labels)
+		require.Equal(t, "v1 notes", out.Notes)
+		require.Equal(t, int64(3), out.UpdatedAt)
+	}
+}
+
+func TestSyncConflictKeepBoth(t *testing.T) {
+	var err error
+	ctx := context.TODO()
+	k1, k2, v1, v2, closeFn := testSyncConflict(t, vault.ResolveKeepBoth)
+	defer closeFn()
+
+	out, err := v1.Keyring().Key(k1.ID)
+	require.NoError(t, err)
+	require.Equal(t, k1, out)
+	conflicts, err := v1.Keyring().Conflicts()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(conflicts))
+	require.Equal(t, k1, conflicts[0].Local)
+	require.Equal(t, k2, conflicts[0].Remote)
+
+	out, err = v2.Keyring().Key(k2.ID)
+	require.NoError(t, err)
+	require.Equal(t, k2, out)
+	conflicts, err = v2.Keyring().Conflicts()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(conflicts))
+
+	// Resolve on v1
+	err = v1.Keyring().Set(k2)
+	require.NoError(t, err)
+	conflicts, err = v1.Keyring().Conflicts()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(conflicts))
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	conflicts, err = v2.Keyring().Conflicts()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(conflicts))
+}
+
+func TestSyncSnapshot(t *testing.T) {
+	var err error
+	ctx := context.TODO()
+
+	rm := remote.NewMem()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	ck, err := rm.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+
+	v1, closeFn1 := testutil.NewTestVaultWithRemote(t, rm, "testpassword1", ck, vault.WithPrunePolicy(vault.PruneSnapshot))
+	defer closeFn1()
+	v2, closeFn2 := testutil.NewTestVaultWithRemote(t, rm, "testpassword2", ck)
+	defer closeFn2()
+	testutil.TrustDevices(t, v1, v2)
+
+	kids := []keys.ID{}
+	for i := 0; i < 10; i++ {
+		key := api.NewKey(keys.GenerateEdX25519Key()).WithLabels("test")
+		err = v1.Keyring().Set(key)
+		require.NoError(t, err)
+		kids = append(kids, key.ID)
+	}
+	err = v1.Keyring().Remove(kids[0])
+	require.NoError(t, err)
+	err = v1.Keyring().PublishSnapshot(ctx)
+	require.NoError(t, err)
+
+	snapshot, err := rm.Snapshot(ctx, ck.AsEdX25519())
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+	count := 0
+	err = v1.DB().Get(&count, "SELECT COUNT(*) FROM pull")
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	// Pruned IDs are kept for dedupe
+	err = v1.DB().Get(&count, "SELECT COUNT(*) FROM pruned")
+	require.NoError(t, err)
+	require.True(t, count > 0)
+
+	// New device starts from snapshot
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err := v2.Keyring().KeysWithLabel("test")
+	require.NoError(t, err)
+	require.Equal(t, 9, len(out))
+	index, err := syncer.PullIndex(v2.DB(), ck.ID)
+	require.NoError(t, err)
+	require.True(t, index > snapshot.Index)
+	err = v2.DB().Get(&count, "SELECT COUNT(*) FROM pull WHERE ridx <= $1", snapshot.Index)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// Events after snapshot
+	err = v1.Keyring().Remove(kids[1])
+	require.NoError(t, err)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err = v2.Keyring().KeysWithLabel("test")
+	require.NoError(t, err)
+	require.Equal(t, 8, len(out))
+
+	// Replays from the checkpoint
+	drift, err := v2.Keyring().Verify()
+	require.NoError(t, err)
+	require.Empty(t, drift)
+
+	// New device that doesn't trust v1 yet pulls the events (not pruned by
+	// default), which are applied on trust
+	v3, closeFn3 := testutil.NewTestVaultWithRemote(t, rm, "testpassword3", ck)
+	defer closeFn3()
+	err = v3.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err = v3.Keyring().KeysWithLabel("test")
+	require.NoError(t, err)
+	require.Equal(t, 0, len(out))
+	dk1, err := v1.DeviceKey()
+	require.NoError(t, err)
+	err = v3.Keyring().TrustDevice(dk1.ID())
+	require.NoError(t, err)
+	out, err = v3.Keyring().KeysWithLabel("test")
+	require.NoError(t, err)
+	require.Equal(t, 8, len(out))
+	err = v3.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	err = v3.DB().Get(&count, "SELECT COUNT(*) FROM pull")
+	require.NoError(t, err)
+	require.True(t, count > 0)
+}
+
+func TestSyncUnsigned(t *testing.T) {
+	var err error
+	ctx := context.TODO()
+
+	rm := remote.NewMem()
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	ck, err := rm.Register(ctx, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+	require.NoError(t, err)
+
+	v1, closeFn1 := testutil.NewTestVaultWithRemote(t, rm, "testpassword1", ck)
+	defer closeFn1()
+	v2, closeFn2 := testutil.NewTestVaultWithRemote(t, rm, "testpassword2", ck)
+	defer closeFn2()
+
+	// Unsigned event (from before events were signed)
+	addUnsigned := func(key *api.Key) {
+		b, err := msgpack.Marshal(key)
+		require.NoError(t, err)
+		err = v1.Add(ck.AsEdX25519(), b, syncer.CryptoBoxSealCipher{})
+		require.NoError(t, err)
+	}
+	bob := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x02))).WithLabels("bob")
+	addUnsigned(bob)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	// Signed event
+	charlie := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x03))).WithLabels("charlie")
+	err = v1.Keyring().Set(charlie)
+	require.NoError(t, err)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	// Unsigned event after a signed event
+	dave := api.NewKey(keys.NewEdX25519KeyFromSeed(testutil.Seed(0x04))).WithLabels("dave")
+	addUnsigned(dave)
+	err = v1.Keyring().Sync(ctx)
+	require.NoError(t, err)
+
+	// Signed event posted again with another ID
+	events, err := rm.Events(ctx, ck.AsEdX25519(), 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(events.Events))
+	err = rm.Post(ctx, ck.AsEdX25519(), []*client.PushEvent{{ID: "replayed", Data: events.Events[1].Data}})
+	require.NoError(t, err)
+
+	testutil.TrustDevices(t, v1, v2)
+	err = v2.Keyring().Sync(ctx)
+	require.NoError(t, err)
+	out, err := v2.Keyring().Get(bob.ID)
+	require.NoError(t, err)
+	require.NotNil(t, out)
+	out, err = v2.Keyring().Get(charlie.ID)
+	require.NoError(t, err)
+	require.NotNil(t, out)
+	out, err = v2.Keyring().Get(dave.ID)
+	require.NoError(t, err)
+	require.Nil(t, out)
+
+	rejected, err := v2.Keyring().Rejected()
+	require.NoError(t, err)
+	reasons := []string{}
+	for _, r := range rejected {
+		reasons = append(reasons, r.Reason)
+	}
+	require.Equal(t, []string{"unsigned event", "event id mismatch"}, reasons)
+}
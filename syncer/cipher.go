@@ -2,6 +2,8 @@ package syncer
 
 import (
 	"github.com/keys-pub/keys"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
 // Cipher for encryption.
@@ -21,3 +23,111 @@ type NoCipher struct{}
 func (c NoCipher) Encrypt(b []byte, key *keys.EdX25519Key) ([]byte, error) {
 	return b, nil
 }
+
+// SignedCipher signs with the sender key and encrypts (CryptoBoxSeal) to the
+// vault key.
+// Use OpenSigned to decrypt and verify.
+type SignedCipher struct {
+	Sender *keys.EdX25519Key
+}
+
+// EventCipher is a Cipher that includes the event ID in the encrypted data, so
+// the event can't be posted again with another ID (see AddTx).
+type EventCipher interface {
+	EncryptEvent(b []byte, key *keys.EdX25519Key, id string) ([]byte, error)
+}
+
+// signedPrefix is the first byte of (decrypted) signed data.
+// It's never used in msgpack, so data from before signing (msgpack encrypted
+// with CryptoBoxSealCipher) doesn't start with it.
+const signedPrefix byte = 0xc1
+
+// ErrUnsigned if data isn't from SignedCipher, for example events from before
+// events were signed (see OpenUnsigned).
+var ErrUnsigned = errors.New("unsigned data")
+
+type signedData struct {
+	VID  keys.ID `msgpack:"v"`
+	ID   string  `msgpack:"id,omitempty"`
+	Data []byte  `msgpack:"d"`
+}
+
+type signedEnvelope struct {
+	Sender keys.ID `msgpack:"s"`
+	Signed []byte  `msgpack:"sig"`
+}
+
+// Encrypt signs and encrypts data without an event ID (for snapshots).
+func (c SignedCipher) Encrypt(b []byte, key *keys.EdX25519Key) ([]byte, error) {
+	return c.EncryptEvent(b, key, "")
+}
+
+// EncryptEvent signs and encrypts data with the event ID.
+func (c SignedCipher) EncryptEvent(b []byte, key *keys.EdX25519Key, id string) ([]byte, error) {
+	if c.Sender == nil {
+		return nil, errors.Errorf("no sender key")
+	}
+	sd, err := msgpack.Marshal(&signedData{VID: key.ID(), ID: id, Data: b})
+	if err != nil {
+		return nil, err
+	}
+	env, err := msgpack.Marshal(&signedEnvelope{Sender: c.Sender.ID(), Signed: c.Sender.Sign(sd)})
+	if err != nil {
+		return nil, err
+	}
+	return keys.CryptoBoxSeal(append([]byte{signedPrefix}, env...), key.X25519Key().PublicKey()), nil
+}
+
+// Signed is data from OpenSigned.
+type Signed struct {
+	// Sender is the key that signed the data.
+	Sender keys.ID
+	// ID is the event ID signed with the data, or empty if none.
+	ID   string
+	Data []byte
+}
+
+// OpenSigned decrypts and verifies data from SignedCipher.
+// Returns ErrUnsigned if the data isn't signed (see OpenUnsigned).
+// If the signature is invalid, the error is returned with the sender.
+// The caller is responsible for checking if the sender is trusted.
+func OpenSigned(b []byte, key *keys.EdX25519Key) (*Signed, error) {
+	decrypted, err := keys.CryptoBoxSealOpen(b, key.X25519Key())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt")
+	}
+	if len(decrypted) == 0 || decrypted[0] != signedPrefix {
+		return nil, ErrUnsigned
+	}
+	var env signedEnvelope
+	if err := msgpack.Unmarshal(decrypted[1:], &env); err != nil {
+		return nil, errors.Wrapf(err, "invalid envelope")
+	}
+	spk, err := keys.NewEdX25519PublicKeyFromID(env.Sender)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid sender")
+	}
+	verified, err := spk.Verify(env.Signed)
+	if err != nil {
+		return &Signed{Sender: env.Sender}, errors.Wrapf(err, "invalid signature")
+	}
+	var sd signedData
+	if err := msgpack.Unmarshal(verified, &sd); err != nil {
+		return &Signed{Sender: env.Sender}, errors.Wrapf(err, "invalid signed data")
+	}
+	if sd.VID != key.ID() {
+		return &Signed{Sender: env.Sender}, errors.Errorf("signed for a different vault")
+	}
+	return &Signed{Sender: env.Sender, ID: sd.ID, Data: sd.Data}, nil
+}
+
+// OpenUnsigned decrypts data from CryptoBoxSealCipher.
+// The data isn't authenticated (anyone with the vault public key can encrypt
+// it), so the caller decides whether to trust it.
+func OpenUnsigned(b []byte, key *keys.EdX25519Key) ([]byte, error) {
+	decrypted, err := keys.CryptoBoxSealOpen(b, key.X25519Key())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt")
+	}
+	return decrypted, nil
+}
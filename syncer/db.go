@@ -5,32 +5,69 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/keys-pub/keys"
+	"github.com/keys-pub/keys/encoding"
 	"github.com/keys-pub/vault/client"
+	"github.com/keys-pub/vault/migrate"
 	"github.com/pkg/errors"
 )
 
-func InitTables(db *sqlx.DB) error {
-	logger.Debugf("Initializing sync tables...")
-	stmts := []string{
+// CreateTables creates the push and pull tables (as in the first version).
+// See vault migrations.
+func CreateTables(tx *sqlx.Tx) error {
+	return migrate.Exec(
 		`CREATE TABLE IF NOT EXISTS push (
 			idx INTEGER PRIMARY KEY AUTOINCREMENT,
 			data BLOB NOT NULL,
 			vid TEXT NOT NULL
 		);`,
-		`CREATE TABLE IF NOT EXISTS pull (						
+		`CREATE TABLE IF NOT EXISTS pull (
 			ridx INTEGER PRIMARY KEY NOT NULL,
-			data BLOB NOT NULL,			
+			data BLOB NOT NULL,
 			rts TIMESTAMP NOT NULL,
 			vid TEXT NOT NULL
 		);`,
-		// TODO: Indexes
-	}
-	for _, stmt := range stmts {
-		if _, err := db.Exec(stmt); err != nil {
-			return err
-		}
-	}
-	return nil
+	)(tx)
+}
+
+// AddEventIDs adds event IDs to the push and pull tables, with IDs for pending
+// pushes.
+func AddEventIDs(tx *sqlx.Tx) error {
+	return migrate.Steps(
+		migrate.AddColumn("push", "id", "TEXT NOT NULL DEFAULT ''"),
+		migrate.AddColumn("pull", "id", "TEXT NOT NULL DEFAULT ''"),
+		migrate.Exec("UPDATE push SET id = lower(hex(randomblob(16))) WHERE id = ''"),
+	)(tx)
+}
+
+// CreateCheckpoint creates the checkpoint (snapshot) table.
+func CreateCheckpoint(tx *sqlx.Tx) error {
+	return migrate.Exec(
+		`CREATE TABLE IF NOT EXISTS checkpoint (
+			vid TEXT PRIMARY KEY NOT NULL,
+			ridx INTEGER NOT NULL,
+			data BLOB NOT NULL
+		);`,
+	)(tx)
+}
+
+// CreatePruned creates the table of pruned (pulled) event IDs, see Prune.
+func CreatePruned(tx *sqlx.Tx) error {
+	return migrate.Exec(
+		`CREATE TABLE IF NOT EXISTS pruned (
+			vid TEXT NOT NULL,
+			id TEXT NOT NULL,
+			PRIMARY KEY (vid, id)
+		);`,
+	)(tx)
+}
+
+// CreateIndexes creates indexes for the push and pull tables.
+func CreateIndexes(tx *sqlx.Tx) error {
+	return migrate.Exec(
+		`CREATE INDEX IF NOT EXISTS push_vid ON push (vid, idx);`,
+		`CREATE INDEX IF NOT EXISTS pull_vid ON pull (vid, ridx);`,
+		`CREATE INDEX IF NOT EXISTS pull_id ON pull (vid, id);`,
+	)(tx)
 }
 
 // Transact creates and executes a transaction.
@@ -58,18 +95,31 @@ func Transact(db *sqlx.DB, txFn func(*sqlx.Tx) error) (err error) {
 
 func AddTx(tx *sqlx.Tx, vk *keys.EdX25519Key, b []byte, cipher Cipher) error {
 	logger.Debugf("Adding to push %s", vk.ID())
-	encrypted, err := cipher.Encrypt(b, vk)
+	id := newEventID()
+	var encrypted []byte
+	var err error
+	if ec, ok := cipher.(EventCipher); ok {
+		encrypted, err = ec.EncryptEvent(b, vk, id)
+	} else {
+		encrypted, err = cipher.Encrypt(b, vk)
+	}
 	if err != nil {
 		return err
 	}
-	if _, err := tx.Exec("INSERT INTO push (vid, data) VALUES ($1, $2)", vk.ID(), encrypted); err != nil {
+	if _, err := tx.Exec("INSERT INTO push (vid, id, data) VALUES ($1, $2, $3)", vk.ID(), id, encrypted); err != nil {
 		return err
 	}
 	return nil
 }
 
+// newEventID returns a random event ID.
+func newEventID() string {
+	return encoding.MustEncode(keys.RandBytes(16), encoding.Base62)
+}
+
 type push struct {
 	Index int64   `db:"idx"`
+	ID    string  `db:"id"`
 	Data  []byte  `db:"data"`
 	VID   keys.ID `db:"vid"`
 }
@@ -90,17 +140,51 @@ func clearPush(db *sqlx.DB, id int64) error {
 }
 
 func setPullTx(tx *sqlx.Tx, events []*client.Event) error {
-	if _, err := tx.NamedExec("INSERT OR REPLACE INTO pull (data, ridx, rts, vid) VALUES (:data, :ridx, :rts, :vid)", events); err != nil {
+	if _, err := tx.NamedExec("INSERT OR REPLACE INTO pull (id, data, ridx, rts, vid) VALUES (:id, :data, :ridx, :rts, :vid)", events); err != nil {
 		return err
 	}
 	return nil
 }
 
-func pullIndex(db *sqlx.DB, vid keys.ID) (int64, error) {
+// dedupeTx returns events without the events whose ID we already pulled
+// (or that are repeated in events).
+// Must be called before setPullTx.
+func dedupeTx(tx *sqlx.Tx, vid keys.ID, events []*client.Event) ([]*client.Event, error) {
+	out := make([]*client.Event, 0, len(events))
+	seen := map[string]bool{}
+	for _, event := range events {
+		if event.ID == "" {
+			out = append(out, event)
+			continue
+		}
+		if seen[event.ID] {
+			logger.Infof("Skipping duplicate event %s (%d)", event.ID, event.RemoteIndex)
+			continue
+		}
+		seen[event.ID] = true
+		var count int
+		if err := tx.Get(&count, `SELECT
+			(SELECT COUNT(*) FROM pull WHERE vid = $1 AND id = $2) +
+			(SELECT COUNT(*) FROM pruned WHERE vid = $1 AND id = $2)`, vid, event.ID); err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			logger.Infof("Skipping duplicate event %s (%d)", event.ID, event.RemoteIndex)
+			continue
+		}
+		out = append(out, event)
+	}
+	return out, nil
+}
+
+// PullIndex returns the remote index we have pulled up to, from pulled events
+// or a checkpoint (snapshot).
+func PullIndex(db *sqlx.DB, vid keys.ID) (int64, error) {
 	var pull struct {
 		Index sql.NullInt64 `db:"ridx"`
 	}
-	if err := db.Get(&pull, "SELECT MAX(ridx) as ridx FROM pull WHERE vid = ?", vid); err != nil {
+	if err := db.Get(&pull, `SELECT MAX(ridx) as ridx FROM (
+		SELECT ridx FROM pull WHERE vid = $1 UNION ALL SELECT ridx FROM checkpoint WHERE vid = $1)`, vid); err != nil {
 		return 0, err
 	}
 	if pull.Index.Valid {
@@ -116,7 +200,8 @@ func PullIndexes(db *sqlx.DB) (map[keys.ID]int64, error) {
 		Index sql.NullInt64  `db:"ridx"`
 	}
 	var pis []*pullIndex
-	if err := db.Select(&pis, "SELECT vid, MAX(ridx) as ridx FROM pull GROUP BY vid"); err != nil {
+	if err := db.Select(&pis, `SELECT vid, MAX(ridx) as ridx FROM (
+		SELECT vid, ridx FROM pull UNION ALL SELECT vid, ridx FROM checkpoint) GROUP BY vid`); err != nil {
 		return nil, err
 	}
 	m := map[keys.ID]int64{}
@@ -128,6 +213,50 @@ func PullIndexes(db *sqlx.DB) (map[keys.ID]int64, error) {
 	return m, nil
 }
 
+// Checkpoint returns the latest snapshot applied or pushed.
+// Returns nil if none.
+func Checkpoint(db *sqlx.DB, vid keys.ID) (*client.Snapshot, error) {
+	var snapshot client.Snapshot
+	if err := db.Get(&snapshot, "SELECT ridx as idx, data FROM checkpoint WHERE vid = $1", vid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func setCheckpointTx(tx *sqlx.Tx, vid keys.ID, snapshot *client.Snapshot) error {
+	if _, err := tx.Exec("INSERT OR REPLACE INTO checkpoint (vid, ridx, data) VALUES ($1, $2, $3)", vid, snapshot.Index, snapshot.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Prune removes pulled events covered by the checkpoint (snapshot).
+// The IDs of removed events are kept in pruned, so they are still deduped.
+func Prune(db *sqlx.DB, vid keys.ID) error {
+	return Transact(db, func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO pruned (vid, id)
+			SELECT vid, id FROM pull WHERE vid = $1 AND id != '' AND
+			ridx <= (SELECT ridx FROM checkpoint WHERE vid = $1)`, vid); err != nil {
+			return err
+		}
+		res, err := tx.Exec("DELETE FROM pull WHERE vid = $1 AND ridx <= (SELECT ridx FROM checkpoint WHERE vid = $1)", vid)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			logger.Debugf("Pruned %d pulled events for %s", n, vid)
+		}
+		return nil
+	})
+}
+
 func PushIndexes(db *sqlx.DB) (map[keys.ID]int64, error) {
 	logger.Debugf("Push indexes...")
 	type pushIndex struct {
@@ -146,3 +275,47 @@ func PushIndexes(db *sqlx.DB) (map[keys.ID]int64, error) {
 	}
 	return m, nil
 }
+
+// CheckpointTx returns the checkpoint (snapshot) in a transaction.
+// Returns nil if none.
+func CheckpointTx(tx *sqlx.Tx, vid keys.ID) (*client.Snapshot, error) {
+	var snapshot client.Snapshot
+	if err := tx.Get(&snapshot, "SELECT ridx as idx, data FROM checkpoint WHERE vid = $1", vid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// PulledTx returns pulled events after index (up to max), in remote order.
+func PulledTx(tx *sqlx.Tx, vid keys.ID, index int64, max int) ([]*client.Event, error) {
+	var events []*client.Event
+	if err := tx.Select(&events, "SELECT * FROM pull WHERE vid = $1 AND ridx > $2 ORDER BY ridx LIMIT $3", vid, index, max); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// PulledEventTx returns the pulled event at remote index, or nil if not found
+// (or pruned).
+func PulledEventTx(tx *sqlx.Tx, vid keys.ID, index int64) (*client.Event, error) {
+	var event client.Event
+	if err := tx.Get(&event, "SELECT * FROM pull WHERE vid = $1 AND ridx = $2", vid, index); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &event, nil
+}
+
+// PendingTx returns the (encrypted) data for events not pushed yet, in order.
+func PendingTx(tx *sqlx.Tx, vid keys.ID) ([][]byte, error) {
+	var data [][]byte
+	if err := tx.Select(&data, "SELECT data FROM push WHERE vid = $1 ORDER BY idx", vid); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -14,3 +14,9 @@ type Context struct {
 
 // Receiver is notified when events are received from the remote.
 type Receiver func(ctx *Context, events []*client.Event) error
+
+// SnapshotReceiver is notified when a snapshot newer than the pulled events is
+// available from the remote.
+// Returns false if the snapshot wasn't applied (for example, if it failed
+// verification), in which case events are pulled instead.
+type SnapshotReceiver func(ctx *Context, snapshot *client.Snapshot) (bool, error)
@@ -13,32 +13,38 @@ import (
 
 // Syncer syncs.
 type Syncer struct {
-	db       *sqlx.DB
-	client   *client.Client
-	receiver Receiver
-	smtx     sync.Mutex
+	db               *sqlx.DB
+	remote           client.Remote
+	receiver         Receiver
+	snapshotReceiver SnapshotReceiver
+	smtx             sync.Mutex
 }
 
 // New creates a Syncer.
-func New(db *sqlx.DB, client *client.Client, receiver Receiver) *Syncer {
+func New(db *sqlx.DB, remote client.Remote, receiver Receiver) *Syncer {
 	return &Syncer{
 		db:       db,
-		client:   client,
+		remote:   remote,
 		receiver: receiver,
 	}
 }
 
+// SetSnapshotReceiver sets the receiver for snapshots.
+// If set, and the remote has a snapshot newer than the pulled events, Pull
+// applies the snapshot and pulls the events after it.
+func (s *Syncer) SetSnapshotReceiver(receiver SnapshotReceiver) {
+	s.snapshotReceiver = receiver
+}
+
 func (s *Syncer) Sync(ctx context.Context, key *api.Key) error {
 	logger.Infof("Syncing %s...", key.ID)
 	s.smtx.Lock()
 	defer s.smtx.Unlock()
 
-	// What happens on connection failures, context cancellation?
-	//
-	// If we fail during push (after succeeding on the server, the response is
-	// lost), we would push duplicates on the next push.
-	// These duplicates would show up in the subsequent pulls and would be up
-	// to clients to deal with it, which most clients could probably ignore.
+	// If we fail during push (after succeeding on the remote, the response is
+	// lost), we push the same events again on the next push. Each event has a
+	// stable ID, so the remote ignores the events it already has, and on pull
+	// we skip events with an ID we already have (for remotes that don't).
 
 	if err := s.Push(ctx, key); err != nil {
 		return errors.Wrapf(err, "failed to push vault")
@@ -55,8 +61,8 @@ func (s *Syncer) Sync(ctx context.Context, key *api.Key) error {
 
 // Push to remote.
 func (s *Syncer) Push(ctx context.Context, key *api.Key) error {
-	if s.client == nil {
-		return errors.Errorf("no vault client set")
+	if s.remote == nil {
+		return errors.Errorf("no remote set")
 	}
 	if !key.IsEdX25519() {
 		return errors.Errorf("invalid key")
@@ -77,7 +83,7 @@ func (s *Syncer) Push(ctx context.Context, key *api.Key) error {
 
 		from := push[0].Index
 		to := int64(-1)
-		out := [][]byte{}
+		out := []*client.PushEvent{}
 		total := int(0)
 		max := 4 * 1000 * 1000 // Max 4MB
 		for _, p := range push {
@@ -87,13 +93,13 @@ func (s *Syncer) Push(ctx context.Context, key *api.Key) error {
 				break
 			}
 
-			out = append(out, p.Data)
+			out = append(out, &client.PushEvent{ID: p.ID, Data: p.Data})
 			to = p.Index
 			total += len(p.Data)
 		}
 
 		logger.Infof("Pushing %d-%d (%db) %s...", from, to, total, key.ID)
-		if err := s.client.Post(ctx, key.AsEdX25519(), out); err != nil {
+		if err := s.remote.Post(ctx, key.AsEdX25519(), out); err != nil {
 			return err
 		}
 		logger.Infof("Clearing push (<=%d)...", to)
@@ -105,9 +111,12 @@ func (s *Syncer) Push(ctx context.Context, key *api.Key) error {
 
 // Pull from remote.
 func (s *Syncer) Pull(ctx context.Context, key *api.Key) error {
+	if err := s.pullSnapshot(ctx, key); err != nil {
+		return errors.Wrapf(err, "failed to pull snapshot")
+	}
 	// Keep pulling until no more or cancel.
 	for {
-		local, err := pullIndex(s.db, key.ID)
+		local, err := PullIndex(s.db, key.ID)
 		if err != nil {
 			return err
 		}
@@ -123,16 +132,71 @@ func (s *Syncer) Pull(ctx context.Context, key *api.Key) error {
 	return nil
 }
 
+func (s *Syncer) pullSnapshot(ctx context.Context, key *api.Key) error {
+	if s.snapshotReceiver == nil {
+		return nil
+	}
+	snapshots, ok := s.remote.(client.Snapshots)
+	if !ok {
+		return nil
+	}
+	if !key.IsEdX25519() {
+		return errors.Errorf("invalid key")
+	}
+	local, err := PullIndex(s.db, key.ID)
+	if err != nil {
+		return err
+	}
+	snapshot, err := snapshots.Snapshot(ctx, key.AsEdX25519())
+	if err != nil {
+		return err
+	}
+	if snapshot == nil || snapshot.Index <= local {
+		return nil
+	}
+	logger.Infof("Applying snapshot (ridx=%d)...", snapshot.Index)
+	return Transact(s.db, func(tx *sqlx.Tx) error {
+		ok, err := s.snapshotReceiver(&Context{key.ID, tx}, snapshot)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			logger.Infof("Snapshot (ridx=%d) not applied", snapshot.Index)
+			return nil
+		}
+		return setCheckpointTx(tx, key.ID, snapshot)
+	})
+}
+
+// PushSnapshot stores a snapshot on the remote and as the local checkpoint.
+// The snapshot should cover the events up to the PullIndex.
+func (s *Syncer) PushSnapshot(ctx context.Context, key *api.Key, snapshot *client.Snapshot) error {
+	snapshots, ok := s.remote.(client.Snapshots)
+	if !ok {
+		return errors.Errorf("remote doesn't support snapshots")
+	}
+	if !key.IsEdX25519() {
+		return errors.Errorf("invalid key")
+	}
+	logger.Infof("Pushing snapshot (ridx=%d)...", snapshot.Index)
+	if err := snapshots.PutSnapshot(ctx, key.AsEdX25519(), snapshot); err != nil {
+		return err
+	}
+	return Transact(s.db, func(tx *sqlx.Tx) error {
+		return setCheckpointTx(tx, key.ID, snapshot)
+	})
+}
+
 func (s *Syncer) pullNext(ctx context.Context, key *api.Key, index int64) (bool, error) {
-	if s.client == nil {
-		return false, errors.Errorf("no vault client set")
+	if s.remote == nil {
+		return false, errors.Errorf("no remote set")
 	}
 	if !key.IsEdX25519() {
 		return false, errors.Errorf("invalid key")
 	}
 
 	logger.Infof("Pulling from ridx=%d", index)
-	events, err := s.client.Events(ctx, key.AsEdX25519(), index)
+	events, err := s.remote.Events(ctx, key.AsEdX25519(), index)
 	if err != nil {
 		return false, err
 	}
@@ -153,13 +217,17 @@ func (s *Syncer) applyPull(vid keys.ID, events *client.Events) error {
 		return nil
 	}
 	return Transact(s.db, func(tx *sqlx.Tx) error {
+		received, err := dedupeTx(tx, vid, events.Events)
+		if err != nil {
+			return err
+		}
 		if err := setPullTx(tx, events.Events); err != nil {
 			return err
 		}
 
-		if s.receiver != nil {
+		if s.receiver != nil && len(received) > 0 {
 			rctx := &Context{vid, tx}
-			if err := s.receiver(rctx, events.Events); err != nil {
+			if err := s.receiver(rctx, received); err != nil {
 				return err
 			}
 		}
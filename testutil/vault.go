@@ -8,19 +8,36 @@ import (
 	"github.com/keys-pub/keys/tsutil"
 	"github.com/keys-pub/vault"
 	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/client"
 	"github.com/stretchr/testify/require"
 )
 
 func NewTestVault(t *testing.T, env *Env) (*vault.Vault, func()) {
-	var err error
 	client := NewVaultClient(t, env)
+	return newTestVault(t, vault.WithClient(client))
+}
+
+// NewTestVaultWithRemote creates a vault with a remote (and setup with a
+// password and client key), instead of using the test server.
+func NewTestVaultWithRemote(t *testing.T, remote client.Remote, password string, ck *api.Key, opt ...vault.Option) (*vault.Vault, func()) {
+	vlt, closeFn := newTestVault(t, append(opt, vault.WithRemote(remote))...)
+	_, err := vlt.SetupPassword(password)
+	require.NoError(t, err)
+	err = vlt.SetClientKey(ck)
+	require.NoError(t, err)
+	return vlt, closeFn
+}
+
+func newTestVault(t *testing.T, opt ...vault.Option) (*vault.Vault, func()) {
+	var err error
 	path := Path()
 	authPath := Path()
 
 	auth, err := auth.NewDB(authPath)
 	require.NoError(t, err)
 
-	vlt, err := vault.New(path, auth, vault.WithClient(client), vault.WithClock(tsutil.NewTestClock()))
+	opt = append(opt, vault.WithClock(tsutil.NewTestClock()))
+	vlt, err := vault.New(path, auth, opt...)
 	require.NoError(t, err)
 
 	closeFn := func() {
@@ -32,6 +49,7 @@ func NewTestVault(t *testing.T, env *Env) (*vault.Vault, func()) {
 		require.NoError(t, err)
 		err = os.Remove(path)
 		require.NoError(t, err)
+		_ = os.Remove(path + ".lock")
 	}
 
 	return vlt, closeFn
@@ -45,3 +63,18 @@ func NewTestVaultWithSetup(t *testing.T, env *Env, password string, ck *api.Key)
 	require.NoError(t, err)
 	return vlt, closeFn
 }
+
+// TrustDevices has each vault trust the device keys of the other vaults.
+func TrustDevices(t *testing.T, vlts ...*vault.Vault) {
+	for _, vlt := range vlts {
+		for _, other := range vlts {
+			if vlt == other {
+				continue
+			}
+			dk, err := other.DeviceKey()
+			require.NoError(t, err)
+			err = vlt.Keyring().TrustDevice(dk.ID())
+			require.NoError(t, err)
+		}
+	}
+}
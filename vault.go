@@ -3,6 +3,8 @@ package vault
 import (
 	"context"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/keys-pub/keys"
@@ -23,16 +25,44 @@ var ErrLocked = errors.New("vault is locked")
 // ErrInvalidAuth if auth is invalid.
 var ErrInvalidAuth = auth.ErrInvalidAuth
 
+// ErrThrottled if there were too many failed password or paper key attempts.
+type ErrThrottled = auth.ErrThrottled
+
+// ErrRotationPending if a master key rotation was interrupted, see Unlock.
+var ErrRotationPending = auth.ErrRotationPending
+
+// ErrReadOnly if the vault was unlocked read-only (see UnlockReadOnly).
+var ErrReadOnly = errors.New("vault is read-only")
+
 // ErrSetupNeeded if setup if needed.
 var ErrSetupNeeded = errors.New("setup needed")
 
 // Vault syncs secrets.
 type Vault struct {
 	path string
-	db   *sqlx.DB
 
-	clock  tsutil.Clock
-	client *client.Client
+	// mtx protects conn, umtx serializes opening and closing it (Setup,
+	// Unlock, Lock, Reset and RotateMasterKey).
+	mtx  sync.Mutex
+	umtx sync.Mutex
+	conn *conn
+
+	clock    tsutil.Clock
+	remote   client.Remote
+	resolver Resolver
+	prune    PrunePolicy
+
+	session    SessionStore
+	sessionTTL time.Duration
+
+	idleTimeout time.Duration
+
+	// smtx protects the status listeners and idle timer.
+	smtx         sync.Mutex
+	listeners    map[int]func(Status)
+	nextListener int
+	idleTimer    *time.Timer
+	lastAccess   time.Time
 
 	auth *auth.DB
 
@@ -45,22 +75,29 @@ type Vault struct {
 func New(path string, auth *auth.DB, opt ...Option) (*Vault, error) {
 	opts := newOptions(opt...)
 
-	cl := opts.Client
-	if cl == nil {
+	remote := opts.Remote
+	if remote == nil {
 		c, err := client.New("https://getchill.app")
 		if err != nil {
 			return nil, err
 		}
-		cl = c
+		remote = c
 	}
 
 	clock := tsutil.NewClock()
 
 	v := &Vault{
-		path:   path,
-		client: cl,
-		clock:  clock,
-		auth:   auth,
+		path:     path,
+		remote:   remote,
+		clock:    clock,
+		auth:     auth,
+		resolver: opts.Resolver,
+		prune:    opts.Prune,
+
+		session:    opts.Session,
+		sessionTTL: opts.SessionTTL,
+
+		idleTimeout: opts.IdleTimeout,
 	}
 	v.kr = NewKeyring(v)
 	return v, nil
@@ -86,7 +123,7 @@ func (v *Vault) Status() Status {
 	if _, err := os.Stat(v.path); os.IsNotExist(err) {
 		return SetupNeeded
 	}
-	if v.db == nil {
+	if v.current() == nil {
 		return Locked
 	}
 	return Unlocked
@@ -95,22 +132,39 @@ func (v *Vault) Status() Status {
 // Setup vault.
 // Doesn't unlock.
 func (v *Vault) Setup(mk *[32]byte) error {
+	if err := v.setup(mk); err != nil {
+		return err
+	}
+	v.notifyStatus(Unlocked)
+	return nil
+}
+
+func (v *Vault) setup(mk *[32]byte) error {
 	logger.Debugf("Setup...")
-	if v.db != nil {
+	v.umtx.Lock()
+	defer v.umtx.Unlock()
+	if v.current() != nil {
 		return errors.Errorf("already unlocked")
 	}
+	lock, err := lockFile(lockPath(v.path), false)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(v.path); err == nil {
+		_ = lock.release()
 		return errors.Errorf("already setup")
 	}
 
 	// This creates a new db file (and on error we'll remove it).
 	db, err := openDB(v.path, mk)
 	if err != nil {
+		_ = lock.release()
 		return err
 	}
 	onErrFn := func() {
 		_ = db.Close()
 		_ = os.Remove(v.path)
+		_ = lock.release()
 	}
 
 	if err := initTables(db); err != nil {
@@ -118,28 +172,93 @@ func (v *Vault) Setup(mk *[32]byte) error {
 		return err
 	}
 
-	v.db = db
+	v.setConn(db, mk, lock, false)
 
 	logger.Debugf("Setup complete")
 	return nil
 }
 
 // Unlock vault.
+// If a master key rotation was interrupted, returns ErrRotationPending, and
+// unlocking with an auth method (for example UnlockWithPassword) completes the
+// rotation and returns the new master key.
 func (v *Vault) Unlock(mk *[32]byte) error {
+	if _, err := v.open(mk, false); err != nil {
+		return err
+	}
+	v.setSession(mk)
+	return nil
+}
+
+// unlock vault with a master key from an auth method, returning the master
+// key, and save it to the session (see WithSession).
+// This may be different from the specified master key if we completed an
+// interrupted master key rotation.
+func (v *Vault) unlock(mk *[32]byte) (*[32]byte, error) {
+	out, err := v.open(mk, true)
+	if err != nil {
+		return nil, err
+	}
+	v.setSession(out)
+	return out, nil
+}
+
+// open the vault database, returning the master key.
+// If resume, completes an interrupted master key rotation (see unlock).
+func (v *Vault) open(mk *[32]byte, resume bool) (*[32]byte, error) {
+	v.umtx.Lock()
+	out, opened, err := v.openConn(mk, nil, resume)
+	v.umtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if opened {
+		v.notifyStatus(Unlocked)
+	}
+	return out, nil
+}
+
+// openConn opens the vault database, returning the master key.
+// If lock is nil, the file lock is acquired (or ErrInUse is returned),
+// otherwise lock is a held file lock (see closeDB).
+// If resume, completes an interrupted master key rotation (see unlock).
+// Returns false if already unlocked.
+// Requires umtx.
+func (v *Vault) openConn(mk *[32]byte, lock *fileLock, resume bool) (*[32]byte, bool, error) {
 	logger.Debugf("Unlock...")
 
-	if v.db != nil {
+	if c := v.current(); c != nil {
+		if c.readOnly {
+			return nil, false, errors.Errorf("already unlocked read-only")
+		}
 		logger.Debugf("Already unlocked")
-		return nil
+		return mk, false, nil
 	}
 
 	if _, err := os.Stat(v.path); os.IsNotExist(err) {
-		return ErrSetupNeeded
+		return nil, false, ErrSetupNeeded
 	}
 
+	if lock == nil {
+		l, err := lockFile(lockPath(v.path), false)
+		if err != nil {
+			return nil, false, err
+		}
+		lock = l
+	}
+	mk, err := v.openLocked(mk, lock, resume)
+	if err != nil {
+		_ = lock.release()
+		return nil, false, err
+	}
+	return mk, true, nil
+}
+
+// openLocked opens the vault database with the file lock held.
+func (v *Vault) openLocked(mk *[32]byte, lock *fileLock, resume bool) (*[32]byte, error) {
 	db, err := openDB(v.path, mk)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	onErrFn := func() {
 		_ = db.Close()
@@ -147,30 +266,98 @@ func (v *Vault) Unlock(mk *[32]byte) error {
 
 	if err := initTables(db); err != nil {
 		onErrFn()
-		return err
+		rdb, newMK, rerr := v.resumeRotation(mk, resume)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if rdb == nil {
+			return nil, err
+		}
+		db, mk = rdb, newMK
+	} else if v.auth != nil {
+		// The database opens with mk, so a rotation from mk was interrupted
+		// before the rekey.
+		if err := v.auth.DropRotation(mk); err != nil {
+			logger.Warningf("Failed to drop rotation: %v", err)
+		}
 	}
 
-	v.db = db
+	v.setConn(db, mk, lock, false)
 
 	logger.Debugf("Unlocked")
+	return mk, nil
+}
+
+// UnlockReadOnly opens the vault database read-only (sqlite mode=ro).
+// Changes to the vault (keyring, config, sync, auth methods or master key)
+// fail with ErrReadOnly.
+// Other processes can also unlock read-only, but not read-write (ErrInUse).
+// The master key isn't saved to the session (see WithSession).
+func (v *Vault) UnlockReadOnly(mk *[32]byte) error {
+	v.umtx.Lock()
+	opened, err := v.openReadOnly(mk)
+	v.umtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if opened {
+		v.notifyStatus(Unlocked)
+	}
 	return nil
 }
 
+// ReadOnly returns true if unlocked read-only.
+func (v *Vault) ReadOnly() bool {
+	c := v.current()
+	return c != nil && c.readOnly
+}
+
+// openReadOnly opens the vault database read-only.
+// Returns false if already unlocked read-only.
+// Requires umtx.
+func (v *Vault) openReadOnly(mk *[32]byte) (bool, error) {
+	logger.Debugf("Unlock (read-only)...")
+	if c := v.current(); c != nil {
+		if !c.readOnly {
+			return false, errors.Errorf("already unlocked (not read-only)")
+		}
+		return false, nil
+	}
+	if _, err := os.Stat(v.path); os.IsNotExist(err) {
+		return false, ErrSetupNeeded
+	}
+
+	lock, err := lockFile(lockPath(v.path), true)
+	if err != nil {
+		return false, err
+	}
+	db, err := openReadOnlyDB(v.path, mk)
+	if err != nil {
+		_ = lock.release()
+		return false, err
+	}
+	v.setConn(db, mk, lock, true)
+
+	logger.Debugf("Unlocked (read-only)")
+	return true, nil
+}
+
 // Lock vault.
+// Cancels syncs and waits for operations in progress, operations after this
+// fail with ErrLocked.
 func (v *Vault) Lock() error {
 	logger.Debugf("Locking...")
-
-	if v.db == nil {
+	v.umtx.Lock()
+	locked, err := v.closeConn()
+	v.umtx.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "failed to close db")
+	}
+	if !locked {
 		logger.Debugf("Already locked")
 		return nil
 	}
-	db := v.db
-	v.db = nil
-
-	if err := db.Close(); err != nil {
-		return errors.Wrapf(err, "failed to close db")
-	}
-
+	v.notifyStatus(Locked)
 	return nil
 }
 
@@ -179,11 +366,11 @@ func (v *Vault) Lock() error {
 // Registering also sync's the keyring.
 // Requires Unlock.
 func (v *Vault) Register(ctx context.Context, key *keys.EdX25519Key, account *keys.EdX25519Key) (*api.Key, error) {
-	if v.db == nil {
-		return nil, ErrLocked
+	if err := v.writable(); err != nil {
+		return nil, err
 	}
 
-	vault, err := v.client.Get(ctx, key)
+	vault, err := v.remote.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -193,7 +380,7 @@ func (v *Vault) Register(ctx context.Context, key *keys.EdX25519Key, account *ke
 		vk = api.NewKey(key).Created(vault.Timestamp)
 		vk.SetExtString("token", vault.Token)
 	} else {
-		k, err := v.client.Register(ctx, key, account)
+		k, err := v.remote.Register(ctx, key, account)
 		if err != nil {
 			return nil, err
 		}
@@ -216,10 +403,12 @@ func (v *Vault) Register(ctx context.Context, key *keys.EdX25519Key, account *ke
 // You can create a vault using Create.
 // Requires Unlock.
 func (v *Vault) Add(key *keys.EdX25519Key, b []byte, cipher syncer.Cipher) error {
-	if v.db == nil {
-		return ErrLocked
+	c, err := v.useWrite()
+	if err != nil {
+		return err
 	}
-	return syncer.Transact(v.db, func(tx *sqlx.Tx) error {
+	defer c.release()
+	return syncer.Transact(c.db, func(tx *sqlx.Tx) error {
 		if err := syncer.AddTx(tx, key, b, cipher); err != nil {
 			return errors.Wrapf(err, "failed to add")
 		}
@@ -234,24 +423,41 @@ func (v *Vault) Keyring() *Keyring {
 
 // DB returns underlying database if vault is open.
 // Returns nil if locked.
+// Lock doesn't wait for callers of DB (unlike vault and keyring operations)
+// before closing the database.
+// This resets the idle lock timer (see WithIdleLock).
 func (v *Vault) DB() *sqlx.DB {
-	if v.db == nil {
+	c := v.current()
+	if c == nil {
 		return nil
 	}
-	return v.db
+	v.touch()
+	return c.db
 }
 
 // ClientKey is the vault client key.
 func (v *Vault) ClientKey() (*api.Key, error) {
-	if v.db == nil {
-		return nil, ErrLocked
+	c, err := v.use()
+	if err != nil {
+		return nil, err
 	}
-	return clientKey(v.db)
+	defer c.release()
+	return clientKey(c.db)
 }
 
 // Client is the vault client.
+// Returns nil if the remote isn't a client (see Remote).
 func (v *Vault) Client() *client.Client {
-	return v.client
+	cl, ok := v.remote.(*client.Client)
+	if !ok {
+		return nil
+	}
+	return cl
+}
+
+// Remote the vault syncs with.
+func (v *Vault) Remote() client.Remote {
+	return v.remote
 }
 
 func clientKey(db *sqlx.DB) (*api.Key, error) {
@@ -270,10 +476,12 @@ func clientKey(db *sqlx.DB) (*api.Key, error) {
 }
 
 func (v *Vault) SetClientKey(ck *api.Key) error {
-	if v.db == nil {
-		return ErrLocked
+	c, err := v.useWrite()
+	if err != nil {
+		return err
 	}
-	return setClientKey(v.db, ck)
+	defer c.release()
+	return setClientKey(c.db, ck)
 }
 
 func setClientKey(db *sqlx.DB, ck *api.Key) error {
@@ -287,7 +495,3 @@ func setClientKey(db *sqlx.DB, ck *api.Key) error {
 
 	return nil
 }
-
-func (v *Vault) Reset() error {
-	return errors.Errorf("not implemented")
-}
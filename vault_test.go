@@ -2,10 +2,13 @@ package vault_test
 
 import (
 	"context"
+	"os"
 	"testing"
 
 	"github.com/keys-pub/keys"
 	"github.com/keys-pub/vault"
+	"github.com/keys-pub/vault/auth"
+	"github.com/keys-pub/vault/client"
 	"github.com/keys-pub/vault/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -70,6 +73,24 @@ func TestVaultLocked(t *testing.T) {
 	require.EqualError(t, err, "vault is locked")
 }
 
+func TestVaultWithClientNil(t *testing.T) {
+	path := testutil.Path()
+	defer func() { _ = os.Remove(path) }()
+	authPath := testutil.Path()
+	defer func() { _ = os.Remove(authPath) }()
+	authDB, err := auth.NewDB(authPath)
+	require.NoError(t, err)
+	defer func() { _ = authDB.Close() }()
+
+	var cl *client.Client
+	vlt, err := vault.New(path, authDB, vault.WithClient(cl))
+	require.NoError(t, err)
+	// Uses the default client (not a typed nil)
+	rm, ok := vlt.Remote().(*client.Client)
+	require.True(t, ok)
+	require.NotNil(t, rm)
+}
+
 func TestVaultInvalidPassword(t *testing.T) {
 	var err error
 	env := testutil.NewEnv(t, vault.ErrLevel)
@@ -83,3 +104,204 @@ func TestVaultInvalidPassword(t *testing.T) {
 	_, err = vlt.UnlockWithPassword("invalidpassword")
 	require.EqualError(t, err, "invalid auth")
 }
+
+func TestVaultReset(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	defer env.CloseFn()
+
+	alice := keys.NewEdX25519KeyFromSeed(testutil.Seed(0x01))
+	testutil.AccountCreate(t, env, alice, "alice@getchill.app")
+	ck := testutil.RegisterClient(t, env, keys.NewEdX25519KeyFromSeed(testutil.Seed(0xa0)), alice)
+
+	vlt, closeFn := testutil.NewTestVaultWithSetup(t, env, "testpassword", ck)
+	defer closeFn()
+
+	err = vlt.Config().Set("key1", "val1")
+	require.NoError(t, err)
+	// Auth for another vault
+	other, err := vlt.Auth().RegisterPassword("otherpassword", keys.Rand32())
+	require.NoError(t, err)
+
+	err = vlt.Reset(context.TODO(), vault.WithDeleteRemote())
+	require.NoError(t, err)
+	require.Equal(t, vault.SetupNeeded, vlt.Status())
+
+	auths, err := vlt.Auth().List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+	require.Equal(t, other.ID, auths[0].ID)
+
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.EqualError(t, err, "invalid auth")
+
+	// Setup again
+	_, err = vlt.SetupPassword("testpassword2")
+	require.NoError(t, err)
+	val, err := vlt.Config().String("key1")
+	require.NoError(t, err)
+	require.Equal(t, "", val)
+
+	// Reset while locked (removes auth for the master key it was last
+	// unlocked with)
+	err = vlt.Lock()
+	require.NoError(t, err)
+	err = vlt.Reset(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, vault.SetupNeeded, vlt.Status())
+	auths, err = vlt.Auth().List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+	require.Equal(t, other.ID, auths[0].ID)
+
+	_, err = vlt.SetupPassword("testpassword3")
+	require.NoError(t, err)
+}
+
+func TestVaultChangePassword(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	defer env.CloseFn()
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	// Locked
+	_, err = vlt.ChangePassword("testpassword", "testpassword2")
+	require.Equal(t, vault.ErrLocked, err)
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+
+	_, err = vlt.ChangePassword("invalidpassword", "testpassword2")
+	require.EqualError(t, err, "invalid auth")
+
+	// Password for another vault (shared auth db)
+	other, err := vlt.Auth().RegisterPassword("otherpassword", keys.Rand32())
+	require.NoError(t, err)
+	_, err = vlt.ChangePassword("otherpassword", "testpassword2")
+	require.EqualError(t, err, "invalid auth")
+
+	reg, err := vlt.ChangePassword("testpassword", "testpassword2")
+	require.NoError(t, err)
+	auths, err := vlt.Auth().List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(auths))
+	ids := []string{auths[0].ID, auths[1].ID}
+	require.Contains(t, ids, reg.ID)
+	require.Contains(t, ids, other.ID)
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.EqualError(t, err, "invalid auth")
+	out, err := vlt.UnlockWithPassword("testpassword2")
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+}
+
+func TestVaultRemoveAuth(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	defer env.CloseFn()
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+	auths, err := vlt.Auth().List()
+	require.NoError(t, err)
+	pw := auths[0]
+
+	// Auth for another vault (shared auth db) isn't counted or removable
+	other, err := vlt.Auth().RegisterPassword("otherpassword", keys.Rand32())
+	require.NoError(t, err)
+	err = vlt.RemoveAuth(other.ID)
+	require.EqualError(t, err, "auth not found "+other.ID)
+
+	// Last auth
+	err = vlt.RemoveAuth(pw.ID)
+	require.Equal(t, vault.ErrLastAuth, err)
+
+	pk, err := vlt.RegisterPaperKey(mk, keys.RandPhrase())
+	require.NoError(t, err)
+
+	// Last non-password auth
+	err = vlt.RemoveAuth(pk.ID)
+	require.Equal(t, vault.ErrLastNonPasswordAuth, err)
+
+	err = vlt.RemoveAuth("notfound")
+	require.EqualError(t, err, "auth not found notfound")
+
+	// Locked
+	err = vlt.Lock()
+	require.NoError(t, err)
+	err = vlt.RemoveAuth(pw.ID)
+	require.Equal(t, vault.ErrLocked, err)
+	_, err = vlt.UnlockWithPassword("testpassword")
+	require.NoError(t, err)
+
+	// Remove password
+	err = vlt.RemoveAuth(pw.ID)
+	require.NoError(t, err)
+	err = vlt.RemoveAuth(pk.ID)
+	require.Equal(t, vault.ErrLastAuth, err)
+
+	// Force
+	err = vlt.RemoveAuth(pk.ID, vault.WithForce())
+	require.NoError(t, err)
+	auths, err = vlt.Auth().List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(auths))
+	require.Equal(t, other.ID, auths[0].ID)
+}
+
+func TestVaultShamir(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+
+	_, shares, err := vlt.RegisterShamir(mk, 3, 2)
+	require.NoError(t, err)
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	_, err = vlt.UnlockWithShamir(shares[1:2])
+	require.EqualError(t, err, "not enough shares")
+
+	out, err := vlt.UnlockWithShamir([]string{shares[1], shares[2]})
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+}
+
+func TestVaultX25519(t *testing.T) {
+	var err error
+	env := testutil.NewEnv(t, vault.ErrLevel)
+	vlt, closeFn := testutil.NewTestVault(t, env)
+	defer closeFn()
+
+	mk, err := vlt.SetupPassword("testpassword")
+	require.NoError(t, err)
+
+	identity := keys.GenerateX25519Key()
+	_, err = vlt.RegisterX25519(mk, identity.ID())
+	require.NoError(t, err)
+
+	err = vlt.Lock()
+	require.NoError(t, err)
+
+	_, err = vlt.UnlockWithX25519(keys.GenerateX25519Key())
+	require.EqualError(t, err, "invalid auth")
+
+	out, err := vlt.UnlockWithX25519(identity)
+	require.NoError(t, err)
+	require.Equal(t, mk, out)
+}
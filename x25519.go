@@ -0,0 +1,29 @@
+package vault
+
+import (
+	"github.com/keys-pub/keys"
+	"github.com/keys-pub/vault/auth"
+)
+
+// RegisterX25519 adds X25519 auth for a recipient (public key ID, kbx...).
+func (v *Vault) RegisterX25519(mk *[32]byte, recipient keys.ID) (*auth.Auth, error) {
+	if err := v.writable(); err != nil {
+		return nil, err
+	}
+	reg, err := v.auth.RegisterX25519(recipient, mk)
+	if err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// UnlockWithX25519 opens vault with an X25519 identity, for example from an
+// identity file (auth.ReadX25519Identity) or the environment
+// (auth.X25519IdentityFromEnv).
+func (v *Vault) UnlockWithX25519(identity *keys.X25519Key) (*[32]byte, error) {
+	_, mk, err := v.auth.X25519(identity)
+	if err != nil {
+		return nil, err
+	}
+	return v.unlock(mk)
+}